@@ -0,0 +1,464 @@
+package gtmcdc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error Messages
+const (
+	ErrorNotAvro = "not in avro wire format"
+)
+
+const (
+	avroNamespace           = "gtmcdc"
+	avroDictionaryNamespace = "gtmcdc.dictionary"
+
+	// magic byte of the Confluent wire format
+	avroMagic = 0
+
+	avroRegistryBackoff    = time.Second
+	avroRegistryMaxBackoff = 30 * time.Second
+	avroRegistryMaxWait    = 2 * time.Minute
+)
+
+var avroName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// AvroEncoder encodes units in Avro with the Confluent wire format, i.e.
+// a zero byte and the 4 bytes schema id followed by the Avro binary.
+//
+// A single record is a gtmcdc.JournalEvent and a transaction is a
+// gtmcdc.TransactionEvent, which have the same fields as in JSON. The fields
+// from the dictionary are a map of nullable string, long and boolean, where
+// decimals and dates are strings. A single record in the dictionary is a
+// gtmcdc.dictionary.<name> instead, whose fields is a record of the fields.
+//
+// Schemas are registered with the subject <topic>-<schema full name>,
+// i.e. the TopicRecordNameStrategy of the Confluent serializers. While the
+// Schema Registry is unavailable, registering is retried with backoff for
+// up to maxWait, then encoding fails and the failure policy of the sink
+// decides whether the filter stops.
+type AvroEncoder struct {
+	registry   SchemaRegistry
+	topic      string
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxWait    time.Duration
+
+	mu     sync.Mutex
+	codecs map[string]*avroCodec
+}
+
+type avroCodec struct {
+	id    int
+	codec *goavro.Codec
+}
+
+// NewAvroEncoder returns the encoder which registers schemas for the topic
+func NewAvroEncoder(registry SchemaRegistry, topic string) *AvroEncoder {
+	return &AvroEncoder{
+		registry:   registry,
+		topic:      topic,
+		backoff:    avroRegistryBackoff,
+		maxBackoff: avroRegistryMaxBackoff,
+		maxWait:    avroRegistryMaxWait,
+		codecs:     map[string]*avroCodec{},
+	}
+}
+
+// Encode returns the message with the Avro encoded unit
+func (a *AvroEncoder) Encode(unit *Unit) (*Message, error) {
+	if !unit.done {
+		return nil, errors.New("transaction not committed")
+	}
+
+	var name string
+	var schema func() (map[string]interface{}, error)
+	var native map[string]interface{}
+
+	if unit.IsTransaction() {
+		event := unit.transactionEvent()
+		name, schema = avroNamespace+".TransactionEvent", avroTransactionSchema
+		native = avroTransaction(event)
+	} else {
+		rec := unit.Records[0]
+		event := rec.Event()
+		if record := rec.detail.record; record != nil && event.Fields != nil {
+			if !avroName.MatchString(record.Name) {
+				return nil, fmt.Errorf("%s is not a valid avro name", record.Name)
+			}
+			name = avroDictionaryNamespace + "." + record.Name
+			schema = func() (map[string]interface{}, error) { return avroDictionarySchema(record), nil }
+			native = avroEvent(event, avroDictionaryFields(event.Fields))
+		} else {
+			name, schema = avroNamespace+".JournalEvent", avroEventSchema
+			native = avroEvent(event, avroFieldsMap(event.Fields))
+		}
+	}
+
+	codec, err := a.codec(name, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 5)
+	header[0] = avroMagic
+	binary.BigEndian.PutUint32(header[1:], uint32(codec.id))
+
+	value, err := codec.codec.BinaryFromNative(header, native)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Value: string(value)}, nil
+}
+
+// codec returns the codec of the schema, the schema is
+// registered when it is used for the first time
+func (a *AvroEncoder) codec(name string, schema func() (map[string]interface{}, error)) (*avroCodec, error) {
+	a.mu.Lock()
+	codec, exists := a.codecs[name]
+	a.mu.Unlock()
+
+	if exists {
+		return codec, nil
+	}
+
+	s, err := schema()
+	if err != nil {
+		return nil, err
+	}
+	text, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := goavro.NewCodec(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	// registered without the lock, registering again is harmless
+	id, err := a.register(a.topic+"-"+name, c.CanonicalSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.codecs[name] = &avroCodec{id: id, codec: c}
+	return a.codecs[name], nil
+}
+
+// register the schema, retrying while the registry is unavailable
+// for up to maxWait
+func (a *AvroEncoder) register(subject, schema string) (int, error) {
+	start := time.Now()
+	backoff := a.backoff
+	for {
+		id, err := a.registry.Register(subject, schema)
+		if err == nil || !isRegistryUnavailable(err) {
+			return id, err
+		}
+		if time.Since(start)+backoff > a.maxWait {
+			return 0, fmt.Errorf("schema registry unavailable for %v. %v", time.Since(start).Round(time.Millisecond), err)
+		}
+
+		log.Warnf("schema registry unavailable, retry in %v. %+v", backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > a.maxBackoff {
+			backoff = a.maxBackoff
+		}
+	}
+}
+
+// DecodeAvro decodes a message value in the Confluent wire format with
+// the schema from the registry, records are returned as maps
+func DecodeAvro(registry SchemaRegistry, value []byte) (interface{}, error) {
+	if len(value) < 5 || value[0] != avroMagic {
+		return nil, errors.New(ErrorNotAvro)
+	}
+
+	schema, err := registry.Schema(int(binary.BigEndian.Uint32(value[1:5])))
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromBinary(value[5:])
+	return native, err
+}
+
+// avroEventFields are the fields of a JournalEvent without the dictionary
+// fields, the fields from the state store are null without the state store
+func avroEventFields() []interface{} {
+	field := func(name string, typ interface{}) map[string]interface{} {
+		return map[string]interface{}{"name": name, "type": typ}
+	}
+	nullable := func(name string, typ interface{}) map[string]interface{} {
+		return map[string]interface{}{"name": name, "type": []interface{}{"null", typ}, "default": nil}
+	}
+	strings := map[string]interface{}{"type": "array", "items": "string"}
+
+	return []interface{}{
+		field("operand", "string"),
+		field("transaction_num", "string"),
+		field("token", "string"),
+		field("token_seq", "long"),
+		field("update_num", "long"),
+		field("stream_num", "long"),
+		field("stream_seq", "long"),
+		field("journal_seq", "long"),
+		field("partners", "string"),
+		field("transaction_tag", "string"),
+		field("pid", "int"),
+		field("client_pid", "int"),
+		field("global", "string"),
+		field("key", "string"),
+		field("subscripts", strings),
+		field("node_values", strings),
+		field("time_stamp", "long"),
+		field("record", "string"),
+		nullable("previous_values", strings),
+		nullable("changes", map[string]interface{}{"type": "array", "items": map[string]interface{}{
+			"type": "record",
+			"name": "PieceChange",
+			"fields": []interface{}{
+				field("piece", "long"),
+				field("old", "string"),
+				field("new", "string"),
+			},
+		}}),
+		nullable("deleted", map[string]interface{}{"type": "array", "items": map[string]interface{}{
+			"type": "record",
+			"name": "DeletedNode",
+			"fields": []interface{}{
+				field("key", "string"),
+				field("subscripts", strings),
+				field("node_values", strings),
+			},
+		}}),
+	}
+}
+
+func avroEventRecord() map[string]interface{} {
+	fields := append(avroEventFields(), map[string]interface{}{
+		"name": "fields",
+		"type": []interface{}{"null", map[string]interface{}{
+			"type":   "map",
+			"values": []interface{}{"null", "string", "long", "boolean"},
+		}},
+		"default": nil,
+	})
+
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      "JournalEvent",
+		"namespace": avroNamespace,
+		"fields":    fields,
+	}
+}
+
+func avroEventSchema() (map[string]interface{}, error) {
+	return avroEventRecord(), nil
+}
+
+func avroTransactionSchema() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      "TransactionEvent",
+		"namespace": avroNamespace,
+		"fields": []interface{}{
+			map[string]interface{}{"name": "operand", "type": "string"},
+			map[string]interface{}{"name": "transaction_num", "type": "string"},
+			map[string]interface{}{"name": "token", "type": "string"},
+			map[string]interface{}{"name": "token_seq", "type": "long"},
+			map[string]interface{}{"name": "stream_num", "type": "long"},
+			map[string]interface{}{"name": "stream_seq", "type": "long"},
+			map[string]interface{}{"name": "journal_seq", "type": "long"},
+			map[string]interface{}{"name": "partners", "type": "string"},
+			map[string]interface{}{"name": "transaction_tag", "type": "string"},
+			map[string]interface{}{"name": "time_stamp", "type": "long"},
+			map[string]interface{}{"name": "updates", "type": map[string]interface{}{
+				"type":  "array",
+				"items": avroEventRecord(),
+			}},
+		},
+	}, nil
+}
+
+// avroDictionarySchema is the schema of a JournalEvent
+// whose fields is a record of the dictionary fields
+func avroDictionarySchema(record *DictionaryRecord) map[string]interface{} {
+	var fields []interface{}
+	for _, sub := range record.pattern.Subscripts {
+		if sub.Name != "" {
+			fields = append(fields, map[string]interface{}{
+				"name": sub.Name, "type": []interface{}{"null", "string"}, "default": nil,
+			})
+		}
+	}
+	for _, field := range record.Fields {
+		fields = append(fields, map[string]interface{}{
+			"name": field.Name, "type": []interface{}{"null", avroFieldType(field.Type)}, "default": nil,
+		})
+	}
+
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      record.Name,
+		"namespace": avroDictionaryNamespace,
+		"fields": append(avroEventFields(), map[string]interface{}{
+			"name": "fields",
+			"type": map[string]interface{}{
+				"type":   "record",
+				"name":   record.Name + "_fields",
+				"fields": fields,
+			},
+		}),
+	}
+}
+
+func avroFieldType(typ string) string {
+	switch typ {
+	case FieldInteger:
+		return "long"
+	case FieldBoolean:
+		return "boolean"
+	}
+	// decimals are strings to keep all digits
+	return "string"
+}
+
+// avroEvent returns the native Avro record of the JournalEvent
+func avroEvent(event *JournalEvent, fields interface{}) map[string]interface{} {
+	native := map[string]interface{}{
+		"operand":         event.Operand,
+		"transaction_num": event.TransactionNum,
+		"token":           event.Token,
+		"token_seq":       int64(event.TokenSeq),
+		"update_num":      int64(event.UpdateNum),
+		"stream_num":      int64(event.StreamNum),
+		"stream_seq":      int64(event.StreamSeq),
+		"journal_seq":     int64(event.JournalSeq),
+		"partners":        event.Partners,
+		"transaction_tag": event.TransactionTag,
+		"pid":             int32(event.ProcessID),
+		"client_pid":      int32(event.ClientProcessID),
+		"global":          event.Global,
+		"key":             event.Key,
+		"subscripts":      avroStrings(event.Subscripts),
+		"node_values":     avroStrings(event.NodeValues),
+		"time_stamp":      event.TimeStamp,
+		"record":          event.Record,
+		"fields":          fields,
+		"previous_values": nil,
+		"changes":         nil,
+		"deleted":         nil,
+	}
+
+	if event.PreviousValues != nil {
+		native["previous_values"] = goavro.Union("array", avroStrings(event.PreviousValues))
+	}
+	if event.Changes != nil {
+		changes := make([]interface{}, len(event.Changes))
+		for i, change := range event.Changes {
+			changes[i] = map[string]interface{}{"piece": int64(change.Piece), "old": change.Old, "new": change.New}
+		}
+		native["changes"] = goavro.Union("array", changes)
+	}
+	if event.Deleted != nil {
+		deleted := make([]interface{}, len(event.Deleted))
+		for i, node := range event.Deleted {
+			deleted[i] = map[string]interface{}{
+				"key":         node.Key,
+				"subscripts":  avroStrings(node.Subscripts),
+				"node_values": avroStrings(node.NodeValues),
+			}
+		}
+		native["deleted"] = goavro.Union("array", deleted)
+	}
+
+	return native
+}
+
+func avroStrings(values []string) []interface{} {
+	native := make([]interface{}, len(values))
+	for i, value := range values {
+		native[i] = value
+	}
+	return native
+}
+
+func avroTransaction(event *TransactionEvent) map[string]interface{} {
+	updates := make([]interface{}, len(event.Updates))
+	for i, update := range event.Updates {
+		updates[i] = avroEvent(update, avroFieldsMap(update.Fields))
+	}
+
+	return map[string]interface{}{
+		"operand":         event.Operand,
+		"transaction_num": event.TransactionNum,
+		"token":           event.Token,
+		"token_seq":       int64(event.TokenSeq),
+		"stream_num":      int64(event.StreamNum),
+		"stream_seq":      int64(event.StreamSeq),
+		"journal_seq":     int64(event.JournalSeq),
+		"partners":        event.Partners,
+		"transaction_tag": event.TransactionTag,
+		"time_stamp":      event.TimeStamp,
+		"updates":         updates,
+	}
+}
+
+// avroValue returns the native union value of a dictionary field
+func avroValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return goavro.Union("string", v)
+	case json.Number:
+		return goavro.Union("string", string(v))
+	case int64:
+		return goavro.Union("long", v)
+	case bool:
+		return goavro.Union("boolean", v)
+	}
+	return nil
+}
+
+// avroFieldsMap returns the dictionary fields as a nullable map
+func avroFieldsMap(fields map[string]interface{}) interface{} {
+	if fields == nil {
+		return nil
+	}
+
+	m := map[string]interface{}{}
+	for name, value := range fields {
+		m[name] = avroValue(value)
+	}
+	return goavro.Union("map", m)
+}
+
+// avroDictionaryFields returns the dictionary fields as a record
+func avroDictionaryFields(fields map[string]interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	for name, value := range fields {
+		m[name] = avroValue(value)
+	}
+	return m
+}
@@ -0,0 +1,221 @@
+package gtmcdc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAvroUnits returns the units in test_tp.txt with the dictionary applied
+func testAvroUnits(t *testing.T) []*Unit {
+	dict, err := LoadDictionary("testdata/dictionary.yaml")
+	assert.Nil(t, err)
+
+	metrics := InitMetrics()
+	sink := &testSink{name: "test"}
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Dictionary: dict, Metrics: metrics}).DoFilter(fin, fout)
+
+	assert.Equal(t, 3, len(sink.units))
+	return sink.units
+}
+
+func Test_AvroEncoder_Encode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avro_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+
+	encoder := NewAvroEncoder(registry, "cdc")
+	units := testAvroUnits(t)
+
+	var ids []int
+	for _, unit := range units {
+		msg, err := encoder.Encode(unit)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(0), msg.Value[0])
+		ids = append(ids, int(binary.BigEndian.Uint32([]byte(msg.Value[1:5]))))
+	}
+	// both transactions have the same schema
+	assert.Equal(t, []int{1, 2, 1}, ids)
+	assert.Equal(t, []string{"cdc-gtmcdc.TransactionEvent"}, registry.Schemas[0].Subjects)
+	assert.Equal(t, []string{"cdc-gtmcdc.dictionary.account_balance"}, registry.Schemas[1].Subjects)
+
+	// transaction
+	msg, err := encoder.Encode(units[0])
+	assert.Nil(t, err)
+	native, err := DecodeAvro(registry, []byte(msg.Value))
+	assert.Nil(t, err)
+
+	event := native.(map[string]interface{})
+	assert.Equal(t, "TCOM", event["operand"])
+	updates := event["updates"].([]interface{})
+	assert.Equal(t, 2, len(updates))
+
+	update := updates[0].(map[string]interface{})
+	assert.Equal(t, "SET", update["operand"])
+	assert.Equal(t, "account_balance", update["record"])
+	fields := update["fields"].(map[string]interface{})["map"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"string": "100.00"}, fields["ledger_balance"])
+	assert.Equal(t, map[string]interface{}{"string": "1234"}, fields["acct"])
+	assert.Nil(t, fields["txn_count"])
+
+	// single record with the dictionary schema
+	msg, err = encoder.Encode(units[1])
+	assert.Nil(t, err)
+	native, err = DecodeAvro(registry, []byte(msg.Value))
+	assert.Nil(t, err)
+
+	event = native.(map[string]interface{})
+	assert.Equal(t, "SET", event["operand"])
+	assert.Equal(t, "ACN", event["global"])
+	assert.Equal(t, "5678", event["key"])
+	assert.Equal(t, []interface{}{"51"}, event["subscripts"])
+	fields = event["fields"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"string": "200.00"}, fields["ledger_balance"])
+	assert.Equal(t, map[string]interface{}{"string": "5678"}, fields["acct"])
+	assert.Nil(t, fields["closed"])
+
+	// the schema is registered once
+	reopened, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(reopened.Schemas))
+
+	var schema map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(reopened.Schemas[1].Schema), &schema))
+	assert.Equal(t, "gtmcdc.dictionary.account_balance", schema["name"])
+}
+
+func Test_AvroEncoder_NoDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avro_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="-.50|65287,62154"`,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)`,
+	)
+
+	encoder := NewAvroEncoder(registry, "cdc")
+	for _, rec := range recs {
+		msg, err := encoder.Encode(&Unit{Records: []*JournalRecord{rec}, done: true})
+		assert.Nil(t, err)
+
+		native, err := DecodeAvro(registry, []byte(msg.Value))
+		assert.Nil(t, err)
+
+		event := native.(map[string]interface{})
+		assert.Equal(t, "ACN", event["global"])
+		assert.Nil(t, event["fields"])
+	}
+	assert.Equal(t, 1, len(registry.Schemas))
+	assert.Equal(t, []string{"cdc-gtmcdc.JournalEvent"}, registry.Schemas[0].Subjects)
+
+	_, err = DecodeAvro(registry, []byte(`{"operand":"SET"}`))
+	assert.Equal(t, ErrorNotAvro, err.Error())
+}
+
+func Test_AvroEncoder_RegistryUnavailable(t *testing.T) {
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/subjects/cdc-") {
+			fmt.Fprint(w, `{"id":7}`)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error_code":409,"message":"incompatible schema"}`)
+	}))
+	defer server.Close()
+
+	registry, err := NewSchemaRegistry(&Config{SchemaRegistry: server.URL})
+	assert.Nil(t, err)
+
+	encoder := NewAvroEncoder(registry, "cdc")
+	encoder.backoff = time.Millisecond
+
+	// encoding waits until the schema is registered
+	recs := parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="1"`)
+	msg, err := encoder.Encode(&Unit{Records: recs, done: true})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32([]byte(msg.Value)[1:5]))
+	assert.Equal(t, 0, failures)
+
+	// a rejected schema is not retried
+	encoder = NewAvroEncoder(registry, "rejected")
+	_, err = encoder.Encode(&Unit{Records: recs, done: true})
+	assert.NotNil(t, err)
+
+	// encoding fails once the registry is unavailable for too long
+	failures = 100
+	registry, err = NewSchemaRegistry(&Config{SchemaRegistry: server.URL})
+	assert.Nil(t, err)
+	encoder = NewAvroEncoder(registry, "cdc")
+	encoder.backoff, encoder.maxWait = time.Millisecond, 10*time.Millisecond
+	_, err = encoder.Encode(&Unit{Records: recs, done: true})
+	assert.NotNil(t, err)
+	assert.True(t, failures > 0)
+}
+
+func Test_DoFilter_KafkaAvro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avro_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	encoder, err := NewEncoder(&Config{Format: FormatAvro, SchemaRegistry: dir, KafkaTopic: "cdc"})
+	assert.Nil(t, err)
+
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{
+		syncProducer: sp,
+		topic:        "cdc",
+	}
+	defer producer.CleanupProducer()
+
+	var values [][]byte
+	for i := 0; i < 3; i++ {
+		sp.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			value, err := msg.Value.Encode()
+			values = append(values, value)
+			return err
+		})
+	}
+
+	metrics := InitMetrics()
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{Producer: producer, Encoder: encoder, Metrics: metrics}, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	assert.Equal(t, 3, len(values))
+	registry, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+	for _, value := range values {
+		_, err := DecodeAvro(registry, value)
+		assert.Nil(t, err)
+	}
+}
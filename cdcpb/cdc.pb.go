@@ -0,0 +1,301 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.21.12
+// source: cdc.proto
+
+package cdcpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SubscribeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Globals        []string `protobuf:"bytes,1,rep,name=globals,proto3" json:"globals,omitempty"`
+	Operands       []string `protobuf:"bytes,2,rep,name=operands,proto3" json:"operands,omitempty"`
+	FromJournalSeq uint64   `protobuf:"varint,3,opt,name=from_journal_seq,json=fromJournalSeq,proto3" json:"from_journal_seq,omitempty"`
+	FromCursor     uint64   `protobuf:"varint,4,opt,name=from_cursor,json=fromCursor,proto3" json:"from_cursor,omitempty"`
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cdc_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cdc_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_cdc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SubscribeRequest) GetGlobals() []string {
+	if x != nil {
+		return x.Globals
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetOperands() []string {
+	if x != nil {
+		return x.Operands
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetFromJournalSeq() uint64 {
+	if x != nil {
+		return x.FromJournalSeq
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetFromCursor() uint64 {
+	if x != nil {
+		return x.FromCursor
+	}
+	return 0
+}
+
+type Event struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	StreamNum  uint32 `protobuf:"varint,1,opt,name=stream_num,json=streamNum,proto3" json:"stream_num,omitempty"`
+	StreamSeq  uint64 `protobuf:"varint,2,opt,name=stream_seq,json=streamSeq,proto3" json:"stream_seq,omitempty"`
+	JournalSeq uint64 `protobuf:"varint,3,opt,name=journal_seq,json=journalSeq,proto3" json:"journal_seq,omitempty"`
+	Operand    string `protobuf:"bytes,4,opt,name=operand,proto3" json:"operand,omitempty"`
+	Global     string `protobuf:"bytes,5,opt,name=global,proto3" json:"global,omitempty"`
+	Json       []byte `protobuf:"bytes,6,opt,name=json,proto3" json:"json,omitempty"`
+	Cursor     uint64 `protobuf:"varint,7,opt,name=cursor,proto3" json:"cursor,omitempty"`
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cdc_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_cdc_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_cdc_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Event) GetStreamNum() uint32 {
+	if x != nil {
+		return x.StreamNum
+	}
+	return 0
+}
+
+func (x *Event) GetStreamSeq() uint64 {
+	if x != nil {
+		return x.StreamSeq
+	}
+	return 0
+}
+
+func (x *Event) GetJournalSeq() uint64 {
+	if x != nil {
+		return x.JournalSeq
+	}
+	return 0
+}
+
+func (x *Event) GetOperand() string {
+	if x != nil {
+		return x.Operand
+	}
+	return ""
+}
+
+func (x *Event) GetGlobal() string {
+	if x != nil {
+		return x.Global
+	}
+	return ""
+}
+
+func (x *Event) GetJson() []byte {
+	if x != nil {
+		return x.Json
+	}
+	return nil
+}
+
+func (x *Event) GetCursor() uint64 {
+	if x != nil {
+		return x.Cursor
+	}
+	return 0
+}
+
+var File_cdc_proto protoreflect.FileDescriptor
+
+var file_cdc_proto_rawDesc = []byte{
+	0x0a, 0x09, 0x63, 0x64, 0x63, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09, 0x67, 0x74, 0x6d,
+	0x63, 0x64, 0x63, 0x2e, 0x76, 0x31, 0x22, 0x93, 0x01, 0x0a, 0x10, 0x53, 0x75, 0x62, 0x73, 0x63,
+	0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x67,
+	0x6c, 0x6f, 0x62, 0x61, 0x6c, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x67, 0x6c,
+	0x6f, 0x62, 0x61, 0x6c, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x6e, 0x64,
+	0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x6e, 0x64,
+	0x73, 0x12, 0x28, 0x0a, 0x10, 0x66, 0x72, 0x6f, 0x6d, 0x5f, 0x6a, 0x6f, 0x75, 0x72, 0x6e, 0x61,
+	0x6c, 0x5f, 0x73, 0x65, 0x71, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0e, 0x66, 0x72, 0x6f,
+	0x6d, 0x4a, 0x6f, 0x75, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x65, 0x71, 0x12, 0x1f, 0x0a, 0x0b, 0x66,
+	0x72, 0x6f, 0x6d, 0x5f, 0x63, 0x75, 0x72, 0x73, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x0a, 0x66, 0x72, 0x6f, 0x6d, 0x43, 0x75, 0x72, 0x73, 0x6f, 0x72, 0x22, 0xc4, 0x01, 0x0a,
+	0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09, 0x73, 0x74, 0x72, 0x65,
+	0x61, 0x6d, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x5f,
+	0x73, 0x65, 0x71, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x73, 0x74, 0x72, 0x65, 0x61,
+	0x6d, 0x53, 0x65, 0x71, 0x12, 0x1f, 0x0a, 0x0b, 0x6a, 0x6f, 0x75, 0x72, 0x6e, 0x61, 0x6c, 0x5f,
+	0x73, 0x65, 0x71, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0a, 0x6a, 0x6f, 0x75, 0x72, 0x6e,
+	0x61, 0x6c, 0x53, 0x65, 0x71, 0x12, 0x18, 0x0a, 0x07, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x6e, 0x64,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x6e, 0x64, 0x12,
+	0x16, 0x0a, 0x06, 0x67, 0x6c, 0x6f, 0x62, 0x61, 0x6c, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x67, 0x6c, 0x6f, 0x62, 0x61, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x6a, 0x73, 0x6f, 0x6e, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x6a, 0x73, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x63,
+	0x75, 0x72, 0x73, 0x6f, 0x72, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x63, 0x75, 0x72,
+	0x73, 0x6f, 0x72, 0x32, 0x43, 0x0a, 0x03, 0x43, 0x64, 0x63, 0x12, 0x3c, 0x0a, 0x09, 0x53, 0x75,
+	0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x12, 0x1b, 0x2e, 0x67, 0x74, 0x6d, 0x63, 0x64, 0x63,
+	0x2e, 0x76, 0x31, 0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x10, 0x2e, 0x67, 0x74, 0x6d, 0x63, 0x64, 0x63, 0x2e, 0x76, 0x31,
+	0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x30, 0x01, 0x42, 0x25, 0x0a, 0x13, 0x69, 0x6f, 0x2e, 0x67,
+	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x67, 0x74, 0x6d, 0x63, 0x64, 0x63, 0x2e, 0x76, 0x31, 0x50,
+	0x01, 0x5a, 0x0c, 0x67, 0x74, 0x6d, 0x63, 0x64, 0x63, 0x2f, 0x63, 0x64, 0x63, 0x70, 0x62, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_cdc_proto_rawDescOnce sync.Once
+	file_cdc_proto_rawDescData = file_cdc_proto_rawDesc
+)
+
+func file_cdc_proto_rawDescGZIP() []byte {
+	file_cdc_proto_rawDescOnce.Do(func() {
+		file_cdc_proto_rawDescData = protoimpl.X.CompressGZIP(file_cdc_proto_rawDescData)
+	})
+	return file_cdc_proto_rawDescData
+}
+
+var file_cdc_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_cdc_proto_goTypes = []interface{}{
+	(*SubscribeRequest)(nil), // 0: gtmcdc.v1.SubscribeRequest
+	(*Event)(nil),            // 1: gtmcdc.v1.Event
+}
+var file_cdc_proto_depIdxs = []int32{
+	0, // 0: gtmcdc.v1.Cdc.Subscribe:input_type -> gtmcdc.v1.SubscribeRequest
+	1, // 1: gtmcdc.v1.Cdc.Subscribe:output_type -> gtmcdc.v1.Event
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_cdc_proto_init() }
+func file_cdc_proto_init() {
+	if File_cdc_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_cdc_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cdc_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Event); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_cdc_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_cdc_proto_goTypes,
+		DependencyIndexes: file_cdc_proto_depIdxs,
+		MessageInfos:      file_cdc_proto_msgTypes,
+	}.Build()
+	File_cdc_proto = out.File
+	file_cdc_proto_rawDesc = nil
+	file_cdc_proto_goTypes = nil
+	file_cdc_proto_depIdxs = nil
+}
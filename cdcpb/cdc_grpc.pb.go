@@ -0,0 +1,132 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: cdc.proto
+
+package cdcpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// CdcClient is the client API for Cdc service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CdcClient interface {
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Cdc_SubscribeClient, error)
+}
+
+type cdcClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCdcClient(cc grpc.ClientConnInterface) CdcClient {
+	return &cdcClient{cc}
+}
+
+func (c *cdcClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Cdc_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cdc_ServiceDesc.Streams[0], "/gtmcdc.v1.Cdc/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cdcSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cdc_SubscribeClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type cdcSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *cdcSubscribeClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CdcServer is the server API for Cdc service.
+// All implementations must embed UnimplementedCdcServer
+// for forward compatibility
+type CdcServer interface {
+	Subscribe(*SubscribeRequest, Cdc_SubscribeServer) error
+	mustEmbedUnimplementedCdcServer()
+}
+
+// UnimplementedCdcServer must be embedded to have forward compatible implementations.
+type UnimplementedCdcServer struct {
+}
+
+func (UnimplementedCdcServer) Subscribe(*SubscribeRequest, Cdc_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedCdcServer) mustEmbedUnimplementedCdcServer() {}
+
+// UnsafeCdcServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CdcServer will
+// result in compilation errors.
+type UnsafeCdcServer interface {
+	mustEmbedUnimplementedCdcServer()
+}
+
+func RegisterCdcServer(s grpc.ServiceRegistrar, srv CdcServer) {
+	s.RegisterService(&Cdc_ServiceDesc, srv)
+}
+
+func _Cdc_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CdcServer).Subscribe(m, &cdcSubscribeServer{stream})
+}
+
+type Cdc_SubscribeServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type cdcSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *cdcSubscribeServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Cdc_ServiceDesc is the grpc.ServiceDesc for Cdc service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cdc_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gtmcdc.v1.Cdc",
+	HandlerType: (*CdcServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Cdc_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cdc.proto",
+}
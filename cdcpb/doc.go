@@ -0,0 +1,5 @@
+// Package cdcpb contains the gRPC service and messages generated from cdc.proto
+// and the messages of the protobuf format generated from event.proto
+package cdcpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cdc.proto event.proto
@@ -0,0 +1,114 @@
+package gtmcdc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Change modes
+const (
+	ChangesFull   = "full"
+	ChangesPieces = "pieces"
+)
+
+// ChangeDetector compares the value of a SET with the previous value
+// from the state store.
+//
+//	full    events have node_values, previous_values and changes
+//	pieces  events of SET have only the changed pieces in changes
+//
+// When suppress is true, a SET is not published if none of its watched
+// pieces changed, all pieces are watched for nodes without a watch.
+// Watches are <node pattern>:<pieces>, e.g. ^ACN(*,51):1,3 watches the
+// pieces 1 and 3 of ^ACN(*,51), the first watch whose pattern matches
+// is used. A transaction is published whole unless all its updates are
+// suppressed. Nodes without a previous value are always published.
+// Suppressed units are still applied by replica sinks, e.g. SQLite.
+type ChangeDetector struct {
+	mode     string
+	suppress bool
+	watches  []*pieceWatch
+}
+
+type pieceWatch struct {
+	pattern *NodePattern
+	pieces  map[int]bool
+}
+
+// NewChangeDetector returns the detector for the mode and the watches
+func NewChangeDetector(mode string, watches []string, suppress bool) (*ChangeDetector, error) {
+	switch mode {
+	case "":
+		mode = ChangesFull
+	case ChangesFull, ChangesPieces:
+	default:
+		return nil, errors.New("invalid change mode " + mode)
+	}
+
+	c := &ChangeDetector{mode: mode, suppress: suppress}
+	for _, spec := range watches {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("no pieces in watch %s", spec)
+		}
+
+		pattern, err := ParseNodePattern(spec[:i])
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", ErrorInvalidPattern, spec[:i])
+		}
+
+		watch := &pieceWatch{pattern: pattern, pieces: map[int]bool{}}
+		for _, s := range strings.Split(spec[i+1:], ",") {
+			piece, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || piece < 1 {
+				return nil, fmt.Errorf("invalid piece %s in watch %s", s, spec)
+			}
+			watch.pieces[piece] = true
+		}
+
+		c.watches = append(c.watches, watch)
+	}
+
+	return c, nil
+}
+
+// Apply marks a SET to publish only the changed pieces or to be
+// suppressed. It must be called after the before image is set by the
+// state store and does nothing if the detector is nil.
+func (c *ChangeDetector) Apply(rec *JournalRecord) {
+	before := rec.detail.before
+	if c == nil || rec.opcode != "SET" || before == nil {
+		return
+	}
+
+	rec.detail.piecesOnly = c.mode == ChangesPieces
+	if !c.suppress || !before.exists {
+		return
+	}
+
+	pieces := c.watched(rec.detail.node)
+	for _, change := range pieceChanges(before.value, rec.detail.value) {
+		if pieces == nil || pieces[change.Piece] {
+			return
+		}
+	}
+
+	rec.detail.suppressed = true
+}
+
+// watched returns the watched pieces of a node, nil for all pieces
+func (c *ChangeDetector) watched(node *Node) map[int]bool {
+	for _, watch := range c.watches {
+		if watch.pattern.Match(node) {
+			return watch.pieces
+		}
+	}
+	return nil
+}
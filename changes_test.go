@@ -0,0 +1,130 @@
+package gtmcdc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewChangeDetector(t *testing.T) {
+	c, err := NewChangeDetector("", []string{"^ACN(*,51):1,3", " ", "^HIST:2"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, ChangesFull, c.mode)
+	assert.Equal(t, 2, len(c.watches))
+	assert.Equal(t, map[int]bool{1: true, 3: true}, c.watches[0].pieces)
+
+	for _, watch := range []string{"^ACN(*,51)", "^ACN(*,51):", "^ACN(*,51):0", "^ACN(*:1", "ACN:1"} {
+		_, err = NewChangeDetector(ChangesFull, []string{watch}, true)
+		assert.NotNil(t, err, watch)
+	}
+
+	_, err = NewChangeDetector("bad", nil, false)
+	assert.NotNil(t, err)
+}
+
+func Test_ChangeDetector_Apply(t *testing.T) {
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	c, err := NewChangeDetector(ChangesPieces, []string{"^ACN(*,51):1,3"}, true)
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65287,62154\1\0\0\1\0\0\0\0\^ACN(1,51)="a|b|c"`,
+		`05\65287,62154\2\0\0\2\0\0\0\0\^ACN(1,51)="a|x|c"`,
+		`05\65287,62154\3\0\0\3\0\0\0\0\^ACN(1,51)="a|x|d"`,
+		`05\65287,62154\4\0\0\4\0\0\0\0\^ACN(1,52)="a"`,
+		`05\65287,62154\5\0\0\5\0\0\0\0\^ACN(1,52)="a"`,
+		`04\65287,62154\6\0\0\6\0\0\0\0\^ACN(1,52)`,
+	)
+	for _, rec := range recs {
+		assert.Nil(t, state.Apply(rec))
+		c.Apply(rec)
+	}
+
+	// new node is not suppressed
+	assert.False(t, recs[0].detail.suppressed)
+	event := recs[0].Event()
+	assert.Nil(t, event.NodeValues)
+	assert.Equal(t, []*PieceChange{{1, "", "a"}, {2, "", "b"}, {3, "", "c"}}, event.Changes)
+
+	// piece 2 is not watched
+	assert.True(t, recs[1].detail.suppressed)
+
+	assert.False(t, recs[2].detail.suppressed)
+	event = recs[2].Event()
+	assert.Nil(t, event.NodeValues)
+	assert.Nil(t, event.PreviousValues)
+	assert.Equal(t, []*PieceChange{{3, "c", "d"}}, event.Changes)
+
+	// all pieces are watched without a watch
+	assert.False(t, recs[3].detail.suppressed)
+	assert.True(t, recs[4].detail.suppressed)
+
+	// KILL is not changed
+	assert.False(t, recs[5].detail.suppressed)
+	assert.Equal(t, []string{"a"}, recs[5].Event().PreviousValues)
+
+	// nil detector does nothing
+	var none *ChangeDetector
+	none.Apply(recs[0])
+}
+
+// testReplicaSink is a testSink that gets the suppressed units too
+type testReplicaSink struct {
+	testSink
+}
+
+func (s *testReplicaSink) IsReplica() bool { return true }
+
+func Test_DoFilter_SuppressUnchanged(t *testing.T) {
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	c, err := NewChangeDetector(ChangesFull, nil, true)
+	assert.Nil(t, err)
+
+	metrics := InitMetrics()
+	sink := &testSink{name: "test"}
+	replica := &testReplicaSink{testSink{name: "replica"}}
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	sinks.Add(replica, FailureRequire)
+
+	f := &Filter{Sinks: sinks, State: state, Changes: c, Metrics: metrics}
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	f.DoFilter(fin, fout)
+	assert.Equal(t, 3, len(sink.units))
+
+	// the same journal again, the transaction sets the same values,
+	// ^ACN(5678,51) is changed from 300.00 to 200.00 and back
+	sink.units, replica.units = nil, nil
+	fin, fout = InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	f.DoFilter(fin, fout)
+	assert.Equal(t, 2, len(sink.units))
+	assert.Equal(t, 1.0, metrics.GetCounterValue("lines_suppressed_unchanged"))
+
+	// the replica gets the suppressed transaction too
+	assert.Equal(t, 3, len(replica.units))
+
+	// a transaction with a changed update is published whole
+	unit := &Unit{}
+	for _, rec := range parseAll(t,
+		`08\65287,62154\3\0\0\3\0\0`,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00|61212"`,
+		`05\65287,62154\3\0\0\3\0\0\2\0\^ACN(1234,52)="2"`,
+		`09\65287,62154\3\0\0\3\0\0\1\BATCH`,
+	) {
+		assert.Nil(t, state.Apply(rec))
+		c.Apply(rec)
+		unit.Records = append(unit.Records, rec)
+	}
+	assert.True(t, unit.Records[1].detail.suppressed)
+	assert.False(t, unit.Records[2].detail.suppressed)
+	assert.False(t, unit.isSuppressed())
+	assert.Equal(t, 4, len(unit.Records))
+}
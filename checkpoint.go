@@ -0,0 +1,210 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Position is the position of a journal record in a replication stream.
+// stream_seq is only used by supplementary instances and is 0 otherwise.
+// ZTSTART...ZTCOM transactions have no position.
+type Position struct {
+	JournalSeq int `json:"journal_seq"`
+	StreamSeq  int `json:"stream_seq"`
+}
+
+// After returns true if p is a later position than other
+func (p Position) After(other Position) bool {
+	if p.StreamSeq > 0 || other.StreamSeq > 0 {
+		return p.StreamSeq > other.StreamSeq
+	}
+	return p.JournalSeq > other.JournalSeq
+}
+
+// IsZero returns true if the position is unknown
+func (p Position) IsZero() bool {
+	return p.JournalSeq == 0 && p.StreamSeq == 0
+}
+
+// position returns the stream number and the position of a journal record
+func (rec *JournalRecord) position() (int, Position) {
+	return rec.repl.streamNum, Position{JournalSeq: rec.repl.journalSeq, StreamSeq: rec.repl.streamSeq}
+}
+
+// position of a unit is the position of the TCOM for a transaction
+// or the position of the only record otherwise
+func (u *Unit) position() (int, Position) {
+	if u.commit != nil {
+		return u.commit.position()
+	}
+	if len(u.Records) == 0 {
+		return 0, Position{}
+	}
+	return u.Records[0].position()
+}
+
+// id of a unit is <stream_num>-<journal_seq> of its position. A unit
+// without a position, e.g. a ZTSTART...ZTCOM transaction or a record in
+// a region that is not replicated, has the id <stream_num>-t<tnum> of
+// its first record instead.
+func (u *Unit) id() string {
+	streamNum, pos := u.position()
+	if pos == (Position{}) {
+		rec := u.commit
+		if len(u.Records) > 0 {
+			rec = u.Records[0]
+		}
+		if rec != nil {
+			return fmt.Sprintf("%d-t%s", streamNum, rec.tran.num)
+		}
+	}
+	return fmt.Sprintf("%d-%d", streamNum, pos.JournalSeq)
+}
+
+// Checkpoint records the position of the last published journal record
+// for each stream in a local file so that records resent by the
+// replication source after a restart are not published again.
+// The file is replaced atomically every time the checkpoint is saved.
+type Checkpoint struct {
+	mu      sync.Mutex
+	path    string
+	every   int
+	pending int
+	Streams map[int]Position `json:"streams"`
+}
+
+// OpenCheckpoint loads the checkpoint file at path, an empty checkpoint is
+// returned if the file does not exist. The checkpoint is saved to file once
+// every number of updates specified by every
+func OpenCheckpoint(path string, every int) (*Checkpoint, error) {
+	if every < 1 {
+		every = 1
+	}
+
+	c := &Checkpoint{
+		path:    path,
+		every:   every,
+		Streams: map[int]Position{},
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(bytes, c); err != nil {
+		return nil, err
+	}
+	if c.Streams == nil {
+		c.Streams = map[int]Position{}
+	}
+
+	log.Infof("checkpoint loaded from %s. %+v", path, c.Streams)
+
+	return c, nil
+}
+
+// IsPublished returns true if the unit is at or before the checkpoint
+// of its stream, i.e. it has been published before
+func (c *Checkpoint) IsPublished(unit *Unit) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stream, pos := unit.position()
+	last, exists := c.Streams[stream]
+	if !exists || pos.IsZero() {
+		return false
+	}
+
+	return !pos.After(last)
+}
+
+// Update moves the checkpoint to the position of a published unit
+func (c *Checkpoint) Update(unit *Unit) error {
+	if c == nil {
+		return nil
+	}
+
+	stream, pos := unit.position()
+	if pos.IsZero() {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.Streams[stream] = pos
+	c.pending++
+	save := c.pending >= c.every
+	c.mu.Unlock()
+
+	if save {
+		return c.Save()
+	}
+
+	return nil
+}
+
+// Save writes the checkpoint to a temporary file and renames it
+// to replace the checkpoint file
+func (c *Checkpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == 0 {
+		return nil
+	}
+
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(c.path, bytes); err != nil {
+		return err
+	}
+
+	c.pending = 0
+	return nil
+}
+
+// writeFileAtomic replaces the file with the data so that the file
+// has either the old or the new content even if the system crashes
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,112 @@
+package gtmcdc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Position(t *testing.T) {
+	assert.True(t, Position{JournalSeq: 10}.After(Position{JournalSeq: 9}))
+	assert.False(t, Position{JournalSeq: 9}.After(Position{JournalSeq: 9}))
+	// stream_seq takes precedence
+	assert.True(t, Position{JournalSeq: 1, StreamSeq: 5}.After(Position{JournalSeq: 9, StreamSeq: 4}))
+	assert.True(t, Position{}.IsZero())
+}
+
+func Test_Checkpoint_SaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+	c, err := OpenCheckpoint(path, 2)
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`,
+		`05\65282,59700\29\0\0\29\2\7\0\0\^ACN(1234,51)="2"`,
+	)
+	unit1 := &Unit{Records: recs[:1], done: true}
+	unit2 := &Unit{Records: recs[1:], done: true}
+
+	assert.False(t, c.IsPublished(unit1))
+	assert.Nil(t, c.Update(unit1))
+
+	// not saved yet because it is saved every 2 updates
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, c.Update(unit2))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	c, err = OpenCheckpoint(path, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, Position{JournalSeq: 28}, c.Streams[0])
+	assert.Equal(t, Position{JournalSeq: 29, StreamSeq: 7}, c.Streams[2])
+	assert.True(t, c.IsPublished(unit1))
+	assert.True(t, c.IsPublished(unit2))
+
+	later := parseAll(t, `05\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,51)="3"`)
+	assert.False(t, c.IsPublished(&Unit{Records: later, done: true}))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+}
+
+func Test_Checkpoint_Invalid(t *testing.T) {
+	tmpFile, err := testTempFileWithContent([]byte("not json"))
+	assert.Nil(t, err)
+	defer os.Remove(tmpFile)
+
+	_, err = OpenCheckpoint(tmpFile, 1)
+	assert.NotNil(t, err)
+}
+
+func Test_DoFilter_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+	checkpoint, err := OpenCheckpoint(path, 100)
+	assert.Nil(t, err)
+
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{syncProducer: sp, topic: "checkpoint"}
+	defer producer.CleanupProducer()
+
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndSucceed()
+	// ZTSTART...ZTCOM has no position and is published again
+	sp.ExpectSendMessageAndSucceed()
+
+	metrics := InitMetrics()
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: testKafkaSinks(producer, metrics), Checkpoint: checkpoint, Metrics: metrics}).DoFilter(fin, fout)
+
+	// the same input is sent again after restart, only the ZTP
+	// transaction is published
+	checkpoint, err = OpenCheckpoint(path, 100)
+	assert.Nil(t, err)
+
+	counters := []string{
+		"lines_output_written",
+		"lines_skipped_by_checkpoint",
+	}
+	prevValues := getCounters(metrics, counters)
+
+	fin, fout = InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: testKafkaSinks(producer, metrics), Checkpoint: checkpoint, Metrics: metrics}).DoFilter(fin, fout)
+
+	currentValues := getCounters(metrics, counters)
+	deltas, err := deltaCounters(prevValues, currentValues)
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{8.0, 2.0}, deltas)
+}
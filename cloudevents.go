@@ -0,0 +1,151 @@
+package gtmcdc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// CloudEvents modes
+const (
+	CloudEventsOff        = "off"
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+)
+
+const (
+	cloudEventsVersion     = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsHeader      = "ce_"
+	contentTypeHeader      = "content-type"
+)
+
+// CloudEvent is a CloudEvents 1.0 envelope in structured mode
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// CloudEventsEncoder wraps the messages of another encoder in CloudEvents
+//
+//	structured  the value is the JSON envelope with the message as data,
+//	            or data_base64 when the message is not JSON
+//	binary      the value is the message and the attributes are
+//	            Kafka headers prefixed with ce_
+//
+// The id is <stream_num>-<journal_seq> of the unit, or <stream_num>-t<tnum>
+// when there is no journal_seq, the source is the instance name or
+// the hostname, the type is gtm.global.<operand> for records of a global
+// node, e.g. gtm.global.set, and gtm.transaction.<operand> for transactions,
+// e.g. gtm.transaction.tcom. The time is the journal timestamp and the
+// subject is the global node reference, e.g. ^ACN(1234,51), if any.
+type CloudEventsEncoder struct {
+	encoder     Encoder
+	mode        string
+	source      string
+	contentType string
+}
+
+// NewCloudEventsEncoder wraps the encoder, contentType is the
+// content type of the messages of the encoder
+func NewCloudEventsEncoder(encoder Encoder, mode, source, contentType string) (*CloudEventsEncoder, error) {
+	if mode != CloudEventsStructured && mode != CloudEventsBinary {
+		return nil, errors.New("invalid cloudevents mode " + mode)
+	}
+
+	source, err := instanceName(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudEventsEncoder{
+		encoder:     encoder,
+		mode:        mode,
+		source:      source,
+		contentType: contentType,
+	}, nil
+}
+
+// Encode returns the message of the encoder in the envelope
+func (c *CloudEventsEncoder) Encode(unit *Unit) (*Message, error) {
+	msg, err := c.encoder.Encode(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	event := c.event(unit)
+
+	if c.mode == CloudEventsBinary {
+		if msg.Headers == nil {
+			msg.Headers = map[string]string{}
+		}
+		msg.Headers[cloudEventsHeader+"specversion"] = event.SpecVersion
+		msg.Headers[cloudEventsHeader+"id"] = event.ID
+		msg.Headers[cloudEventsHeader+"source"] = event.Source
+		msg.Headers[cloudEventsHeader+"type"] = event.Type
+		if event.Time != "" {
+			msg.Headers[cloudEventsHeader+"time"] = event.Time
+		}
+		if event.Subject != "" {
+			msg.Headers[cloudEventsHeader+"subject"] = event.Subject
+		}
+		msg.Headers[contentTypeHeader] = c.contentType
+		return msg, nil
+	}
+
+	if json.Valid([]byte(msg.Value)) {
+		event.Data = json.RawMessage(msg.Value)
+	} else {
+		event.DataBase64 = base64.StdEncoding.EncodeToString([]byte(msg.Value))
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Value = string(value)
+	if msg.Headers == nil {
+		msg.Headers = map[string]string{}
+	}
+	msg.Headers[contentTypeHeader] = cloudEventsContentType
+	return msg, nil
+}
+
+// event returns the envelope of the unit without data
+func (c *CloudEventsEncoder) event(unit *Unit) *CloudEvent {
+	rec := unit.Records[0]
+	kind := "global"
+	if unit.IsTransaction() {
+		rec, kind = unit.commit, "transaction"
+	} else if rec.detail.node == nil {
+		kind = "journal"
+	}
+
+	event := &CloudEvent{
+		SpecVersion:     cloudEventsVersion,
+		ID:              unit.id(),
+		Source:          c.source,
+		Type:            "gtm." + kind + "." + strings.ToLower(rec.opcode),
+		DataContentType: c.contentType,
+	}
+
+	if rec.header.timestamp > 0 {
+		event.Time = time.Unix(rec.header.timestamp, 0).UTC().Format(time.RFC3339)
+	}
+
+	if kind == "global" {
+		event.Subject = rec.detail.node.String()
+	}
+
+	return event
+}
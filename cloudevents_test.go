@@ -0,0 +1,112 @@
+package gtmcdc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CloudEventsEncoder_Structured(t *testing.T) {
+	encoder, err := NewEncoder(&Config{CloudEvents: CloudEventsStructured, Instance: "/gtm/prod1"})
+	assert.Nil(t, err)
+
+	var events []*CloudEvent
+	for _, unit := range testAvroUnits(t) {
+		msg, err := encoder.Encode(unit)
+		assert.Nil(t, err)
+		assert.Equal(t, "application/cloudevents+json", msg.Headers["content-type"])
+
+		event := &CloudEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(msg.Value), event))
+		events = append(events, event)
+
+		// data is the JSON event
+		jsonstr, err := unit.JSON()
+		assert.Nil(t, err)
+		assert.JSONEq(t, jsonstr, string(event.Data))
+	}
+
+	assert.Equal(t, &CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              "0-4",
+		Source:          "/gtm/prod1",
+		Type:            "gtm.global.set",
+		Time:            "2019-10-01T17:15:55Z",
+		Subject:         "^ACN(5678,51)",
+		DataContentType: "application/json",
+		Data:            events[1].Data,
+	}, events[1])
+
+	assert.Equal(t, "0-3", events[0].ID)
+	assert.Equal(t, "gtm.transaction.tcom", events[0].Type)
+	assert.Equal(t, "", events[0].Subject)
+	assert.Equal(t, "0-t5", events[2].ID)
+	assert.Equal(t, "gtm.transaction.ztcom", events[2].Type)
+}
+
+func Test_CloudEventsEncoder_Binary(t *testing.T) {
+	encoder, err := NewEncoder(&Config{CloudEvents: CloudEventsBinary, Instance: "prod1"})
+	assert.Nil(t, err)
+
+	units := testAvroUnits(t)
+	msg, err := encoder.Encode(units[1])
+	assert.Nil(t, err)
+
+	jsonstr, err := units[1].JSON()
+	assert.Nil(t, err)
+	assert.Equal(t, jsonstr, msg.Value)
+	assert.Equal(t, map[string]string{
+		"ce_specversion": "1.0",
+		"ce_id":          "0-4",
+		"ce_source":      "prod1",
+		"ce_type":        "gtm.global.set",
+		"ce_time":        "2019-10-01T17:15:55Z",
+		"ce_subject":     "^ACN(5678,51)",
+		"content-type":   "application/json",
+	}, msg.Headers)
+
+	// records without a node and a timestamp
+	recs := parseAll(t, `11\0,0\28\0\0\0\0\0\0\worm`)
+	msg, err = encoder.Encode(&Unit{Records: recs, done: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "gtm.journal.ztworm", msg.Headers["ce_type"])
+	assert.Equal(t, "0-t28", msg.Headers["ce_id"])
+	_, hasTime := msg.Headers["ce_time"]
+	assert.False(t, hasTime)
+}
+
+func Test_CloudEventsEncoder_Avro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudevents_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	encoder, err := NewEncoder(&Config{
+		Format:         FormatAvro,
+		SchemaRegistry: dir,
+		KafkaTopic:     "cdc",
+		CloudEvents:    CloudEventsStructured,
+	})
+	assert.Nil(t, err)
+
+	msg, err := encoder.Encode(testAvroUnits(t)[1])
+	assert.Nil(t, err)
+
+	event := &CloudEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(msg.Value), event))
+	assert.Equal(t, "application/avro", event.DataContentType)
+	assert.Nil(t, event.Data)
+
+	data, err := base64.StdEncoding.DecodeString(event.DataBase64)
+	assert.Nil(t, err)
+	registry, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+	_, err = DecodeAvro(registry, data)
+	assert.Nil(t, err)
+
+	_, err = NewEncoder(&Config{CloudEvents: "both"})
+	assert.NotNil(t, err)
+}
@@ -27,25 +27,245 @@ func main() {
 	log.Infof("Starting cdcfilter with conf=%s, i=%s, o=%s, %+v",
 		envFile, inputFile, outputFile, conf)
 
-	producer, err := pkg.InitProducer(conf.KafkaBrokerList, conf.KafkaTopic)
-	if err != nil {
-		log.Infof("Kafka producer not available. %v", err)
-	}
-	defer producer.CleanupProducer()
-
 	if conf.PromHTTPAddr != "off" {
-		err = pkg.InitPromHTTP(conf.PromHTTPAddr)
+		err := pkg.InitPromHTTP(conf.PromHTTPAddr)
 		if err != nil {
 			log.Warn(err)
 		}
 	}
 
+	metrics := pkg.InitMetrics()
+
+	sinks := pkg.NewFanout(metrics)
+	sinks.Retries, sinks.RetryBackoff = conf.SinkRetries, conf.SinkRetryBackoff
+	defer func() {
+		_ = sinks.Close()
+	}()
+
+	// the smallest limit of the sinks in async mode
+	maxInFlight := 0
+	limitInFlight := func(async bool, limit int) {
+		if async && (maxInFlight == 0 || limit < maxInFlight) {
+			maxInFlight = limit
+		}
+	}
+
+	for _, spec := range conf.Sinks {
+		name, policy, err := pkg.ParseSinkSpec(spec)
+		if err != nil {
+			log.Fatalf("Invalid sink %s. %v", spec, err)
+		}
+
+		var sink pkg.Sink
+		switch name {
+		case pkg.SinkKafka:
+			sink = initKafkaSink(conf, metrics)
+			limitInFlight(conf.KafkaAsync, conf.KafkaMaxInFlight)
+		case pkg.SinkFile:
+			sink = initFileSink(conf, metrics)
+		case pkg.SinkWebhook:
+			sink = initWebhookSink(conf, metrics)
+			limitInFlight(conf.WebhookBatchSize > 1, conf.WebhookMaxInFlight)
+		case pkg.SinkNats:
+			sink = initNatsSink(conf, metrics)
+		case pkg.SinkRedis:
+			sink = initRedisSink(conf, metrics)
+		case pkg.SinkMqtt:
+			sink = initMqttSink(conf, metrics)
+		case pkg.SinkGrpc:
+			sink = initGrpcSink(conf, metrics)
+		case pkg.SinkSqlite:
+			sink = initSqliteSink(conf, metrics)
+		case pkg.SinkSQL:
+			sink = initSQLSink(conf, metrics)
+			limitInFlight(conf.SQLBatchSize > 1, conf.SQLMaxInFlight)
+		default:
+			log.Fatalf("Unknown sink %s", name)
+		}
+
+		if sink != nil {
+			sinks.Add(sink, policy)
+		}
+	}
+
+	var checkpoint *pkg.Checkpoint
+	if conf.CheckpointFile != "off" {
+		var err error
+		checkpoint, err = pkg.OpenCheckpoint(conf.CheckpointFile, conf.CheckpointEvery)
+		if err != nil {
+			log.Fatalf("Unable to open checkpoint %s. %v", conf.CheckpointFile, err)
+		}
+	}
+
+	var dictionary *pkg.Dictionary
+	if conf.Dictionary != "off" {
+		var err error
+		dictionary, err = pkg.LoadDictionary(conf.Dictionary)
+		if err != nil {
+			log.Fatalf("Unable to load dictionary %s. %v", conf.Dictionary, err)
+		}
+	}
+
+	var state *pkg.StateStore
+	if conf.StateFile != "off" {
+		var err error
+		state, err = pkg.OpenStateStore(conf.StateFile)
+		if err != nil {
+			log.Fatalf("Unable to open state store %s. %v", conf.StateFile, err)
+		}
+		defer func() {
+			_ = state.Close()
+		}()
+	}
+
+	changes, err := pkg.NewChangeDetector(conf.Changes, conf.Watch, conf.SuppressUnchanged)
+	if err != nil {
+		log.Fatalf("Invalid change detection. %v", err)
+	}
+	if state == nil && (conf.Changes == pkg.ChangesPieces || conf.SuppressUnchanged) {
+		log.Fatalf("Change detection requires a state store in GTMCDC_STATE_FILE")
+	}
+
 	fin, fout := pkg.InitInputAndOutput(inputFile, outputFile)
 	defer closeFile(fin)
 	defer closeFile(fout)
 
-	metrics := pkg.InitMetrics()
-	pkg.DoFilter(fin, fout, producer, metrics)
+	filter := &pkg.Filter{
+		Sinks:       sinks,
+		Checkpoint:  checkpoint,
+		Dictionary:  dictionary,
+		State:       state,
+		Changes:     changes,
+		MaxInFlight: maxInFlight,
+		Metrics:     metrics,
+
+		TransactionMaxLines: conf.TransactionMaxLines,
+		TransactionTimeout:  conf.TransactionTimeout,
+	}
+	filter.DoFilter(fin, fout)
 
 	log.Info("done")
 }
+
+// initKafkaSink returns nil if Kafka is not configured
+func initKafkaSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	producer, err := pkg.InitProducer(conf)
+	if err != nil {
+		log.Infof("Kafka producer not available. %v", err)
+	}
+	if producer == nil {
+		return nil
+	}
+
+	var spool *pkg.Spool
+	if conf.SpoolDir != "off" {
+		spool, err = pkg.OpenSpool(conf.SpoolDir, conf.SpoolSegmentSize, metrics)
+		if err != nil {
+			log.Fatalf("Unable to open spool %s. %v", conf.SpoolDir, err)
+		}
+		spool.StartDrainer(producer, conf.SpoolDrainInterval)
+	}
+
+	keyStrategy, err := pkg.NewKeyStrategy(conf.KafkaKey)
+	if err != nil {
+		log.Fatalf("Invalid Kafka key strategy. %v", err)
+	}
+
+	tombstones, err := pkg.NewTombstonePolicy(conf.KafkaTombstone, conf.KafkaTombstoneSubtree)
+	if err != nil {
+		log.Fatalf("Invalid Kafka tombstone mode. %v", err)
+	}
+	if tombstones.IsEnabled() && conf.KafkaKey == pkg.KeyNone {
+		log.Fatalf("Kafka tombstones require a key strategy in GTMCDC_KAFKA_KEY")
+	}
+
+	encoder, err := pkg.NewEncoder(conf)
+	if err != nil {
+		log.Fatalf("Unable to create %s encoder. %v", conf.Format, err)
+	}
+
+	return &pkg.KafkaSink{
+		Producer:    producer,
+		Spool:       spool,
+		KeyStrategy: keyStrategy,
+		Tombstones:  tombstones,
+		Encoder:     encoder,
+		Metrics:     metrics,
+	}
+}
+
+func initFileSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	if conf.FileDir == "off" {
+		log.Fatalf("File sink requires a directory in GTMCDC_FILE_DIR")
+	}
+
+	sink, err := pkg.OpenFileSink(conf.FileDir, conf.FileMaxSize, conf.FileMaxAge, conf.FileGzip, metrics)
+	if err != nil {
+		log.Fatalf("Unable to open file sink %s. %v", conf.FileDir, err)
+	}
+
+	return sink
+}
+
+func initWebhookSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewWebhookSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to create webhook sink. %v", err)
+	}
+
+	return sink
+}
+
+func initNatsSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewNatsSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to connect to nats %s. %v", conf.NatsURL, err)
+	}
+
+	return sink
+}
+
+func initRedisSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewRedisSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to create redis sink. %v", err)
+	}
+
+	return sink
+}
+
+func initMqttSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewMqttSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to connect to mqtt broker %s. %v", conf.MqttBroker, err)
+	}
+
+	return sink
+}
+
+func initGrpcSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewGrpcSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to start grpc server on %s. %v", conf.GrpcAddr, err)
+	}
+
+	return sink
+}
+
+func initSqliteSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewSqliteSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to open sqlite database %s. %v", conf.SqliteFile, err)
+	}
+
+	return sink
+}
+
+func initSQLSink(conf *pkg.Config, metrics *pkg.Metrics) pkg.Sink {
+	sink, err := pkg.NewSQLSink(conf, metrics)
+	if err != nil {
+		log.Fatalf("Unable to connect to %s database. %v", conf.SQLDriver, err)
+	}
+
+	return sink
+}
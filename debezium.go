@@ -0,0 +1,276 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Debezium operations
+const (
+	DebeziumCreate = "c"
+	DebeziumUpdate = "u"
+	DebeziumDelete = "d"
+)
+
+const debeziumConnector = "gtm"
+
+// DebeziumEvent is a change event in the Debezium envelope, as written by
+// the Kafka Connect JsonConverter with schemas.enable=false
+type DebeziumEvent struct {
+	Before      map[string]interface{} `json:"before"`
+	After       map[string]interface{} `json:"after"`
+	Source      *DebeziumSource        `json:"source"`
+	Op          string                 `json:"op"`
+	TsMs        int64                  `json:"ts_ms"`
+	Transaction *DebeziumTransaction   `json:"transaction"`
+}
+
+// DebeziumSource has the journal header and replication fields of the record
+type DebeziumSource struct {
+	Connector      string `json:"connector"`
+	Name           string `json:"name"`
+	TsMs           int64  `json:"ts_ms"`
+	Snapshot       string `json:"snapshot"`
+	Table          string `json:"table"`
+	StreamNum      int    `json:"stream_num"`
+	StreamSeq      int    `json:"stream_seq"`
+	JournalSeq     int    `json:"journal_seq"`
+	TokenSeq       int    `json:"token_seq"`
+	UpdateNum      int    `json:"update_num"`
+	TransactionNum string `json:"transaction_num,omitempty"`
+	Token          string `json:"token,omitempty"`
+	ProcessID      int16  `json:"pid,omitempty"`
+	ClientPID      int16  `json:"client_pid,omitempty"`
+}
+
+// DebeziumTransaction is the position of the record in its transaction
+type DebeziumTransaction struct {
+	ID                  string `json:"id"`
+	TotalOrder          int    `json:"total_order"`
+	DataCollectionOrder int    `json:"data_collection_order"`
+}
+
+// debeziumEncoder publishes a Debezium change event for each SET, KILL and
+// ZKILL of a unit. The table and row of a record are the global and its
+// global, key, subscripts and node_values as in JSON, or the dictionary
+// record and its named subscripts and fields when the node is in the
+// dictionary. SET is an update and KILL and ZKILL are deletes whose before
+// has only the node. Without the state store it is not known whether the
+// node of a SET existed, so every SET is an update whose before is null, as
+// Debezium does for a table without full replica identity. With the state
+// store, before has the previous value and SET of a node without a previous
+// value is a create.
+//
+// A KILL also deletes the descendants of its node. Without the state store
+// there is a delete for every dictionary record of the descendants, whose
+// before has the named subscripts of the KILL, e.g. acct for a KILL of
+// ^ACN(1234) and the record ^ACN(acct,51). With the state store there is
+// a delete for every descendant deleted, whose before has its last value.
+// All events of a record have the key of the record.
+type debeziumEncoder struct {
+	name string
+	now  func() time.Time
+}
+
+// newDebeziumEncoder returns the encoder, name is the
+// logical name in source, i.e. the instance name
+func newDebeziumEncoder(name string) (*debeziumEncoder, error) {
+	name, err := instanceName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &debeziumEncoder{name: name, now: time.Now}, nil
+}
+
+// Encode is not supported, the messages are per record
+func (d *debeziumEncoder) Encode(unit *Unit) (*Message, error) {
+	return nil, errors.New("debezium events are published per record")
+}
+
+// EncodeRecords returns the change events of the records
+func (d *debeziumEncoder) EncodeRecords(unit *Unit) ([][]*Message, error) {
+	if !unit.done {
+		return nil, errors.New("transaction not committed")
+	}
+
+	messages := make([][]*Message, len(unit.Records))
+	total, tables := 0, map[string]int{}
+
+	for i, rec := range unit.Records {
+		for _, event := range d.events(rec) {
+			if unit.IsTransaction() {
+				total++
+				tables[event.Source.Table]++
+				event.Transaction = &DebeziumTransaction{
+					ID:                  unit.id(),
+					TotalOrder:          total,
+					DataCollectionOrder: tables[event.Source.Table],
+				}
+			}
+
+			value, err := json.Marshal(event)
+			if err != nil {
+				return nil, err
+			}
+			messages[i] = append(messages[i], &Message{Value: string(value)})
+		}
+	}
+
+	return messages, nil
+}
+
+// events returns the change event of a record followed
+// by the deletes of the descendants for a KILL
+func (d *debeziumEncoder) events(rec *JournalRecord) []*DebeziumEvent {
+	event := d.event(rec)
+	if event == nil {
+		return nil
+	}
+
+	events := []*DebeziumEvent{event}
+	if rec.opcode != "KILL" {
+		return events
+	}
+
+	if before := rec.detail.before; before != nil {
+		for _, deleted := range before.deleted {
+			events = append(events, debeziumDeleted(rec, event, deleted))
+		}
+		return events
+	}
+
+	for _, record := range rec.detail.descendants {
+		descendant := debeziumDelete(event, record.Name)
+		descendant.Before = map[string]interface{}{}
+		for name, sub := range record.pattern.Names(rec.detail.node) {
+			descendant.Before[name] = sub
+		}
+		events = append(events, descendant)
+	}
+
+	return events
+}
+
+// debeziumDelete returns a copy of the delete event of a KILL for the table
+func debeziumDelete(event *DebeziumEvent, table string) *DebeziumEvent {
+	source := *event.Source
+	source.Table = table
+	return &DebeziumEvent{Source: &source, Op: DebeziumDelete, TsMs: event.TsMs}
+}
+
+// debeziumDeleted returns the delete event of a descendant deleted by a
+// KILL, in the table of its dictionary record if any
+func debeziumDeleted(rec *JournalRecord, event *DebeziumEvent, deleted *DeletedNode) *DebeziumEvent {
+	node := &Node{Global: rec.detail.node.Global}
+	for _, sub := range append([]string{deleted.Key}, deleted.Subscripts...) {
+		node.Subscripts = append(node.Subscripts, Subscript{Value: sub})
+	}
+
+	for _, record := range rec.detail.descendants {
+		if record.pattern.Match(node) {
+			descendant := debeziumDelete(event, record.Name)
+			descendant.Before = record.Values(node, strings.Join(deleted.NodeValues, "|"))
+			return descendant
+		}
+	}
+
+	descendant := debeziumDelete(event, strings.ToUpper(node.Global))
+	subscripts := deleted.Subscripts
+	if subscripts == nil {
+		subscripts = []string{}
+	}
+	descendant.Before = map[string]interface{}{
+		"global":      descendant.Source.Table,
+		"key":         deleted.Key,
+		"subscripts":  subscripts,
+		"node_values": deleted.NodeValues,
+	}
+	return descendant
+}
+
+// event returns the change event of a record or nil if
+// the record does not change a node
+func (d *debeziumEncoder) event(rec *JournalRecord) *DebeziumEvent {
+	if rec.detail.node == nil {
+		return nil
+	}
+
+	journal := rec.Event()
+	event := &DebeziumEvent{
+		Source: &DebeziumSource{
+			Connector:      debeziumConnector,
+			Name:           d.name,
+			TsMs:           rec.header.timestamp * 1000,
+			Snapshot:       "false",
+			Table:          journal.Global,
+			StreamNum:      journal.StreamNum,
+			StreamSeq:      journal.StreamSeq,
+			JournalSeq:     journal.JournalSeq,
+			TokenSeq:       journal.TokenSeq,
+			UpdateNum:      journal.UpdateNum,
+			TransactionNum: journal.TransactionNum,
+			Token:          journal.Token,
+			ProcessID:      journal.ProcessID,
+			ClientPID:      journal.ClientProcessID,
+		},
+		TsMs: d.now().UnixNano() / int64(time.Millisecond),
+	}
+	if journal.Record != "" {
+		event.Source.Table = journal.Record
+	}
+
+	// before and after have all pieces of the values even
+	// when only the changed pieces are published in JSON
+	var previous []string
+	if before := rec.detail.before; before != nil && before.exists {
+		previous = strings.Split(before.value, "|")
+	}
+	if previous != nil || isKill(rec) {
+		event.Before = debeziumRow(rec, journal, previous)
+	}
+
+	switch {
+	case rec.opcode == "SET":
+		event.Op = DebeziumUpdate
+		if rec.detail.before != nil && !rec.detail.before.exists {
+			event.Op = DebeziumCreate
+		}
+		event.After = debeziumRow(rec, journal, strings.Split(rec.detail.value, "|"))
+	case isKill(rec):
+		event.Op = DebeziumDelete
+	default:
+		return nil
+	}
+
+	return event
+}
+
+// debeziumRow returns the row of the record with the values,
+// the row has only the node when values is nil
+func debeziumRow(rec *JournalRecord, event *JournalEvent, values []string) map[string]interface{} {
+	if record := rec.detail.record; record != nil {
+		if values != nil {
+			return record.Values(rec.detail.node, strings.Join(values, "|"))
+		}
+		row := map[string]interface{}{}
+		for name, sub := range record.pattern.Names(rec.detail.node) {
+			row[name] = sub
+		}
+		return row
+	}
+
+	row := map[string]interface{}{
+		"global":     event.Global,
+		"key":        event.Key,
+		"subscripts": event.Subscripts,
+	}
+	if event.Subscripts == nil {
+		row["subscripts"] = []string{}
+	}
+	if values != nil {
+		row["node_values"] = values
+	}
+	return row
+}
@@ -0,0 +1,230 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDebeziumEncoder(t *testing.T) *debeziumEncoder {
+	encoder, err := newDebeziumEncoder("prod1")
+	assert.Nil(t, err)
+	encoder.now = func() time.Time { return time.Unix(1600000000, 0) }
+	return encoder
+}
+
+func Test_DebeziumEncoder_Transaction(t *testing.T) {
+	units := testAvroUnits(t)
+	msgs, err := testDebeziumEncoder(t).EncodeRecords(units[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+
+	expected := `{
+		"before": null,
+		"after": {"acct": "1234", "closed": null, "last_txn_date": "2008-08-04", "ledger_balance": 100.00, "txn_count": null},
+		"source": {
+			"connector": "gtm", "name": "prod1", "ts_ms": 1569950154000, "snapshot": "false",
+			"table": "account_balance", "stream_num": 0, "stream_seq": 0, "journal_seq": 3,
+			"token_seq": 3, "update_num": 1, "transaction_num": "3"
+		},
+		"op": "u",
+		"ts_ms": 1600000000000,
+		"transaction": {"id": "0-3", "total_order": 1, "data_collection_order": 1}
+	}`
+	assert.JSONEq(t, expected, msgs[0][0].Value)
+
+	event := &DebeziumEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(msgs[1][0].Value), event))
+	assert.Equal(t, "account_status", event.Source.Table)
+	assert.Equal(t, &DebeziumTransaction{ID: "0-3", TotalOrder: 2, DataCollectionOrder: 1}, event.Transaction)
+
+	// single record
+	msgs, err = testDebeziumEncoder(t).EncodeRecords(units[1])
+	assert.Nil(t, err)
+	event = &DebeziumEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(msgs[0][0].Value), event))
+	assert.Nil(t, event.Transaction)
+	assert.Contains(t, msgs[0][0].Value, `"ledger_balance":200.00`)
+}
+
+func Test_DebeziumEncoder_Records(t *testing.T) {
+	dict, err := LoadDictionary("testdata/dictionary.yaml")
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65287,62154\28\0\0\28\0\0\0\0\^XYZ(1,"a")="x|y"`,
+		`04\65287,62154\29\0\0\29\0\0\0\0\^XYZ(1)`,
+		`04\65287,62154\30\0\0\30\0\0\0\0\^ACN(1234,51)`,
+		`11\65287,62154\31\0\0\31\0\0\0\worm`,
+	)
+	dict.Apply(recs[2])
+
+	encoder := testDebeziumEncoder(t)
+	var events []*DebeziumEvent
+	for _, rec := range recs {
+		msgs, err := encoder.EncodeRecords(&Unit{Records: []*JournalRecord{rec}, done: true})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(msgs))
+		if len(msgs[0]) == 0 {
+			events = append(events, nil)
+			continue
+		}
+
+		event := &DebeziumEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(msgs[0][0].Value), event))
+		events = append(events, event)
+	}
+
+	assert.Equal(t, "u", events[0].Op)
+	assert.Equal(t, "XYZ", events[0].Source.Table)
+	assert.Equal(t, map[string]interface{}{
+		"global": "XYZ", "key": "1", "subscripts": []interface{}{"a"}, "node_values": []interface{}{"x", "y"},
+	}, events[0].After)
+
+	assert.Equal(t, "d", events[1].Op)
+	assert.Nil(t, events[1].After)
+	assert.Equal(t, map[string]interface{}{"global": "XYZ", "key": "1", "subscripts": []interface{}{}}, events[1].Before)
+
+	assert.Equal(t, "d", events[2].Op)
+	assert.Equal(t, "account_balance", events[2].Source.Table)
+	assert.Equal(t, map[string]interface{}{"acct": "1234"}, events[2].Before)
+
+	// not a change of a node
+	assert.Nil(t, events[3])
+
+	_, err = encoder.Encode(&Unit{Records: recs[:1], done: true})
+	assert.NotNil(t, err)
+}
+
+func testDebeziumEvents(t *testing.T, msgs []*Message) []*DebeziumEvent {
+	var events []*DebeziumEvent
+	for _, msg := range msgs {
+		event := &DebeziumEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(msg.Value), event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func Test_DebeziumEncoder_KillDescendants(t *testing.T) {
+	dict, err := LoadDictionary("testdata/dictionary.yaml")
+	assert.Nil(t, err)
+
+	kill := parseAll(t, `04\65287,62154\30\0\0\30\0\0\0\0\^ACN(1234)`)[0]
+	dict.Apply(kill)
+
+	// without the state store, a delete for each record matched by prefix
+	msgs, err := testDebeziumEncoder(t).EncodeRecords(&Unit{Records: []*JournalRecord{kill}, done: true})
+	assert.Nil(t, err)
+	events := testDebeziumEvents(t, msgs[0])
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "ACN", events[0].Source.Table)
+	for i, table := range []string{"account_balance", "account_status"} {
+		assert.Equal(t, "d", events[i+1].Op)
+		assert.Equal(t, table, events[i+1].Source.Table)
+		assert.Equal(t, map[string]interface{}{"acct": "1234"}, events[i+1].Before)
+		assert.Equal(t, 30, events[i+1].Source.JournalSeq)
+	}
+
+	// with the state store, a delete for each node deleted
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	recs := parseAll(t,
+		`05\65287,62154\28\0\0\28\0\0\0\0\^ACN(1234,51)="100.00|61212"`,
+		`05\65287,62154\29\0\0\29\0\0\0\0\^ACN(1234,"x")="y"`,
+	)
+	for _, rec := range append(recs, kill) {
+		assert.Nil(t, state.Apply(rec))
+	}
+	tcom := parseAll(t, `09\65287,62154\30\0\0\30\0\0\3\BATCH`)[0]
+	unit := &Unit{Records: append(recs, kill), commit: tcom, done: true}
+	msgs, err = testDebeziumEncoder(t).EncodeRecords(unit)
+	assert.Nil(t, err)
+	events = testDebeziumEvents(t, msgs[2])
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "account_balance", events[1].Source.Table)
+	assert.Equal(t, "1234", events[1].Before["acct"])
+	assert.Equal(t, 100.00, events[1].Before["ledger_balance"])
+	assert.Equal(t, "ACN", events[2].Source.Table)
+	assert.Equal(t, map[string]interface{}{
+		"global": "ACN", "key": "1234", "subscripts": []interface{}{"x"}, "node_values": []interface{}{"y"},
+	}, events[2].Before)
+	assert.Equal(t, 5, events[2].Transaction.TotalOrder)
+}
+
+func Test_DoFilter_KafkaDebezium(t *testing.T) {
+	encoder, err := NewEncoder(&Config{Format: FormatDebezium, Instance: "prod1"})
+	assert.Nil(t, err)
+
+	keyStrategy, err := NewKeyStrategy(KeyGlobalSubscripts)
+	assert.Nil(t, err)
+
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{
+		syncProducer: sp,
+		topic:        "cdc",
+	}
+	defer producer.CleanupProducer()
+
+	var keys []string
+	for i := 0; i < 4; i++ {
+		sp.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			key, err := msg.Key.Encode()
+			keys = append(keys, string(key))
+			return err
+		})
+	}
+
+	metrics := InitMetrics()
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{Producer: producer, KeyStrategy: keyStrategy, Encoder: encoder, Metrics: metrics}, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	assert.Equal(t, []string{"ACN:1234:51", "ACN:1234:52", "ACN:5678:51", "ACN:5678:51"}, keys)
+
+	_, err = NewEncoder(&Config{Format: FormatDebezium, CloudEvents: CloudEventsBinary})
+	assert.NotNil(t, err)
+}
+
+func Test_DebeziumEncoder_State(t *testing.T) {
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	recs := parseAll(t,
+		`05\65287,62154\1\0\0\1\0\0\0\0\^XYZ(1)="a|b"`,
+		`05\65287,62154\2\0\0\2\0\0\0\0\^XYZ(1)="a|c"`,
+		`10\65287,62154\3\0\0\3\0\0\0\0\^XYZ(1)`,
+	)
+
+	encoder := testDebeziumEncoder(t)
+	var events []*DebeziumEvent
+	for _, rec := range recs {
+		assert.Nil(t, state.Apply(rec))
+		msgs, err := encoder.EncodeRecords(&Unit{Records: []*JournalRecord{rec}, done: true})
+		assert.Nil(t, err)
+
+		event := &DebeziumEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(msgs[0][0].Value), event))
+		events = append(events, event)
+	}
+
+	assert.Equal(t, "c", events[0].Op)
+	assert.Nil(t, events[0].Before)
+
+	assert.Equal(t, "u", events[1].Op)
+	assert.Equal(t, []interface{}{"a", "b"}, events[1].Before["node_values"])
+	assert.Equal(t, []interface{}{"a", "c"}, events[1].After["node_values"])
+
+	assert.Equal(t, "d", events[2].Op)
+	assert.Equal(t, []interface{}{"a", "c"}, events[2].Before["node_values"])
+}
@@ -0,0 +1,279 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Field types
+const (
+	FieldString  = "string"
+	FieldDecimal = "decimal"
+	FieldInteger = "integer"
+	FieldBoolean = "boolean"
+	FieldDate    = "date"
+)
+
+const defaultDelimiter = "|"
+
+var decimalPattern = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)$`)
+
+// horolog day 0
+var horologEpoch = time.Date(1840, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Dictionary maps the value pieces of global nodes to named and typed
+// fields. It is loaded from a YAML file, e.g.
+//
+//	delimiter: "|"
+//	records:
+//	  - node: ^ACN(acct,51)
+//	    name: account_balance
+//	    fields:
+//	      - name: ledger_balance
+//	        type: decimal
+//	      - name: last_txn_date
+//	        type: date
+//	      - name: closed
+//	        piece: 5
+//	        type: boolean
+//
+// A field is the piece after the previous field unless piece is given,
+// the type is one of string, decimal, integer, boolean or date, which is
+// a $HOROLOG date with optional time. The named subscripts of the node
+// are string fields as well. The first record whose node matches is used.
+type Dictionary struct {
+	Delimiter string              `yaml:"delimiter"`
+	Records   []*DictionaryRecord `yaml:"records"`
+}
+
+// DictionaryRecord are the fields of the nodes matching a pattern
+type DictionaryRecord struct {
+	Node      string             `yaml:"node"`
+	Name      string             `yaml:"name"`
+	Delimiter string             `yaml:"delimiter"`
+	Fields    []*DictionaryField `yaml:"fields"`
+
+	pattern *NodePattern
+}
+
+// DictionaryField is a piece of the value, pieces are numbered from 1
+type DictionaryField struct {
+	Name  string `yaml:"name"`
+	Piece int    `yaml:"piece"`
+	Type  string `yaml:"type"`
+}
+
+// LoadDictionary reads and validates the dictionary file
+func LoadDictionary(path string) (*Dictionary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dict := &Dictionary{}
+	if err = yaml.Unmarshal(data, dict); err != nil {
+		return nil, err
+	}
+
+	if dict.Delimiter == "" {
+		dict.Delimiter = defaultDelimiter
+	}
+
+	for _, record := range dict.Records {
+		if record.pattern, err = ParseNodePattern(record.Node); err != nil {
+			return nil, fmt.Errorf("%s %s", ErrorInvalidPattern, record.Node)
+		}
+		if record.Name == "" {
+			return nil, errors.New("no name for " + record.Node)
+		}
+		if record.Delimiter == "" {
+			record.Delimiter = dict.Delimiter
+		}
+
+		names := map[string]bool{}
+		for _, sub := range record.pattern.Subscripts {
+			names[sub.Name] = sub.Name != ""
+		}
+
+		piece := 0
+		for _, field := range record.Fields {
+			if field.Piece == 0 {
+				field.Piece = piece + 1
+			}
+			piece = field.Piece
+
+			if field.Type == "" {
+				field.Type = FieldString
+			}
+
+			switch {
+			case field.Name == "":
+				return nil, fmt.Errorf("field without name in %s", record.Node)
+			case names[field.Name]:
+				return nil, fmt.Errorf("field %s used more than once in %s", field.Name, record.Node)
+			case field.Piece < 1:
+				return nil, fmt.Errorf("invalid piece %d of %s", field.Piece, field.Name)
+			}
+			names[field.Name] = true
+
+			switch field.Type {
+			case FieldString, FieldDecimal, FieldInteger, FieldBoolean, FieldDate:
+			default:
+				return nil, fmt.Errorf("invalid type %s of %s", field.Type, field.Name)
+			}
+		}
+	}
+
+	return dict, nil
+}
+
+// Apply sets the dictionary record of the journal record if its node
+// matches, and for a KILL the dictionary records of the descendants of
+// its node, i.e. the records whose nodes the KILL deletes
+func (d *Dictionary) Apply(rec *JournalRecord) {
+	node := rec.detail.node
+	if d == nil || node == nil {
+		return
+	}
+
+	for _, record := range d.Records {
+		switch {
+		case record.pattern.Match(node):
+			if rec.detail.record == nil {
+				rec.detail.record = record
+			}
+		case rec.opcode == "KILL" && record.pattern.MatchPrefix(node):
+			rec.detail.descendants = append(rec.detail.descendants, record)
+		}
+	}
+}
+
+// Values returns the named subscripts and fields of a node and value,
+// fields are nil when the piece is empty or not valid for the type
+func (r *DictionaryRecord) Values(node *Node, value string) map[string]interface{} {
+	values := map[string]interface{}{}
+	for name, sub := range r.pattern.Names(node) {
+		values[name] = sub
+	}
+
+	pieces := strings.Split(value, r.Delimiter)
+	for _, field := range r.Fields {
+		piece := ""
+		if field.Piece <= len(pieces) {
+			piece = pieces[field.Piece-1]
+		}
+
+		typed, err := field.value(piece)
+		if err != nil {
+			log.Debugf("%s of %s is not a valid %s. %+v", piece, field.Name, field.Type, err)
+			typed = nil
+		}
+		values[field.Name] = typed
+	}
+
+	return values
+}
+
+// value converts a piece to the type of the field
+func (f *DictionaryField) value(piece string) (interface{}, error) {
+	if f.Type == FieldString {
+		return piece, nil
+	}
+
+	piece = strings.TrimSpace(piece)
+	if piece == "" {
+		return nil, nil
+	}
+
+	switch f.Type {
+	case FieldDecimal:
+		return decimalValue(piece)
+
+	case FieldInteger:
+		i, err := strconv.ParseInt(piece, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return i, nil
+
+	case FieldBoolean:
+		switch strings.ToUpper(piece) {
+		case "Y", "YES", "T", "TRUE":
+			return true, nil
+		case "N", "NO", "F", "FALSE":
+			return false, nil
+		}
+		// M truth value
+		n, err := strconv.ParseFloat(piece, 64)
+		if err != nil {
+			return nil, err
+		}
+		return n != 0, nil
+
+	case FieldDate:
+		return horologDate(piece)
+	}
+
+	return nil, errors.New("invalid type " + f.Type)
+}
+
+// decimalValue returns the decimal as a JSON number keeping all digits,
+// e.g. 100.00, M numbers such as .5 get a leading zero
+func decimalValue(s string) (json.Number, error) {
+	if !decimalPattern.MatchString(s) {
+		return "", errors.New("invalid decimal " + s)
+	}
+
+	sign := ""
+	if s[0] == '-' || s[0] == '+' {
+		if s[0] == '-' {
+			sign = "-"
+		}
+		s = s[1:]
+	}
+
+	parts := strings.SplitN(s, ".", 2)
+	num := strings.TrimLeft(parts[0], "0")
+	if num == "" {
+		num = "0"
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		num += "." + parts[1]
+	}
+	if sign == "-" && strings.Trim(num, "0.") == "" {
+		sign = ""
+	}
+
+	return json.Number(sign + num), nil
+}
+
+// horologDate returns a $HOROLOG date as 2006-01-02, or
+// 2006-01-02T15:04:05 when the time is included
+func horologDate(s string) (string, error) {
+	parts := strings.Split(s, ",")
+	day, err := strconv.Atoi(parts[0])
+	if err != nil || day < 0 || len(parts) > 2 {
+		return "", errors.New(ErrorNotHorologFormat)
+	}
+
+	t := horologEpoch.AddDate(0, 0, day)
+	if len(parts) == 1 {
+		return t.Format("2006-01-02"), nil
+	}
+
+	sec, err := strconv.Atoi(parts[1])
+	if err != nil || sec < 0 || sec > 86399 {
+		return "", errors.New(ErrorNotHorologFormat)
+	}
+
+	return t.Add(time.Duration(sec) * time.Second).Format("2006-01-02T15:04:05"), nil
+}
@@ -0,0 +1,101 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DoFilter_Dictionary(t *testing.T) {
+	dict, err := LoadDictionary("testdata/dictionary.yaml")
+	assert.Nil(t, err)
+
+	metrics := InitMetrics()
+	sink := &testSink{name: "test"}
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Dictionary: dict, Metrics: metrics}).DoFilter(fin, fout)
+
+	jsonstr, err := sink.units[0].Records[0].JSON()
+	assert.Nil(t, err)
+	assert.Contains(t, jsonstr, `"record":"account_balance"`)
+	assert.Contains(t, jsonstr, `"fields":{"acct":"1234","closed":null,"last_txn_date":"2008-08-04","ledger_balance":100.00,"txn_count":null}`)
+
+	event := sink.units[0].Records[1].Event()
+	assert.Equal(t, "account_status", event.Record)
+	assert.Equal(t, map[string]interface{}{"acct": "1234", "status": "1", "since": nil}, event.Fields)
+}
+
+func Test_DictionaryRecord_Values(t *testing.T) {
+	dict, err := LoadDictionary("testdata/dictionary.yaml")
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="-.50|65287,62154|12||Y"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="abc|x|1.5||0"`,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,53)="1"`,
+	)
+	for _, rec := range recs {
+		dict.Apply(rec)
+	}
+
+	fields := recs[0].Event().Fields
+	assert.Equal(t, json.Number("-0.50"), fields["ledger_balance"])
+	assert.Equal(t, "2019-10-01T17:15:54", fields["last_txn_date"])
+	assert.Equal(t, int64(12), fields["txn_count"])
+	assert.Equal(t, true, fields["closed"])
+
+	// invalid pieces are null
+	fields = recs[1].Event().Fields
+	assert.Nil(t, fields["ledger_balance"])
+	assert.Nil(t, fields["last_txn_date"])
+	assert.Nil(t, fields["txn_count"])
+	assert.Equal(t, false, fields["closed"])
+
+	// KILL has no fields
+	assert.Equal(t, "account_balance", recs[2].Event().Record)
+	assert.Nil(t, recs[2].Event().Fields)
+
+	assert.Equal(t, "", recs[3].Event().Record)
+}
+
+func Test_LoadDictionary_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"records:\n  - node: ACN\n    name: acn",
+		"records:\n  - node: ^ACN",
+		"records:\n  - node: ^ACN\n    name: acn\n    fields: [{type: decimal}]",
+		"records:\n  - node: ^ACN(acct)\n    name: acn\n    fields: [{name: acct}]",
+		"records:\n  - node: ^ACN\n    name: acn\n    fields: [{name: a, type: float}]",
+		"records:\n  - node: ^ACN\n    name: acn\n    fields: [{name: a, piece: -1}]",
+		"records: [",
+	} {
+		path, err := testTempFileWithContent([]byte(content))
+		assert.Nil(t, err)
+		_, err = LoadDictionary(path)
+		assert.NotNil(t, err, content)
+		os.Remove(path)
+	}
+
+	_, err := LoadDictionary("testdata/no_such_file.yaml")
+	assert.NotNil(t, err)
+}
+
+func Test_DecimalValue(t *testing.T) {
+	for input, expected := range map[string]string{
+		"100.00": "100.00", ".5": "0.5", "-.5": "-0.5", "007": "7", "+1.": "1", "-0": "0",
+	} {
+		num, err := decimalValue(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, json.Number(expected), num, input)
+	}
+
+	for _, input := range []string{"1e5", "NaN", "Inf", "1.2.3", "-", "."} {
+		_, err := decimalValue(input)
+		assert.NotNil(t, err, input)
+	}
+}
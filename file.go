@@ -0,0 +1,445 @@
+package gtmcdc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkFile is the name of the file sink in GTMCDC_SINKS
+const SinkFile = "file"
+
+const (
+	fileSegmentExt = ".jsonl"
+	fileGzipExt    = ".gz"
+	fileOpenExt    = ".open"
+	fileManifest   = "manifest.json"
+
+	// the active segment is checked for rotation at
+	// least this often when there are no new records
+	fileRotateInterval = time.Second
+)
+
+// FileSegment describes a closed segment in the manifest. The journal_seq
+// range covers the records that have one, records of ZTSTART...ZTCOM
+// transactions have no journal_seq
+type FileSegment struct {
+	File            string `json:"file"`
+	FirstJournalSeq int    `json:"first_journal_seq"`
+	LastJournalSeq  int    `json:"last_journal_seq"`
+	Records         int    `json:"records"`
+	Closed          int64  `json:"closed"`
+}
+
+// FileSink writes the JSON of every journal record, one per line, to
+// segment files named <index>.jsonl in a directory. The active segment is
+// named <index>.jsonl.open until it is closed, once it grows beyond maxSize
+// bytes or becomes older than maxAge, and is then renamed to <index>.jsonl,
+// or compressed to <index>.jsonl.gz when compress is true.
+// The closed segments along with the first and last journal_seq in each of
+// them are listed in manifest.json in the same directory. The records of
+// a unit are always written to the same segment.
+type FileSink struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	metrics  *Metrics
+
+	next     int64
+	writer   *os.File
+	written  int64
+	opened   time.Time
+	active   *FileSegment
+	Segments []*FileSegment `json:"segments"`
+	closed   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenFileSink opens the file sink in directory dir, the directory is
+// created if it does not exist. Segments left open by a previous run, or
+// closed or compressed but not added to the manifest before a crash, are
+// closed and added to the manifest.
+func OpenFileSink(dir string, maxSize int64, maxAge time.Duration, compress bool, metrics *Metrics) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileSink{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+		metrics:  metrics,
+		next:     1,
+	}
+
+	bytes, err := ioutil.ReadFile(s.manifestPath())
+	if err == nil {
+		err = json.Unmarshal(bytes, s)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		var idx int64
+		if _, err := fmt.Sscanf(f.Name(), "%016d"+fileSegmentExt, &idx); err != nil {
+			continue
+		}
+		if idx >= s.next {
+			s.next = idx + 1
+		}
+
+		path := s.segmentPath(idx)
+		switch f.Name() {
+		case filepath.Base(path) + fileOpenExt:
+			log.Infof("closing segment %s from previous run", f.Name())
+			if err := os.Rename(path+fileOpenExt, path); err != nil {
+				return nil, err
+			}
+		case filepath.Base(path):
+			if s.listed(f.Name()) {
+				continue
+			}
+			log.Infof("adding segment %s from previous run to manifest", f.Name())
+		case filepath.Base(path) + fileGzipExt:
+			// the uncompressed segment, listed first, is recovered instead
+			if s.listed(f.Name()) || s.listed(filepath.Base(path)) {
+				continue
+			}
+			log.Infof("adding segment %s from previous run to manifest", f.Name())
+			if err := s.recover(path+fileGzipExt, true); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			continue
+		}
+
+		if err := s.recover(path, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if maxAge > 0 {
+		s.startRotation()
+	}
+
+	return s, nil
+}
+
+// listed returns true if the segment file is in the manifest
+func (s *FileSink) listed(name string) bool {
+	for _, seg := range s.Segments {
+		if seg.File == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startRotation closes the active segment once it is older than maxAge
+// even if nothing is published, until Close is called
+func (s *FileSink) startRotation() {
+	interval := fileRotateInterval
+	if s.maxAge < interval {
+		interval = s.maxAge
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					log.Errorf("Unable to close file segment. %+v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Name returns the name of the sink
+func (s *FileSink) Name() string {
+	return SinkFile
+}
+
+// Publish writes the JSON of the records of the unit to the active segment
+func (s *FileSink) Publish(unit *Unit) error {
+	var buf bytes.Buffer
+	for _, rec := range unit.Records {
+		jsonstr, err := rec.JSON()
+		if err != nil {
+			return err
+		}
+		buf.WriteString(jsonstr)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.rotateIfDue(); err != nil {
+		return err
+	}
+
+	if s.writer == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+
+	s.written += int64(buf.Len())
+	for _, rec := range unit.Records {
+		s.active.add(rec.repl.journalSeq)
+		s.metrics.IncrCounter("file_records_written")
+	}
+
+	return nil
+}
+
+func (seg *FileSegment) add(journalSeq int) {
+	seg.Records++
+	if journalSeq == 0 {
+		return
+	}
+	if seg.FirstJournalSeq == 0 {
+		seg.FirstJournalSeq = journalSeq
+	}
+	seg.LastJournalSeq = journalSeq
+}
+
+// Flush closes the active segment if it is due for rotation
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rotateIfDue()
+}
+
+// Close the active segment so that all segments are in the manifest
+func (s *FileSink) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return s.closeSegment()
+}
+
+// Healthy returns true until the sink is closed
+func (s *FileSink) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.closed
+}
+
+func (s *FileSink) segmentPath(idx int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d"+fileSegmentExt, idx))
+}
+
+func (s *FileSink) manifestPath() string {
+	return filepath.Join(s.dir, fileManifest)
+}
+
+func (s *FileSink) rotateIfDue() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	if s.written >= s.maxSize || (s.maxAge > 0 && time.Since(s.opened) >= s.maxAge) {
+		return s.closeSegment()
+	}
+
+	return nil
+}
+
+// open starts a new active segment
+func (s *FileSink) open() error {
+	path := s.segmentPath(s.next)
+	f, err := os.OpenFile(path+fileOpenExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.writer = f
+	s.written = 0
+	s.opened = time.Now()
+	s.active = &FileSegment{File: filepath.Base(path)}
+	s.next++
+
+	return syncDir(s.dir)
+}
+
+// closeSegment closes the active segment, renames it so that it is not
+// recovered again, compresses it and adds it to the manifest
+func (s *FileSink) closeSegment() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	name := s.writer.Name()
+	err := s.writer.Close()
+	s.writer = nil
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(name, fileOpenExt)
+	if err := os.Rename(name, path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	return s.finish(path, s.active)
+}
+
+// recover adds a segment of a previous run to the manifest, the
+// manifest entry is rebuilt from the journal_seq in the segment.
+// A compressed segment was compressed before a crash, it is added
+// to the manifest as is
+func (s *FileSink) recover(path string, compressed bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	seg := &FileSegment{File: filepath.Base(path)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event := JournalEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a partial line written before a crash
+			log.Warnf("invalid line in %s. %+v", path, err)
+			continue
+		}
+		seg.add(event.JournalSeq)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if compressed {
+		return s.list(seg)
+	}
+	return s.finish(path, seg)
+}
+
+// finish compresses the closed segment if configured
+// and adds it to the manifest
+func (s *FileSink) finish(path string, seg *FileSegment) error {
+	if s.compress {
+		if err := gzipFile(path); err != nil {
+			return err
+		}
+		seg.File += fileGzipExt
+	}
+
+	return s.list(seg)
+}
+
+// list adds the segment to the manifest
+func (s *FileSink) list(seg *FileSegment) error {
+	seg.Closed = time.Now().Unix()
+	s.Segments = append(s.Segments, seg)
+	s.metrics.IncrCounter("file_segments_closed")
+
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.manifestPath(), bytes)
+}
+
+// gzipFile compresses the file to a file with .gz appended
+// to its name and removes the original file
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+fileGzipExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
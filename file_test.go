@@ -0,0 +1,171 @@
+package gtmcdc
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFileSinkManifest(t *testing.T, dir string) []*FileSegment {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, fileManifest))
+	assert.Nil(t, err)
+
+	manifest := struct {
+		Segments []*FileSegment `json:"segments"`
+	}{}
+	assert.Nil(t, json.Unmarshal(bytes, &manifest))
+
+	return manifest.Segments
+}
+
+func testGunzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	bytes, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+
+	return string(bytes)
+}
+
+func Test_DoFilter_FileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	// every unit goes to its own segment
+	sink, err := OpenFileSink(dir, 1, time.Hour, true, metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+	assert.Nil(t, sinks.Close())
+
+	segments := testFileSinkManifest(t, dir)
+	assert.Equal(t, 3, len(segments))
+	assert.Equal(t, "0000000000000001.jsonl.gz", segments[0].File)
+	assert.Equal(t, 2, segments[0].Records)
+
+	// the updates of the transaction are in the first segment
+	lines := strings.Split(strings.TrimSpace(testGunzip(t, filepath.Join(dir, segments[0].File))), "\n")
+	assert.Equal(t, 2, len(lines))
+	event := JournalEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, "SET", event.Operand)
+	assert.Equal(t, segments[0].FirstJournalSeq, event.TokenSeq)
+
+	_, err = os.Stat(filepath.Join(dir, "0000000000000001.jsonl"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_FileSink_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a segment left open by a crash, with a partial line at the end
+	content := `{"operand":"SET","journal_seq":28}` + "\n" +
+		`{"operand":"SET","journal_seq":29}` + "\n" + `{"operand":"KI`
+	err = ioutil.WriteFile(filepath.Join(dir, "0000000000000003.jsonl.open"), []byte(content), 0644)
+	assert.Nil(t, err)
+
+	sink, err := OpenFileSink(dir, 1024, 0, false, InitMetrics())
+	assert.Nil(t, err)
+
+	segments := testFileSinkManifest(t, dir)
+	assert.Equal(t, 1, len(segments))
+	assert.Equal(t, "0000000000000003.jsonl", segments[0].File)
+	assert.Equal(t, 28, segments[0].FirstJournalSeq)
+	assert.Equal(t, 29, segments[0].LastJournalSeq)
+	assert.Equal(t, 2, segments[0].Records)
+
+	// new segments continue after the existing ones
+	recs := parseAll(t, `05\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,51)="1"`)
+	assert.Nil(t, sink.Publish(&Unit{Records: recs, done: true}))
+	assert.Nil(t, sink.Close())
+
+	segments = testFileSinkManifest(t, dir)
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, "0000000000000004.jsonl", segments[1].File)
+	assert.Equal(t, 30, segments[1].FirstJournalSeq)
+
+	// closed segments are not added to the manifest again
+	sink, err = OpenFileSink(dir, 1024, 0, false, InitMetrics())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Close())
+	assert.Equal(t, 2, len(testFileSinkManifest(t, dir)))
+
+	// a segment closed before a crash and not in the manifest yet
+	err = ioutil.WriteFile(filepath.Join(dir, "0000000000000005.jsonl"), []byte(content), 0644)
+	assert.Nil(t, err)
+	sink, err = OpenFileSink(dir, 1024, 0, false, InitMetrics())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Close())
+	segments = testFileSinkManifest(t, dir)
+	assert.Equal(t, 3, len(segments))
+	assert.Equal(t, "0000000000000005.jsonl", segments[2].File)
+
+	// a segment compressed before a crash and not in the manifest yet
+	path := filepath.Join(dir, "0000000000000006.jsonl")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	assert.Nil(t, gzipFile(path))
+	sink, err = OpenFileSink(dir, 1024, 0, true, InitMetrics())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Close())
+	segments = testFileSinkManifest(t, dir)
+	assert.Equal(t, 4, len(segments))
+	assert.Equal(t, "0000000000000006.jsonl.gz", segments[3].File)
+	assert.Equal(t, 29, segments[3].LastJournalSeq)
+	assert.Equal(t, 2, segments[3].Records)
+
+	// both files are left when the crash was before the
+	// uncompressed one was removed, the segment is listed once
+	path = filepath.Join(dir, "0000000000000007.jsonl")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	assert.Nil(t, ioutil.WriteFile(path+".gz", []byte("partial"), 0644))
+	sink, err = OpenFileSink(dir, 1024, 0, true, InitMetrics())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Close())
+	segments = testFileSinkManifest(t, dir)
+	assert.Equal(t, 5, len(segments))
+	assert.Equal(t, "0000000000000007.jsonl.gz", segments[4].File)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_FileSink_MaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := OpenFileSink(dir, 1024, 10*time.Millisecond, false, InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	recs := parseAll(t, `05\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,51)="1"`)
+	assert.Nil(t, sink.Publish(&Unit{Records: recs, done: true}))
+	_, err = os.Stat(filepath.Join(dir, "0000000000000001.jsonl.open"))
+	assert.Nil(t, err)
+
+	// the segment is closed without another record being published
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, fileManifest))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "0000000000000001.jsonl", testFileSinkManifest(t, dir)[0].File)
+}
@@ -20,6 +20,143 @@ type Config struct {
 	PromHTTPAddr    string `env:"GTMCDC_PROM_HTTP_ADDR" envDefault:"off"`
 	LogFile         string `env:"GTMCDC_LOG" envDefault:"stderr"`
 	LogLevel        string `env:"GTMCDC_LOG_LEVEL" envDefault:"debug"`
+
+	// sinks with optional failure policy, e.g. kafka:require,file:ignore
+	Sinks            []string      `env:"GTMCDC_SINKS" envDefault:"kafka" envSeparator:","`
+	SinkRetries      int           `env:"GTMCDC_SINK_RETRIES" envDefault:"3"`
+	SinkRetryBackoff time.Duration `env:"GTMCDC_SINK_RETRY_BACKOFF" envDefault:"1s"`
+
+	FileDir     string        `env:"GTMCDC_FILE_DIR" envDefault:"off"`
+	FileMaxSize int64         `env:"GTMCDC_FILE_MAX_SIZE" envDefault:"67108864"`
+	FileMaxAge  time.Duration `env:"GTMCDC_FILE_MAX_AGE" envDefault:"1h"`
+	FileGzip    bool          `env:"GTMCDC_FILE_GZIP" envDefault:"true"`
+
+	WebhookURL              string        `env:"GTMCDC_WEBHOOK_URL" envDefault:"off"`
+	WebhookHeaders          []string      `env:"GTMCDC_WEBHOOK_HEADERS" envSeparator:","`
+	WebhookHMACSecret       string        `env:"GTMCDC_WEBHOOK_HMAC_SECRET"`
+	WebhookBatchSize        int           `env:"GTMCDC_WEBHOOK_BATCH_SIZE" envDefault:"1"`
+	WebhookLinger           time.Duration `env:"GTMCDC_WEBHOOK_LINGER" envDefault:"100ms"`
+	WebhookTimeout          time.Duration `env:"GTMCDC_WEBHOOK_TIMEOUT" envDefault:"10s"`
+	WebhookRetries          int           `env:"GTMCDC_WEBHOOK_RETRIES" envDefault:"5"`
+	WebhookBackoff          time.Duration `env:"GTMCDC_WEBHOOK_BACKOFF" envDefault:"500ms"`
+	WebhookMaxBackoff       time.Duration `env:"GTMCDC_WEBHOOK_MAX_BACKOFF" envDefault:"30s"`
+	WebhookBreakerThreshold int           `env:"GTMCDC_WEBHOOK_BREAKER_THRESHOLD" envDefault:"5"`
+	WebhookBreakerCooldown  time.Duration `env:"GTMCDC_WEBHOOK_BREAKER_COOLDOWN" envDefault:"30s"`
+	WebhookMaxInFlight      int           `env:"GTMCDC_WEBHOOK_MAX_IN_FLIGHT" envDefault:"1000"`
+
+	NatsURL           string        `env:"GTMCDC_NATS_URL" envDefault:"off"`
+	NatsSubjectPrefix string        `env:"GTMCDC_NATS_SUBJECT_PREFIX" envDefault:"gtmcdc"`
+	NatsJetStream     bool          `env:"GTMCDC_NATS_JETSTREAM" envDefault:"true"`
+	NatsCreds         string        `env:"GTMCDC_NATS_CREDS"`
+	NatsTimeout       time.Duration `env:"GTMCDC_NATS_TIMEOUT" envDefault:"5s"`
+
+	RedisAddr     string        `env:"GTMCDC_REDIS_ADDR" envDefault:"off"`
+	RedisPassword string        `env:"GTMCDC_REDIS_PASSWORD"`
+	RedisDB       int           `env:"GTMCDC_REDIS_DB" envDefault:"0"`
+	RedisStream   string        `env:"GTMCDC_REDIS_STREAM" envDefault:"gtmcdc:{{.Global}}"`
+	RedisMaxLen   int64         `env:"GTMCDC_REDIS_MAXLEN" envDefault:"1000000"`
+	RedisTimeout  time.Duration `env:"GTMCDC_REDIS_TIMEOUT" envDefault:"5s"`
+
+	MqttBroker   string        `env:"GTMCDC_MQTT_BROKER" envDefault:"off"`
+	MqttVersion  string        `env:"GTMCDC_MQTT_VERSION" envDefault:"3.1.1"`
+	MqttClientID string        `env:"GTMCDC_MQTT_CLIENT_ID" envDefault:"gtmcdc"`
+	MqttUser     string        `env:"GTMCDC_MQTT_USER"`
+	MqttPassword string        `env:"GTMCDC_MQTT_PASSWORD"`
+	MqttTopic    string        `env:"GTMCDC_MQTT_TOPIC" envDefault:"gtmcdc/{{.Global}}/{{.Key}}{{range .Subscripts}}/{{.}}{{end}}"`
+	MqttQoS      int           `env:"GTMCDC_MQTT_QOS" envDefault:"1"`
+	MqttRetained bool          `env:"GTMCDC_MQTT_RETAINED" envDefault:"false"`
+	MqttTimeout  time.Duration `env:"GTMCDC_MQTT_TIMEOUT" envDefault:"10s"`
+
+	GrpcAddr       string `env:"GTMCDC_GRPC_ADDR" envDefault:"off"`
+	GrpcBufferSize int    `env:"GTMCDC_GRPC_BUFFER_SIZE" envDefault:"10000"`
+
+	SqliteFile    string   `env:"GTMCDC_SQLITE_FILE" envDefault:"off"`
+	SqliteGlobals []string `env:"GTMCDC_SQLITE_GLOBALS" envSeparator:","`
+
+	SQLDriver      string        `env:"GTMCDC_SQL_DRIVER" envDefault:"postgres"`
+	SQLDSN         string        `env:"GTMCDC_SQL_DSN" envDefault:"off"`
+	SQLMapping     string        `env:"GTMCDC_SQL_MAPPING" envDefault:"sql_mapping.yaml"`
+	SQLBatchSize   int           `env:"GTMCDC_SQL_BATCH_SIZE" envDefault:"100"`
+	SQLLinger      time.Duration `env:"GTMCDC_SQL_LINGER" envDefault:"100ms"`
+	SQLMaxInFlight int           `env:"GTMCDC_SQL_MAX_IN_FLIGHT" envDefault:"1000"`
+
+	SpoolDir           string        `env:"GTMCDC_SPOOL_DIR" envDefault:"off"`
+	SpoolSegmentSize   int64         `env:"GTMCDC_SPOOL_SEGMENT_SIZE" envDefault:"67108864"`
+	SpoolDrainInterval time.Duration `env:"GTMCDC_SPOOL_DRAIN_INTERVAL" envDefault:"5s"`
+
+	KafkaAsync       bool          `env:"GTMCDC_KAFKA_ASYNC" envDefault:"false"`
+	KafkaBatchSize   int           `env:"GTMCDC_KAFKA_BATCH_SIZE" envDefault:"100"`
+	KafkaLinger      time.Duration `env:"GTMCDC_KAFKA_LINGER" envDefault:"10ms"`
+	KafkaCompression string        `env:"GTMCDC_KAFKA_COMPRESSION" envDefault:"none"`
+	KafkaMaxInFlight int           `env:"GTMCDC_KAFKA_MAX_IN_FLIGHT" envDefault:"1000"`
+
+	KafkaTLS           bool   `env:"GTMCDC_KAFKA_TLS" envDefault:"false"`
+	KafkaTLSCA         string `env:"GTMCDC_KAFKA_TLS_CA"`
+	KafkaTLSCert       string `env:"GTMCDC_KAFKA_TLS_CERT"`
+	KafkaTLSKey        string `env:"GTMCDC_KAFKA_TLS_KEY"`
+	KafkaTLSSkipVerify bool   `env:"GTMCDC_KAFKA_TLS_SKIP_VERIFY" envDefault:"false"`
+	KafkaSASLMechanism string `env:"GTMCDC_KAFKA_SASL_MECHANISM" envDefault:"off"`
+	KafkaSASLUser      string `env:"GTMCDC_KAFKA_SASL_USER"`
+	KafkaSASLPassword  string `env:"GTMCDC_KAFKA_SASL_PASSWORD"`
+
+	KafkaIdempotent      bool   `env:"GTMCDC_KAFKA_IDEMPOTENT" envDefault:"false"`
+	KafkaTransactionalID string `env:"GTMCDC_KAFKA_TRANSACTIONAL_ID"`
+
+	KafkaKey              string `env:"GTMCDC_KAFKA_KEY" envDefault:"none"`
+	KafkaTombstone        string `env:"GTMCDC_KAFKA_TOMBSTONE" envDefault:"off"`
+	KafkaTombstoneSubtree bool   `env:"GTMCDC_KAFKA_TOMBSTONE_SUBTREE" envDefault:"false"`
+
+	Format                 string `env:"GTMCDC_FORMAT" envDefault:"json"`
+	SchemaRegistry         string `env:"GTMCDC_SCHEMA_REGISTRY" envDefault:"off"`
+	SchemaRegistryUser     string `env:"GTMCDC_SCHEMA_REGISTRY_USER"`
+	SchemaRegistryPassword string `env:"GTMCDC_SCHEMA_REGISTRY_PASSWORD"`
+
+	CloudEvents string `env:"GTMCDC_CLOUDEVENTS" envDefault:"off"`
+	Instance    string `env:"GTMCDC_INSTANCE"`
+
+	Dictionary string `env:"GTMCDC_DICTIONARY" envDefault:"off"`
+	StateFile  string `env:"GTMCDC_STATE_FILE" envDefault:"off"`
+
+	Changes           string   `env:"GTMCDC_CHANGES" envDefault:"full"`
+	Watch             []string `env:"GTMCDC_WATCH" envSeparator:";"`
+	SuppressUnchanged bool     `env:"GTMCDC_SUPPRESS_UNCHANGED" envDefault:"false"`
+
+	TransactionMaxLines int           `env:"GTMCDC_TRANSACTION_MAX_LINES" envDefault:"100000"`
+	TransactionTimeout  time.Duration `env:"GTMCDC_TRANSACTION_TIMEOUT" envDefault:"5m"`
+
+	CheckpointFile  string `env:"GTMCDC_CHECKPOINT_FILE" envDefault:"off"`
+	CheckpointEvery int    `env:"GTMCDC_CHECKPOINT_EVERY" envDefault:"1"`
+}
+
+// String returns the configurations with secrets masked so that
+// it can be logged
+func (c *Config) String() string {
+	masked := *c
+	if masked.KafkaSASLPassword != "" {
+		masked.KafkaSASLPassword = "******"
+	}
+	if masked.RedisPassword != "" {
+		masked.RedisPassword = "******"
+	}
+	if masked.MqttPassword != "" {
+		masked.MqttPassword = "******"
+	}
+	if masked.SchemaRegistryPassword != "" {
+		masked.SchemaRegistryPassword = "******"
+	}
+	// the dsn may contain the database password
+	if masked.SQLDSN != "" && masked.SQLDSN != "off" {
+		masked.SQLDSN = "******"
+	}
+	if masked.WebhookHMACSecret != "" {
+		masked.WebhookHMACSecret = "******"
+	}
+	// header values may contain credentials
+	masked.WebhookHeaders = nil
+	for _, header := range c.WebhookHeaders {
+		masked.WebhookHeaders = append(masked.WebhookHeaders, strings.SplitN(header, ":", 2)[0]+": ******")
+	}
+	return fmt.Sprintf("%+v", masked)
 }
 
 // LoadConfig loads the filter configurations from file
@@ -42,55 +179,202 @@ func LoadConfig(envFile string) *Config {
 	return &conf
 }
 
+// Filter holds the components used by the filter to publish journal records
+//
+// Sinks are the destinations where the units are published to. When
+// Checkpoint is not nil, records that were published before the filter
+// restarted are skipped. When any sink is in async mode, up to MaxInFlight
+// messages are sent without waiting for acknowledgement. When Dictionary
+// is not nil, events of the nodes in the dictionary have typed fields.
+// When State is not nil, events have the previous value of the node, and
+// Changes decides whether SETs are published with all or only the changed
+// pieces, or not published at all. The state is updated with the units
+// that are published, not with the units skipped by the checkpoint. A transaction that is not committed
+// within TransactionMaxLines lines or TransactionTimeout is forwarded
+// without being published.
+type Filter struct {
+	Sinks       *Fanout
+	Checkpoint  *Checkpoint
+	Dictionary  *Dictionary
+	State       *StateStore
+	Changes     *ChangeDetector
+	MaxInFlight int
+	Metrics     *Metrics
+
+	TransactionMaxLines int
+	TransactionTimeout  time.Duration
+
+	window *window
+}
+
 // DoFilter is the main processing loop that
 // reads journal extract and publish messages
-func DoFilter(fin, fout *os.File, producer *Producer, metrics *Metrics) {
+func (f *Filter) DoFilter(fin, fout *os.File) {
+	assembler := NewTransactionAssembler()
+	assembler.MaxLines, assembler.Timeout = f.TransactionMaxLines, f.TransactionTimeout
+
+	if f.Sinks.IsAsync() {
+		f.window = newWindow(f, fout, f.MaxInFlight)
+		defer func() {
+			f.window = nil
+		}()
+	}
+
 	scanner := bufio.NewScanner(fin)
-	for scanner.Scan() {
+	stopped := false
+	for !stopped && scanner.Scan() {
 		line := scanner.Text()
-		metrics.IncrCounter("lines_read_from_input")
-
-		// log with fields
-		logf := log.WithField("journal", line)
+		f.Metrics.IncrCounter("lines_read_from_input")
 
 		rec, err := Parse(line)
 		if err != nil {
-			logf.Info("Unable to parse record")
-			metrics.IncrCounter("lines_parse_error")
-		} else {
-			metrics.IncrCounter("lines_parsed")
+			log.WithField("journal", line).Info("Unable to parse record")
+			f.Metrics.IncrCounter("lines_parse_error")
+			continue
+		}
 
-			jsonstr, err := rec.JSON()
-			if err != nil {
-				logf.Infof("cannot marshal to JSON due to %+v", err)
-				continue
+		f.Metrics.IncrCounter("lines_parsed")
+		f.Dictionary.Apply(rec)
+		for _, unit := range assembler.Add(rec, line) {
+			if stopped = !f.processUnit(unit, fout); stopped {
+				break
 			}
+		}
+	}
 
-			logf.Debugf("line parsed to json %s", jsonstr)
+	if !stopped {
+		for _, unit := range assembler.Flush() {
+			if !f.processUnit(unit, fout) {
+				break
+			}
+		}
+	}
 
-			if producer.IsKafkaAvailable() && jsonstr != "" {
-				start := time.Now()
+	if f.window != nil {
+		f.window.wait()
+	}
 
-				err = producer.PublishMessage(jsonstr)
-				if err != nil {
-					logf.Warnf("Unable to publish message for journal record. %+v", err)
-					metrics.IncrCounter("lines_parsed_but_not_published")
-				} else {
-					metrics.IncrCounter("lines_parsed_and_published")
-					elapsed := time.Since(start)
-					metrics.HistoObserve("message_publish_to_kafka", float64(elapsed/time.Microsecond))
-				}
-			}
+	if err := f.Sinks.Flush(); err != nil {
+		log.Warnf("Unable to flush sinks. %+v", err)
+	}
 
-			// send to output only after a message is successfully published
-			_, err = fmt.Fprintln(fout, line)
-			if err != nil {
-				metrics.IncrCounter("lines_output_write_error")
-				logf.Infof("Unable to write to output")
-			} else {
-				metrics.IncrCounter("lines_output_written")
-			}
+	if err := f.Checkpoint.Save(); err != nil {
+		log.Warnf("Unable to save checkpoint. %+v", err)
+	}
+}
+
+// processUnit publishes a single journal record or a committed transaction
+// and then writes the journal lines to the output. It returns false if
+// the filter should stop because of a sink failure.
+func (f *Filter) processUnit(unit *Unit, fout *os.File) bool {
+	if f.window != nil {
+		return f.processUnitAsync(unit)
+	}
+
+	// log with fields
+	logf := log.WithField("journal", unit.Lines[0])
+	metrics := f.Metrics
+
+	if f.Checkpoint.IsPublished(unit) {
+		// resent by the replication source after a restart
+		logf.Debug("journal record published already")
+		metrics.IncrCounter("lines_skipped_by_checkpoint")
+	} else if unit.IsCommitted() {
+		f.applyState(unit)
+		if unit.isSuppressed() {
+			// no watched piece changed, only replica sinks get the unit
+			logf.Debug("journal record suppressed")
+			metrics.IncrCounter("lines_suppressed_unchanged")
+		}
+
+		// the lines are held back when a sink failed
+		if err := f.Sinks.Publish(unit); err != nil {
+			logf.Errorf("filter stopped. %+v", err)
+			return false
 		}
+		f.updateCheckpoint(unit)
+	} else {
+		// the input ended before the transaction is committed or it is
+		// abandoned, nothing is published but the lines are still forwarded
+		logf.Warnf("transaction not committed, %d lines not published", len(unit.Lines))
+		metrics.IncrCounter("transactions_not_committed")
+	}
+
+	// send to output only after a message is successfully published or spooled
+	f.writeLines(unit, fout)
+	return true
+}
+
+// processUnitAsync publishes a unit to the sinks without waiting for
+// acknowledgement. The lines are written to the output by the window once
+// all messages are acknowledged
+func (f *Filter) processUnitAsync(unit *Unit) bool {
+	// log with fields
+	logf := log.WithField("journal", unit.Lines[0])
+
+	pu := &pendingUnit{unit: unit}
+	if !f.window.add(pu) {
+		logf.Error("filter stopped because of an earlier sink failure")
+		return false
+	}
+	defer f.window.sent(pu)
+
+	if f.Checkpoint.IsPublished(unit) {
+		logf.Debug("journal record published already")
+		f.Metrics.IncrCounter("lines_skipped_by_checkpoint")
+		pu.skip = true
+		return true
+	}
+
+	if !unit.IsCommitted() {
+		logf.Warnf("transaction not committed, %d lines not published", len(unit.Lines))
+		f.Metrics.IncrCounter("transactions_not_committed")
+		pu.skip = true
+		return true
+	}
+
+	f.applyState(unit)
+	if unit.isSuppressed() {
+		// no watched piece changed, only replica sinks get the unit
+		logf.Debug("journal record suppressed")
+		f.Metrics.IncrCounter("lines_suppressed_unchanged")
+	}
+
+	f.Sinks.PublishAsync(unit,
+		func() { f.window.track(pu) },
+		func(err error) { f.window.ack(pu, err) },
+	)
+
+	return true
+}
+
+// applyState updates the state store with a unit that is published, which
+// sets the before images of its records, and detects the changed pieces
+func (f *Filter) applyState(unit *Unit) {
+	if err := f.State.ApplyUnit(unit); err != nil {
+		log.WithField("journal", unit.Lines[0]).Warnf("Unable to update state store. %+v", err)
+	}
+	for _, rec := range unit.Records {
+		f.Changes.Apply(rec)
+	}
+}
+
+// writeLines writes the journal lines of a unit to the output
+func (f *Filter) writeLines(unit *Unit, fout *os.File) {
+	for _, line := range unit.Lines {
+		_, err := fmt.Fprintln(fout, line)
+		if err != nil {
+			f.Metrics.IncrCounter("lines_output_write_error")
+			log.WithField("journal", line).Infof("Unable to write to output")
+		} else {
+			f.Metrics.IncrCounter("lines_output_written")
+		}
+	}
+}
+
+func (f *Filter) updateCheckpoint(unit *Unit) {
+	if err := f.Checkpoint.Update(unit); err != nil {
+		log.Warnf("Unable to save checkpoint. %+v", err)
 	}
 }
 
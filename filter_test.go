@@ -95,17 +95,97 @@ func Test_DoFilter_MockKafka(t *testing.T) {
 	// the file contains 3 records
 	// #1 is good
 	// #2 is a TCOM, the mock producer will fail when this
-	// #3 cannot be parsed
-	//    message is published
+	//    message is published, which stops the filter
+	//    without forwarding the line
+	// #3 cannot be parsed, it is not read
 	fin, fout := InitInputAndOutput("testdata/test1.txt", nullFile())
-	DoFilter(fin, fout, producer, metrics)
+	(&Filter{Sinks: testKafkaSinks(producer, metrics), Metrics: metrics}).DoFilter(fin, fout)
 
 	currentValues := getCounters(metrics, counters)
 	deltas, err := deltaCounters(prevValues, currentValues)
 
 	assert.Nil(t, err)
-	expected := []float64{3.0, 1.0, 2.0, 1.0, 1.0}
-	assert.ElementsMatch(t, expected, deltas)
+	expected := []float64{2.0, 0.0, 1.0, 1.0, 1.0}
+	assert.Equal(t, expected, deltas)
+}
+
+func Test_DoFilter_Transactions(t *testing.T) {
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{
+		syncProducer: sp,
+		topic:        "does_not_matter",
+	}
+	defer producer.CleanupProducer()
+
+	// TSTART...TCOM, a single SET and ZTSTART...ZTCOM
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndSucceed()
+
+	counters := []string{
+		"lines_read_from_input",
+		"lines_output_written",
+		"lines_parsed_and_published",
+	}
+
+	metrics := InitMetrics()
+	prevValues := getCounters(metrics, counters)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: testKafkaSinks(producer, metrics), Metrics: metrics}).DoFilter(fin, fout)
+
+	currentValues := getCounters(metrics, counters)
+	deltas, err := deltaCounters(prevValues, currentValues)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{8.0, 8.0, 3.0}, deltas)
+}
+
+func Test_DoFilter_Async(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	spool, err := OpenSpool(dir, 1024, metrics)
+	assert.Nil(t, err)
+	defer spool.Close()
+
+	producer, ap := testAsyncProducer(t)
+	defer producer.CleanupProducer()
+
+	// the single SET fails and is spooled, the transaction after it
+	// is spooled as well to keep the order until the spool is drained
+	ap.ExpectInputAndSucceed()
+	ap.ExpectInputAndFail(errors.New("send message failed"))
+
+	counters := []string{
+		"lines_output_written",
+		"lines_parsed_and_published",
+		"lines_parsed_and_spooled",
+	}
+	prevValues := getCounters(metrics, counters)
+
+	output, err := testTempFileWithContent([]byte(""))
+	assert.Nil(t, err)
+	defer os.Remove(output)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", output)
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{Producer: producer, Spool: spool, Metrics: metrics}, FailureRequire)
+	filter := &Filter{Sinks: sinks, MaxInFlight: 1, Metrics: metrics}
+	filter.DoFilter(fin, fout)
+	_ = fout.Close()
+
+	currentValues := getCounters(metrics, counters)
+	deltas, err := deltaCounters(prevValues, currentValues)
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{8.0, 1.0, 2.0}, deltas)
+	assert.Equal(t, 2, spool.Depth())
+
+	// output is in the same order as input
+	expected, _ := ioutil.ReadFile("testdata/test_tp.txt")
+	actual, _ := ioutil.ReadFile(output)
+	assert.Equal(t, string(expected), string(actual))
 }
 
 func getCounters(metrics *Metrics, counterNames []string) []float64 {
@@ -0,0 +1,98 @@
+package gtmcdc
+
+import (
+	"errors"
+	"os"
+)
+
+// Formats of the messages published to Kafka
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+	FormatDebezium = "debezium"
+)
+
+// Encoder encodes a unit into the value and headers of the message
+// published to Kafka. The key is set by the sink.
+type Encoder interface {
+	Encode(unit *Unit) (*Message, error)
+}
+
+// RecordEncoder is implemented by encoders that publish messages for each
+// record of a unit instead of one message for the unit. The messages are
+// in the order of the records, the messages of a record are at its index
+// and there are none for records that are not published.
+type RecordEncoder interface {
+	EncodeRecords(unit *Unit) ([][]*Message, error)
+}
+
+// contentTypes are the content types of the formats
+var contentTypes = map[string]string{
+	FormatJSON:     "application/json",
+	FormatAvro:     "application/avro",
+	FormatProtobuf: "application/protobuf",
+}
+
+// NewEncoder returns the encoder of the format in the configuration,
+// wrapped in CloudEvents when it is enabled
+func NewEncoder(conf *Config) (Encoder, error) {
+	encoder, err := newFormatEncoder(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.CloudEvents == "" || conf.CloudEvents == CloudEventsOff {
+		return encoder, nil
+	}
+	if _, ok := encoder.(RecordEncoder); ok {
+		return nil, errors.New("cloudevents is not supported with format " + conf.Format)
+	}
+
+	format := conf.Format
+	if format == "" {
+		format = FormatJSON
+	}
+	return NewCloudEventsEncoder(encoder, conf.CloudEvents, conf.Instance, contentTypes[format])
+}
+
+func newFormatEncoder(conf *Config) (Encoder, error) {
+	switch conf.Format {
+	case "", FormatJSON:
+		return jsonEncoder{}, nil
+
+	case FormatAvro:
+		registry, err := NewSchemaRegistry(conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewAvroEncoder(registry, conf.KafkaTopic), nil
+
+	case FormatProtobuf:
+		return protobufEncoder{}, nil
+
+	case FormatDebezium:
+		return newDebeziumEncoder(conf.Instance)
+	}
+
+	return nil, errors.New("unsupported format " + conf.Format)
+}
+
+// jsonEncoder encodes a unit as JSON, see Unit.JSON
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(unit *Unit) (*Message, error) {
+	jsonstr, err := unit.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Value: jsonstr}, nil
+}
+
+// instanceName returns the name or the hostname if name is empty
+func instanceName(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
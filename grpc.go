@@ -0,0 +1,298 @@
+package gtmcdc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gtmcdc/cdcpb"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SinkGrpc is the name of the gRPC streaming sink in GTMCDC_SINKS
+const SinkGrpc = "grpc"
+
+// Error Messages
+const (
+	ErrorCursorExpired    = "records after the cursor are no longer in the buffer"
+	ErrorSubscriberBehind = "subscriber fell behind the buffer"
+)
+
+// GrpcSink keeps the latest records in a ring buffer and streams them to
+// the clients of the Cdc service defined in cdcpb/cdc.proto. A client
+// resumes after the cursor of the last record it received as long
+// as the following records are still in the buffer. After cdcfilter
+// restarted, the buffer starts over and a client resumes after the
+// journal_seq of the last record it received instead. Publishing never
+// blocks on slow clients, a client that falls behind the buffer gets
+// RESOURCE_EXHAUSTED and has to subscribe again.
+type GrpcSink struct {
+	cdcpb.UnimplementedCdcServer
+
+	ring     *eventRing
+	listener net.Listener
+	server   *grpc.Server
+	metrics  *Metrics
+}
+
+// NewGrpcSink starts the gRPC server on the address in the configuration
+func NewGrpcSink(conf *Config, metrics *Metrics) (*GrpcSink, error) {
+	if conf.GrpcAddr == "" || conf.GrpcAddr == "off" {
+		return nil, errors.New("invalid grpc address")
+	}
+	if conf.GrpcBufferSize <= 0 {
+		return nil, errors.New("invalid grpc buffer size")
+	}
+
+	listener, err := net.Listen("tcp", conf.GrpcAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GrpcSink{
+		ring:     newEventRing(conf.GrpcBufferSize),
+		listener: listener,
+		server:   grpc.NewServer(),
+		metrics:  metrics,
+	}
+	cdcpb.RegisterCdcServer(g.server, g)
+
+	go func() {
+		if err := g.server.Serve(listener); err != nil {
+			log.Warnf("grpc server stopped. %+v", err)
+		}
+	}()
+
+	log.Infof("grpc server listening on %s", listener.Addr())
+	return g, nil
+}
+
+// Addr returns the address the gRPC server is listening on
+func (g *GrpcSink) Addr() string {
+	return g.listener.Addr().String()
+}
+
+// Name returns the name of the sink
+func (g *GrpcSink) Name() string {
+	return SinkGrpc
+}
+
+// Publish adds the records of the unit to the buffer, subscribers
+// see the records of a unit together
+func (g *GrpcSink) Publish(unit *Unit) error {
+	events := make([]*cdcpb.Event, 0, len(unit.Records))
+	for _, rec := range unit.Records {
+		jsonstr, err := rec.JSON()
+		if err != nil {
+			return err
+		}
+
+		event := rec.Event()
+		streamNum, pos := rec.position()
+		events = append(events, &cdcpb.Event{
+			StreamNum:  uint32(streamNum),
+			StreamSeq:  uint64(pos.StreamSeq),
+			JournalSeq: uint64(pos.JournalSeq),
+			Operand:    event.Operand,
+			Global:     event.Global,
+			Json:       []byte(jsonstr),
+		})
+	}
+
+	g.ring.add(events)
+	for range events {
+		g.metrics.IncrCounter("grpc_records_buffered")
+	}
+
+	return nil
+}
+
+// Subscribe implements the Cdc service
+func (g *GrpcSink) Subscribe(req *cdcpb.SubscribeRequest, stream cdcpb.Cdc_SubscribeServer) error {
+	match := newEventMatcher(req)
+
+	var pos uint64
+	var err error
+	if req.FromCursor != 0 {
+		pos, err = g.ring.seek(req.FromCursor)
+	} else {
+		pos, err = g.ring.seekJournalSeq(req.FromJournalSeq)
+	}
+	if err != nil {
+		return err
+	}
+
+	g.metrics.IncrCounter("grpc_subscriptions")
+	for {
+		events, next, changed, err := g.ring.read(pos)
+		if err != nil {
+			g.metrics.IncrCounter("grpc_subscribers_behind")
+			return err
+		}
+
+		for _, event := range events {
+			if !match(event) {
+				continue
+			}
+			if err = stream.Send(event); err != nil {
+				return err
+			}
+			g.metrics.IncrCounter("grpc_records_streamed")
+		}
+		pos = next
+
+		if len(events) == 0 {
+			select {
+			case <-changed:
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			}
+		}
+	}
+}
+
+// Flush does nothing because the records are in the buffer
+func (g *GrpcSink) Flush() error {
+	return nil
+}
+
+// Close stops the gRPC server, which ends all subscriptions
+func (g *GrpcSink) Close() error {
+	g.server.Stop()
+	return nil
+}
+
+// Healthy always returns true since publishing only adds to the buffer
+func (g *GrpcSink) Healthy() bool {
+	return true
+}
+
+// newEventMatcher returns a function which returns true
+// for the events matching the globals and operands requested
+func newEventMatcher(req *cdcpb.SubscribeRequest) func(event *cdcpb.Event) bool {
+	globals, operands := map[string]bool{}, map[string]bool{}
+	for _, global := range req.Globals {
+		globals[strings.ToUpper(strings.TrimPrefix(global, "^"))] = true
+	}
+	for _, operand := range req.Operands {
+		operands[strings.ToUpper(operand)] = true
+	}
+
+	return func(event *cdcpb.Event) bool {
+		return (len(globals) == 0 || globals[event.Global]) &&
+			(len(operands) == 0 || operands[event.Operand])
+	}
+}
+
+// eventRing is a fixed size buffer of the latest events. Events are
+// addressed by their position, which counts all events ever added.
+// The cursor of an event is its position after base, which is the
+// time the ring was created so that the cursors of a ring are greater
+// than the cursors of the rings before a restart.
+type eventRing struct {
+	mu      sync.Mutex
+	events  []*cdcpb.Event
+	base    uint64
+	next    uint64        // position of the next event added
+	evicted uint64        // highest journal_seq of the events overwritten
+	changed chan struct{} // closed when events are added
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{
+		events:  make([]*cdcpb.Event, size),
+		base:    uint64(time.Now().UnixNano()),
+		changed: make(chan struct{}),
+	}
+}
+
+// first returns the position of the oldest event in the buffer,
+// must be called with the lock held
+func (r *eventRing) first() uint64 {
+	size := uint64(len(r.events))
+	if r.next < size {
+		return 0
+	}
+	return r.next - size
+}
+
+func (r *eventRing) add(events []*cdcpb.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := uint64(len(r.events))
+	for _, event := range events {
+		i := r.next % size
+		if old := r.events[i]; old != nil && old.JournalSeq > r.evicted {
+			r.evicted = old.JournalSeq
+		}
+		r.next++
+		event.Cursor = r.base + r.next
+		r.events[i] = event
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// seek returns the position of the first event after the cursor
+func (r *eventRing) seek(cursor uint64) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cursor == 0 {
+		return r.first(), nil
+	}
+
+	// the cursor of an event is the position after it
+	if cursor < r.base+r.first() || cursor > r.base+r.next {
+		return 0, status.Error(codes.OutOfRange, ErrorCursorExpired)
+	}
+
+	return cursor - r.base, nil
+}
+
+// seekJournalSeq returns the position of the first event
+// with a journal_seq greater than journalSeq
+func (r *eventRing) seekJournalSeq(journalSeq uint64) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if journalSeq > 0 && journalSeq < r.evicted {
+		return 0, status.Error(codes.OutOfRange, ErrorCursorExpired)
+	}
+
+	size := uint64(len(r.events))
+	for pos := r.first(); pos < r.next; pos++ {
+		if r.events[pos%size].JournalSeq > journalSeq {
+			return pos, nil
+		}
+	}
+
+	return r.next, nil
+}
+
+// read returns the events from the position, the position after them
+// and the channel closed when more events are added
+func (r *eventRing) read(pos uint64) ([]*cdcpb.Event, uint64, <-chan struct{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pos < r.first() {
+		return nil, pos, nil, status.Error(codes.ResourceExhausted, ErrorSubscriberBehind)
+	}
+
+	size := uint64(len(r.events))
+	events := make([]*cdcpb.Event, 0, r.next-pos)
+	for ; pos < r.next; pos++ {
+		events = append(events, r.events[pos%size])
+	}
+
+	return events, pos, r.changed, nil
+}
@@ -0,0 +1,145 @@
+package gtmcdc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gtmcdc/cdcpb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func testGrpcClient(t *testing.T, addr string) (cdcpb.CdcClient, func()) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	return cdcpb.NewCdcClient(conn), func() { _ = conn.Close() }
+}
+
+func testGrpcReceive(t *testing.T, stream cdcpb.Cdc_SubscribeClient, n int) []*cdcpb.Event {
+	var events []*cdcpb.Event
+	for i := 0; i < n; i++ {
+		event, err := stream.Recv()
+		assert.Nil(t, err)
+		events = append(events, event)
+	}
+	return events
+}
+
+func Test_DoFilter_Grpc(t *testing.T) {
+	metrics := InitMetrics()
+	sink, err := NewGrpcSink(&Config{GrpcAddr: "127.0.0.1:0", GrpcBufferSize: 3}, metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	defer sinks.Close()
+
+	// 4 records with journal_seq 3, 3, 4 and the ZTP update without
+	// one, the oldest does not fit in the buffer
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	client, closeClient := testGrpcClient(t, sink.Addr())
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &cdcpb.SubscribeRequest{})
+	assert.Nil(t, err)
+	events := testGrpcReceive(t, stream, 3)
+	assert.Equal(t, uint64(3), events[0].JournalSeq)
+	assert.Equal(t, uint64(0), events[2].JournalSeq)
+	assert.Equal(t, events[0].Cursor+1, events[1].Cursor)
+
+	journalEvent := JournalEvent{}
+	assert.Nil(t, json.Unmarshal(events[2].Json, &journalEvent))
+	assert.Equal(t, "300.00", journalEvent.NodeValues[0])
+
+	// resume after the transaction
+	stream, err = client.Subscribe(ctx, &cdcpb.SubscribeRequest{FromCursor: events[0].Cursor})
+	assert.Nil(t, err)
+	resumed := testGrpcReceive(t, stream, 2)
+	assert.Equal(t, uint64(4), resumed[0].JournalSeq)
+
+	// records after the cursor are gone, and cursors of
+	// a previous run are not in the buffer either
+	for _, cursor := range []uint64{events[0].Cursor - 2, 5, events[2].Cursor + 1} {
+		stream, err = client.Subscribe(ctx, &cdcpb.SubscribeRequest{FromCursor: cursor})
+		assert.Nil(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+	}
+
+	// resume after the journal_seq, e.g. after a restart
+	stream, err = client.Subscribe(ctx, &cdcpb.SubscribeRequest{FromJournalSeq: 3})
+	assert.Nil(t, err)
+	resumed = testGrpcReceive(t, stream, 2)
+	assert.Equal(t, resumed[0].Cursor, events[1].Cursor)
+	assert.Equal(t, uint64(4), resumed[0].JournalSeq)
+
+	// the record with journal_seq 2 is no longer in the buffer
+	stream, err = client.Subscribe(ctx, &cdcpb.SubscribeRequest{FromJournalSeq: 2})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func Test_GrpcSink_Live(t *testing.T) {
+	sink, err := NewGrpcSink(&Config{GrpcAddr: "127.0.0.1:0", GrpcBufferSize: 10}, InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	client, closeClient := testGrpcClient(t, sink.Addr())
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &cdcpb.SubscribeRequest{Globals: []string{"^acn"}, Operands: []string{"kill"}})
+	assert.Nil(t, err)
+
+	go func() {
+		// wait for the subscription before publishing
+		for sink.metrics.GetCounterValue("grpc_subscriptions") == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, line := range []string{
+			`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`,
+			`04\65282,59700\29\0\0\29\0\0\0\0\^XYZ(1)`,
+			`04\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,51)`,
+		} {
+			_ = sink.Publish(&Unit{Records: parseAll(t, line), done: true})
+		}
+	}()
+
+	events := testGrpcReceive(t, stream, 1)
+	assert.Equal(t, "KILL", events[0].Operand)
+	assert.Equal(t, "ACN", events[0].Global)
+	assert.Equal(t, uint64(30), events[0].JournalSeq)
+}
+
+func Test_EventRing_Behind(t *testing.T) {
+	ring := newEventRing(2)
+	pos, err := ring.seek(0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), pos)
+
+	ring.add([]*cdcpb.Event{{JournalSeq: 1}, {JournalSeq: 2}, {JournalSeq: 3}})
+	_, _, _, err = ring.read(pos)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	events, next, _, err := ring.read(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, uint64(3), next)
+
+	_, err = NewGrpcSink(&Config{GrpcAddr: "off"}, nil)
+	assert.NotNil(t, err)
+}
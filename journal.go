@@ -3,7 +3,6 @@ package gtmcdc
 import (
 	"encoding/json"
 	"errors"
-	"regexp"
 	"strconv"
 	"strings"
 
@@ -40,7 +39,17 @@ type transaction struct {
 
 type expr struct {
 	nodeFlags string
+	node      *Node
 	value     string
+	record    *DictionaryRecord
+	before    *beforeImage
+
+	// the dictionary records of the descendants of the node of a KILL
+	descendants []*DictionaryRecord
+
+	// set by the ChangeDetector
+	piecesOnly bool
+	suppressed bool
 }
 
 // JournalRecord represent content of a GT.M journal log entry
@@ -72,6 +81,15 @@ type JournalEvent struct {
 	Subscripts      []string `json:"subscripts,omitempty"`
 	NodeValues      []string `json:"node_values,omitempty"`
 	TimeStamp       int64    `json:"time_stamp,omitempty"`
+
+	// from the dictionary
+	Record string                 `json:"record,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	// from the state store
+	PreviousValues []string       `json:"previous_values,omitempty"`
+	Changes        []*PieceChange `json:"changes,omitempty"`
+	Deleted        []*DeletedNode `json:"deleted,omitempty"`
 }
 
 func atoi(s string) int {
@@ -131,6 +149,11 @@ func OpCode(numeric string) string {
 // ZTWORM  = "11"\time\tnum\pid\clntpid\token_seq\strm_num\strm_seq\updnum\ztwormhole
 // ZTRIG   = "12"\time\tnum\pid\clntpid\token_seq\strm_num\strm_seq\updnum\nodeflags\node
 // LGTRIG  = "13"\time\tnum\pid\clntpid\token_seq\strm_num\strm_seq\updnum\trigdefinition
+//
+// In a replicated region the token_seq of an update, TSTART and TCOM is the
+// journal sequence number, all records of a TP transaction share the one of
+// the transaction. NULL and EOF have it in jsnum. The token of ZTSTART and
+// ZTCOM is not a journal sequence number.
 func Parse(raw string) (*JournalRecord, error) {
 	// log with fields
 	logf := log.WithFields(log.Fields{"journal": raw})
@@ -168,30 +191,71 @@ func Parse(raw string) (*JournalRecord, error) {
 		// ignore an empty line
 
 	case "SET", "KILL", "ZKILL", "ZTRIG":
+		if len(s) < 11 {
+			return nil, errors.New(ErrorInvalidRecord)
+		}
+
 		rec.tran.tokenSeq, rec.tran.updateNum = atoi(s[5]), atoi(s[8])
 		rec.repl.streamNum, rec.repl.streamSeq = atoi(s[6]), atoi(s[7])
+		rec.repl.journalSeq = rec.tran.tokenSeq
+		rec.detail.nodeFlags = s[9]
 
-		s2 := strings.Split(s[len(s)-1], "=")
-		rec.detail.nodeFlags = s2[0]
-		if len(s2) > 1 {
-			val := s2[1]
-			// remove leading and end double quote characters
-			if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
-				val = val[1 : len(val)-1]
-			}
-			rec.detail.value = val
+		// the node value may contain \ so the rest of the line is rejoined
+		node, value, _, err := parseNode(strings.Join(s[10:], "\\"))
+		if err != nil {
+			logf.Infof("unable to parse node. %+v", err)
+			return nil, errors.New(ErrorInvalidRecord)
 		}
+		rec.detail.node = node
+		rec.detail.value = value
 
 	case "TSTART", "TCOM":
+		if len(s) < 8 || (rec.opcode == "TCOM" && len(s) < 10) {
+			return nil, errors.New(ErrorInvalidRecord)
+		}
+
 		rec.tran.tokenSeq = atoi(s[5])
 		rec.repl.streamNum, rec.repl.streamSeq = atoi(s[6]), atoi(s[7])
+		rec.repl.journalSeq = rec.tran.tokenSeq
 		if rec.opcode == "TCOM" {
 			// must be TCOM
 			rec.tran.partners = s[8]
 			rec.tran.tag = s[9]
 		}
 
-	case "NULL", "EOF", "LGTRIG", "PINI", "PFIN":
+	case "ZTSTART", "ZTCOM":
+		if len(s) < 6 || (rec.opcode == "ZTCOM" && len(s) < 7) {
+			return nil, errors.New(ErrorInvalidRecord)
+		}
+
+		// the token takes the place of token_seq so that the updates
+		// within a ZTSTART/ZTCOM transaction can be matched to it
+		rec.tran.token = s[5]
+		rec.tran.tokenSeq = atoi(s[5])
+		if rec.opcode == "ZTCOM" {
+			rec.tran.partners = s[6]
+		}
+
+	case "ZTWORM", "LGTRIG":
+		if len(s) < 9 {
+			return nil, errors.New(ErrorInvalidRecord)
+		}
+
+		rec.tran.tokenSeq, rec.tran.updateNum = atoi(s[5]), atoi(s[8])
+		rec.repl.streamNum, rec.repl.streamSeq = atoi(s[6]), atoi(s[7])
+		rec.repl.journalSeq = rec.tran.tokenSeq
+
+	case "NULL", "EOF":
+		if len(s) < 6 || (rec.opcode == "NULL" && len(s) < 8) {
+			return nil, errors.New(ErrorInvalidRecord)
+		}
+
+		rec.repl.journalSeq = atoi(s[5])
+		if rec.opcode == "NULL" {
+			rec.repl.streamNum, rec.repl.streamSeq = atoi(s[6]), atoi(s[7])
+		}
+
+	case "PINI", "PFIN":
 		logf.Debugf("journal entry ignored. %s", rec.opcode)
 
 	default:
@@ -201,22 +265,9 @@ func Parse(raw string) (*JournalRecord, error) {
 	return &rec, nil
 }
 
-// JSON representation of a journal log entry
-func (rec *JournalRecord) JSON() (string, error) {
-	var r []string
-	var err error
-	switch rec.opcode {
-	case "SET", "KILL", "ZKILL", "ZTRIG":
-		r, err = parseNodeFlags(rec.detail.nodeFlags)
-		if err != nil {
-			return "", errors.New("unable to parse")
-		}
-	default:
-		// for other type of operands the node flags are all empty
-		r = []string{"", "", ""}
-	}
-
-	event := JournalEvent{
+// Event returns the JournalEvent that is associated to the journal log entry
+func (rec *JournalRecord) Event() *JournalEvent {
+	event := &JournalEvent{
 		Operand:        rec.opcode,
 		TransactionNum: rec.tran.num,
 		Token:          rec.tran.token,
@@ -225,14 +276,48 @@ func (rec *JournalRecord) JSON() (string, error) {
 		StreamNum:      rec.repl.streamNum,
 		StreamSeq:      rec.repl.streamSeq,
 		JournalSeq:     rec.repl.journalSeq,
-		Global:         r[0],
-		Key:            r[1],
-		Subscripts:     r[2:],
 		NodeValues:     strings.Split(rec.detail.value, "|"),
 		TimeStamp:      rec.header.timestamp,
 	}
 
-	bytes, err := json.Marshal(&event)
+	// for other type of operands the node is empty
+	if node := rec.detail.node; node != nil {
+		subscripts := node.SubscriptValues()
+		event.Global = strings.ToUpper(node.Global)
+		event.Key = node.Key()
+		if len(subscripts) > 1 {
+			event.Subscripts = subscripts[1:]
+		}
+	}
+
+	if record := rec.detail.record; record != nil {
+		event.Record = record.Name
+		if rec.opcode == "SET" {
+			event.Fields = record.Values(rec.detail.node, rec.detail.value)
+		}
+	}
+
+	if before := rec.detail.before; before != nil {
+		if before.exists {
+			event.PreviousValues = strings.Split(before.value, "|")
+		}
+		if rec.opcode == "SET" {
+			event.Changes = pieceChanges(before.value, rec.detail.value)
+		}
+		event.Deleted = before.deleted
+	}
+
+	// only the changed pieces are published
+	if rec.detail.piecesOnly {
+		event.NodeValues, event.PreviousValues = nil, nil
+	}
+
+	return event
+}
+
+// JSON representation of a journal log entry
+func (rec *JournalRecord) JSON() (string, error) {
+	bytes, err := json.Marshal(rec.Event())
 	if err != nil {
 		return "", errors.New("unable to parse")
 	}
@@ -287,27 +372,3 @@ func Horolog2Timestamp(horolog string) (int64, error) {
 
 	return int64(seconds), nil
 }
-
-func parseNodeFlags(node string) ([]string, error) {
-	var nodeRegex *regexp.Regexp
-	func() {
-		if nodeRegex == nil {
-			nodeRegex = regexp.MustCompile(`\^(?P<global>.*?)\((?P<index>.+)\)`)
-		}
-	}()
-
-	m := nodeRegex.FindStringSubmatch(node)
-	if m == nil || len(m) < 2 {
-		return nil, errors.New("invalid node")
-	}
-
-	subscripts := strings.Split(m[2], ",")
-	if subscripts == nil || len(m) < 1 {
-		return nil, errors.New("invalid node")
-	}
-
-	ret := []string{strings.ToUpper(m[1]), subscripts[0]}
-	ret = append(ret, subscripts[1:]...)
-
-	return ret, nil
-}
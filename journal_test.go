@@ -61,10 +61,32 @@ func Test_Parse_JournalRecord_2(t *testing.T) {
 	assert.Equal(t, "1", rec.tran.partners)
 }
 
+func Test_Parse_JournalSeq(t *testing.T) {
+	rec, _ := Parse(`09\65287,58606\8\0\0\8\2\5\1\`)
+	assert.Equal(t, repl{streamNum: 2, streamSeq: 5, journalSeq: 8}, rec.repl)
+
+	rec, _ = Parse(`00\65287,58606\9\0\0\12\1\4\0`)
+	assert.Equal(t, "NULL", rec.opcode)
+	assert.Equal(t, repl{streamNum: 1, streamSeq: 4, journalSeq: 12}, rec.repl)
+
+	rec, _ = Parse(`03\65287,58606\9\0\0\13`)
+	assert.Equal(t, 13, rec.repl.journalSeq)
+
+	rec, _ = Parse(`11\65287,58606\9\0\0\14\0\0\1\hole`)
+	assert.Equal(t, 14, rec.repl.journalSeq)
+
+	// the token of ZTP is not a journal sequence number
+	rec, _ = Parse(`07\65287,62156\5\0\0\9001\1`)
+	assert.Equal(t, 0, rec.repl.journalSeq)
+
+	_, err := Parse(`03\65287,58606\9\0\0`)
+	assert.NotNil(t, err)
+}
+
 func Test_JournalRecord_Json(t *testing.T) {
 	expected := `{"operand":"SET","transaction_num":"28",` +
 		`"token_seq":28,"update_num":0,"stream_num":0,"stream_seq":0,` +
-		`"journal_seq":0,"global":"ACN","key":"1234","subscripts":["51"],` +
+		`"journal_seq":28,"global":"ACN","key":"1234","subscripts":["51"],` +
 		`"node_values":["300.00","61212","1","","","",""],` +
 		`"time_stamp":1569515700}`
 
@@ -77,6 +99,19 @@ func Test_JournalRecord_Json(t *testing.T) {
 	assert.Equal(t, expected, jayson)
 }
 
+func Test_JournalRecord_Json_Strings(t *testing.T) {
+	rec, err := Parse(`05\65282,59700\28\0\0\28\0\0\0\0\^acc("A,B",51)="a\b=c|d"`)
+	assert.Nil(t, err)
+	assert.Equal(t, `a\b=c|d`, rec.detail.value)
+
+	jayson, err := rec.JSON()
+	assert.Nil(t, err)
+	assert.Contains(t, jayson, `"global":"ACC","key":"A,B","subscripts":["51"],"node_values":["a\\b=c","d"]`)
+
+	_, err = Parse(`05\65282,59700\28\0\0\28\0\0\0\0\^acc("A,B"="1"`)
+	assert.NotNil(t, err)
+}
+
 func Test_atli(t *testing.T) {
 	i := atoi("100")
 	assert.Equal(t, 100, i)
@@ -85,34 +120,98 @@ func Test_atli(t *testing.T) {
 	assert.Equal(t, 0, i)
 }
 
-func Test_parseNodeFlags(t *testing.T) {
-	r, err := parseNodeFlags("^ACN(5877000047,51)")
+func Test_parseNode(t *testing.T) {
+	n, _, hasValue, err := parseNode("^ACN(5877000047,51)")
+	assert.Nil(t, err)
+	assert.False(t, hasValue)
+	assert.Equal(t, "ACN", n.Global)
+	assert.Equal(t, []Subscript{{"5877000047", true}, {"51", true}}, n.Subscripts)
+
+	n, _, _, err = parseNode("^ACN(5877000047)")
+	assert.Nil(t, err)
+	assert.Equal(t, "5877000047", n.Key())
+	assert.Equal(t, 1, len(n.Subscripts))
+
+	n, _, _, err = parseNode("^acn(5877000047,51,1245)")
+	assert.Nil(t, err)
+	assert.Equal(t, "acn", n.Global)
+	assert.Equal(t, []string{"5877000047", "51", "1245"}, n.SubscriptValues())
+
+	n, _, _, err = parseNode("^ACN")
+	assert.Nil(t, err)
+	assert.Equal(t, "", n.Key())
+
+	_, _, _, err = parseNode("^ACN()")
+	assert.NotNil(t, err)
+
+	_, _, _, err = parseNode("^ACN(1")
+	assert.NotNil(t, err)
+
+	_, _, _, err = parseNode("garbage")
+	assert.NotNil(t, err)
+
+	_, _, _, err = parseNode("")
+	assert.NotNil(t, err)
+}
+
+func Test_Node_String(t *testing.T) {
+	for _, ref := range []string{
+		"^ACN",
+		"^ACN(5877000047,51)",
+		`^ACN("A,B",-1.5,"say ""hi""","01")`,
+	} {
+		n, _, _, err := parseNode(ref)
+		assert.Nil(t, err)
+		assert.Equal(t, ref, n.String())
+	}
+}
+
+func Test_parseNode_Strings(t *testing.T) {
+	n, value, hasValue, err := parseNode(`^ACN("A,B",51)="x=1"`)
 	assert.Nil(t, err)
-	assert.Equal(t, 3, len(r))
-	assert.Equal(t, "ACN", r[0])
-	assert.Equal(t, "5877000047", r[1])
-	assert.Equal(t, "51", r[2])
+	assert.True(t, hasValue)
+	assert.Equal(t, []Subscript{{"A,B", false}, {"51", true}}, n.Subscripts)
+	assert.Equal(t, "x=1", value)
 
-	r, err = parseNodeFlags("^ACN(5877000047)")
+	n, value, _, err = parseNode(`^X("a(b)","say ""hi""")="abc"_$C(10,9)_"def"`)
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(r))
-	assert.Equal(t, "ACN", r[0])
-	assert.Equal(t, "5877000047", r[1])
+	assert.Equal(t, []string{"a(b)", `say "hi"`}, n.SubscriptValues())
+	assert.Equal(t, "abc\n\tdef", value)
 
-	r, err = parseNodeFlags("^acn(5877000047,51,1245)")
+	n, value, _, err = parseNode(`^X($C(0)_"k",-0.50,"07")=$ZCH(200)`)
 	assert.Nil(t, err)
-	assert.Equal(t, 4, len(r))
-	assert.Equal(t, "ACN", r[0])
-	assert.Equal(t, "5877000047", r[1])
-	assert.Equal(t, "51", r[2])
-	assert.Equal(t, "1245", r[3])
+	assert.Equal(t, []Subscript{{"\x00k", false}, {"-.5", true}, {"07", false}}, n.Subscripts)
+	assert.Equal(t, "\xc8", value)
 
-	_, err = parseNodeFlags("^ACN()")
+	_, value, _, err = parseNode(`^X(1)=0012.10`)
+	assert.Nil(t, err)
+	assert.Equal(t, "12.1", value)
+
+	_, _, _, err = parseNode(`^X(1)="unterminated`)
 	assert.NotNil(t, err)
 
-	_, err = parseNodeFlags("garbage")
+	_, _, _, err = parseNode(`^X(1)=$ZF(1)`)
 	assert.NotNil(t, err)
 
-	_, err = parseNodeFlags("")
+	_, _, _, err = parseNode(`^X(1)="a"junk`)
+	assert.NotNil(t, err)
+}
+
+func Test_canonicNumber(t *testing.T) {
+	for input, expected := range map[string]string{
+		"51":    "51",
+		"007":   "7",
+		"-0":    "0",
+		"0.50":  ".5",
+		"-0.25": "-.25",
+		"1E3":   "1000",
+		"12.00": "12",
+	} {
+		s, err := canonicNumber(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, s, input)
+	}
+
+	_, err := canonicNumber("-")
 	assert.NotNil(t, err)
 }
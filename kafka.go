@@ -0,0 +1,268 @@
+package gtmcdc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkKafka is the name of the Kafka sink in GTMCDC_SINKS
+const SinkKafka = "kafka"
+
+// KafkaSink publishes units to Kafka with the Producer
+//
+// When Spool is not nil, messages that cannot be published are written
+// to the spool instead of being lost. KeyStrategy computes the key of
+// messages. Tombstones decides if tombstones are published for KILL and ZKILL.
+// Encoder encodes units, they are published as JSON when it is nil.
+type KafkaSink struct {
+	Producer    *Producer
+	Spool       *Spool
+	KeyStrategy *KeyStrategy
+	Tombstones  *TombstonePolicy
+	Encoder     Encoder
+	Metrics     *Metrics
+
+	// mu guards the state of the async mode. Once a message fails, no
+	// message is sent to the producer until the messages in flight are
+	// acknowledged and the spool is drained, so that the order is kept
+	mu       sync.Mutex
+	results  <-chan *PublishResult
+	inFlight int
+	blocked  bool
+}
+
+// Name returns the name of the sink
+func (k *KafkaSink) Name() string {
+	return SinkKafka
+}
+
+// Publish the messages of a unit in order. The unit is published when all
+// messages are either published or spooled
+func (k *KafkaSink) Publish(unit *Unit) error {
+	messages, err := k.messages(unit)
+	if err != nil {
+		log.Infof("cannot encode unit due to %+v", err)
+		return err
+	}
+
+	if k.Spool != nil {
+		spooled, err := k.Spool.Publish(k.Producer, messages...)
+		switch {
+		case err != nil:
+			log.Errorf("Unable to publish or spool message for journal record. %+v", err)
+			k.countMessages("lines_parsed_but_not_published", messages)
+			return err
+		case spooled:
+			k.countMessages("lines_parsed_and_spooled", messages)
+		default:
+			k.countMessages("lines_parsed_and_published", messages)
+		}
+		return nil
+	}
+
+	start := time.Now()
+
+	err = k.Producer.PublishMessages(messages)
+	if err != nil {
+		log.Warnf("Unable to publish message for journal record. %+v", err)
+		k.countMessages("lines_parsed_but_not_published", messages)
+		return err
+	}
+
+	k.countMessages("lines_parsed_and_published", messages)
+	elapsed := time.Since(start)
+	k.Metrics.HistoObserve("message_publish_to_kafka", float64(elapsed/time.Microsecond))
+
+	return nil
+}
+
+// PublishAsync sends the messages of a unit with the async producer.
+// Messages that fail are written to the spool if there is one.
+func (k *KafkaSink) PublishAsync(unit *Unit, track func(), ack func(err error)) {
+	k.collectResults()
+
+	messages, err := k.messages(unit)
+	if err != nil {
+		log.Infof("cannot encode unit due to %+v", err)
+		track()
+		ack(err)
+		return
+	}
+
+	for _, message := range messages {
+		track()
+
+		// keep the order with messages that are in the spool already
+		if !k.send() {
+			ack(k.spoolMessage(message))
+			continue
+		}
+
+		if err := k.Producer.PublishAsync(message, ack); err != nil {
+			k.handleResult(&PublishResult{Message: message, Metadata: ack, Err: err})
+		}
+	}
+}
+
+// send returns true if a message can be sent to the producer, false if
+// it must be spooled after the messages that failed or are in the spool
+func (k *KafkaSink) send() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.Spool != nil {
+		if k.blocked && k.inFlight == 0 && k.Spool.Depth() == 0 {
+			k.blocked = false
+		}
+		if k.blocked || k.Spool.Depth() > 0 {
+			return false
+		}
+	}
+
+	k.inFlight++
+	return true
+}
+
+// collectResults handles the acknowledgements from the async producer
+// until the producer is closed. The producer has a new results channel
+// when it is connected again, e.g. by the spool drainer
+func (k *KafkaSink) collectResults() {
+	results := k.Producer.Results()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if results == nil || results == k.results {
+		return
+	}
+	k.results = results
+
+	go func() {
+		for res := range results {
+			k.handleResult(res)
+		}
+	}()
+}
+
+func (k *KafkaSink) handleResult(res *PublishResult) {
+	ack := res.Metadata.(func(err error))
+
+	var err error
+	if res.Err != nil {
+		k.mu.Lock()
+		k.blocked = true
+		k.mu.Unlock()
+
+		log.Warnf("Unable to publish message for journal record. %+v", res.Err)
+		err = k.spoolMessage(res.Message)
+	} else {
+		k.Metrics.IncrCounter("lines_parsed_and_published")
+	}
+
+	// the message is in flight until it is in the spool
+	k.mu.Lock()
+	k.inFlight--
+	k.mu.Unlock()
+
+	ack(err)
+}
+
+// spoolMessage writes a message that cannot be published to the spool
+func (k *KafkaSink) spoolMessage(message *Message) error {
+	if k.Spool == nil {
+		k.Metrics.IncrCounter("lines_parsed_but_not_published")
+		return errors.New(ErrorSinkUnavailable)
+	}
+
+	if err := k.Spool.Write(message); err != nil {
+		log.Errorf("Unable to spool message for journal record. %+v", err)
+		k.Metrics.IncrCounter("lines_parsed_but_not_published")
+		return err
+	}
+
+	k.Metrics.IncrCounter("lines_parsed_and_spooled")
+	return nil
+}
+
+func (k *KafkaSink) countMessages(name string, messages []*Message) {
+	for range messages {
+		k.Metrics.IncrCounter(name)
+	}
+}
+
+// messages returns the messages to be published for a unit, i.e. the
+// encoded event, or an event per record for a RecordEncoder, followed by
+// tombstones for KILL and ZKILL if enabled
+func (k *KafkaSink) messages(unit *Unit) ([]*Message, error) {
+	var messages []*Message
+
+	if !k.Tombstones.ReplacesEvent(unit, k.KeyStrategy) {
+		encoder := k.Encoder
+		if encoder == nil {
+			encoder = jsonEncoder{}
+		}
+
+		if records, ok := encoder.(RecordEncoder); ok {
+			msgs, err := records.EncodeRecords(unit)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, recMsgs := range msgs {
+				for _, msg := range recMsgs {
+					msg.Key, err = k.KeyStrategy.Key(unit.Records[i].Event())
+					if err != nil {
+						return nil, err
+					}
+					messages = append(messages, msg)
+				}
+			}
+		} else {
+			msg, err := encoder.Encode(unit)
+			if err != nil {
+				return nil, err
+			}
+
+			msg.Key, err = k.KeyStrategy.UnitKey(unit)
+			if err != nil {
+				return nil, err
+			}
+
+			messages = append(messages, msg)
+		}
+	}
+
+	tombstones, err := k.Tombstones.Tombstones(unit, k.KeyStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(messages, tombstones...), nil
+}
+
+// Flush does nothing because messages are acknowledged
+// before the unit is considered published
+func (k *KafkaSink) Flush() error {
+	return nil
+}
+
+// Close the spool and then the producer used to drain it
+func (k *KafkaSink) Close() error {
+	k.Spool.Close()
+	k.Producer.CleanupProducer()
+
+	return nil
+}
+
+// Healthy returns true if messages can be published or spooled
+func (k *KafkaSink) Healthy() bool {
+	return k.Spool != nil || k.Producer.IsKafkaAvailable()
+}
+
+// IsAsync returns true if the producer is in async mode
+func (k *KafkaSink) IsAsync() bool {
+	return k.Producer.IsAsync()
+}
@@ -0,0 +1,122 @@
+package gtmcdc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+)
+
+// Key strategies
+const (
+	KeyNone             = "none"
+	KeyGlobalKey        = "global+key"
+	KeyGlobalSubscripts = "global+subscripts"
+)
+
+const keySeparator = ":"
+
+// KeyStrategy computes the Kafka message key from a JournalEvent so that
+// all messages for the same node go to the same partition, which keeps
+// updates of a node in order and allows the topic to use log compaction.
+// The strategy is one of
+//
+//	none              no key
+//	global+key        global and the first subscript, e.g. ACN:1234
+//	global+subscripts global and all subscripts, e.g. ACN:1234:51
+//
+// or a text/template on JournalEvent, e.g. {{.Global}}-{{.Key}}.
+// Subscripts that are not canonical numbers are quoted as in ZWRITE,
+// e.g. ^ACN("1:2") is ACN:"1:2" so that it is not the same key as
+// ^ACN(1,2)
+type KeyStrategy struct {
+	strategy string
+	tmpl     *NameTemplate
+}
+
+// NewKeyStrategy returns the KeyStrategy for the given specification
+func NewKeyStrategy(spec string) (*KeyStrategy, error) {
+	switch spec {
+	case "", KeyNone:
+		return &KeyStrategy{strategy: KeyNone}, nil
+	case KeyGlobalKey, KeyGlobalSubscripts:
+		return &KeyStrategy{strategy: spec}, nil
+	}
+
+	if !strings.Contains(spec, "{{") {
+		return nil, errors.New("invalid key strategy " + spec)
+	}
+
+	tmpl, err := NewNameTemplate("key", spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyStrategy{strategy: "template", tmpl: tmpl}, nil
+}
+
+// Key returns the message key for a JournalEvent.
+// Empty string is returned for events without a global node
+func (k *KeyStrategy) Key(event *JournalEvent) (string, error) {
+	if k == nil || event == nil || event.Global == "" {
+		return "", nil
+	}
+
+	// the global node without subscripts
+	if event.Key == "" && k.strategy != "template" {
+		return event.Global, nil
+	}
+
+	switch k.strategy {
+	case KeyGlobalKey:
+		return event.Global + keySeparator + subscriptString(event.Key), nil
+
+	case KeyGlobalSubscripts:
+		parts := []string{event.Global, subscriptString(event.Key)}
+		for _, sub := range event.Subscripts {
+			parts = append(parts, subscriptString(sub))
+		}
+		return strings.Join(parts, keySeparator), nil
+
+	case "template":
+		return k.tmpl.Execute(event)
+	}
+
+	return "", nil
+}
+
+// UnitKey returns the message key of a unit. The key of a transaction is
+// the key of its first update so that a transaction that updates a single
+// node keeps the order with other updates of the same node.
+func (k *KeyStrategy) UnitKey(unit *Unit) (string, error) {
+	if len(unit.Records) == 0 {
+		return "", nil
+	}
+	return k.Key(unit.Records[0].Event())
+}
+
+// NameTemplate renders names such as keys, streams and topics from
+// a JournalEvent with text/template, e.g. gtmcdc:{{.Global}}
+type NameTemplate struct {
+	tmpl *template.Template
+}
+
+// NewNameTemplate parses the template, referring to
+// a field not in JournalEvent is an error
+func NewNameTemplate(name, spec string) (*NameTemplate, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NameTemplate{tmpl: tmpl}, nil
+}
+
+// Execute returns the name for the event
+func (t *NameTemplate) Execute(event *JournalEvent) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,82 @@
+package gtmcdc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KeyStrategy(t *testing.T) {
+	rec, err := Parse(`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51,"A")="300.00"`)
+	assert.Nil(t, err)
+	event := rec.Event()
+
+	for spec, expected := range map[string]string{
+		"none":                       "",
+		"global+key":                 "ACN:1234",
+		"global+subscripts":          `ACN:1234:51:"A"`,
+		"{{.Global}}-{{.Key}}":       "ACN-1234",
+		"{{index .Subscripts 0}}":    "51",
+		"{{.Operand}}/{{.TokenSeq}}": "SET/28",
+	} {
+		keys, err := NewKeyStrategy(spec)
+		assert.Nil(t, err)
+
+		key, err := keys.Key(event)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, key, spec)
+	}
+
+	// a subscript with the separator is not the same key as two subscripts
+	keys, err := NewKeyStrategy("global+subscripts")
+	assert.Nil(t, err)
+	recs := parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN("1:2")="1"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,2)="1"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN("say ""hi""")="1"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN="1"`,
+	)
+	for i, expected := range []string{`ACN:"1:2"`, `ACN:1:2`, `ACN:"say ""hi"""`, `ACN`} {
+		key, err := keys.Key(recs[i].Event())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, key)
+	}
+
+	_, err = NewKeyStrategy("global+everything")
+	assert.NotNil(t, err)
+
+	_, err = NewKeyStrategy("{{.Global")
+	assert.NotNil(t, err)
+
+	keys, err = NewKeyStrategy("{{.NoSuchField}}")
+	assert.Nil(t, err)
+	_, err = keys.Key(event)
+	assert.NotNil(t, err)
+}
+
+func Test_KeyStrategy_Unit(t *testing.T) {
+	keys, err := NewKeyStrategy("global+key")
+	assert.Nil(t, err)
+
+	recs := parseAll(t,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"`,
+		`05\65287,62154\3\0\0\3\0\0\2\0\^CIF(99,1)="x"`,
+		`09\65287,58606\8\0\0\8\0\0\1\`,
+	)
+
+	// the key of a transaction is the key of the first update
+	key, err := keys.UnitKey(&Unit{Records: recs[:2], commit: recs[2], done: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "ACN:1234", key)
+
+	// records without a node have no key
+	key, err = keys.UnitKey(&Unit{Records: recs[2:], done: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+
+	// nil strategy is the same as none
+	var none *KeyStrategy
+	key, err = none.UnitKey(&Unit{Records: recs[:1], done: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+}
@@ -2,60 +2,114 @@ package gtmcdc
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
 )
 
 type Metrics struct {
+	mu         sync.Mutex
 	counters   map[string]prometheus.Counter
 	histograms map[string]prometheus.Histogram
+	gauges     map[string]prometheus.Gauge
 }
 
 // GetCounterValue returns the value of a counter
 // A new counter will be created if it does not exist already
 func (m *Metrics) GetCounterValue(name string) float64 {
-	counter, exists := m.counters[name]
-	if !exists {
-		return 0
-	}
-
 	pb := &dto.Metric{}
-	_ = counter.Write(pb)
+	_ = m.counter(name).Write(pb)
 	return pb.GetCounter().GetValue()
 }
 
 // IncrCounter increment a counter
 // A new counter will be created if it does not exist already
 func (m *Metrics) IncrCounter(name string) {
+	m.counter(name).Inc()
+}
+
+func (m *Metrics) counter(name string) prometheus.Counter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	counter, exists := m.counters[name]
 	if !exists {
-		counter = promauto.NewCounter(prometheus.CounterOpts{
+		counter = registerCollector(prometheus.NewCounter(prometheus.CounterOpts{
 			Name: name,
-		})
+		})).(prometheus.Counter)
 		m.counters[name] = counter
 	}
 
-	counter.Inc()
+	return counter
 }
 
 // HistoObserve records an obseration for a histogram
 // A new histogram will be created if it does not exist already
 func (m *Metrics) HistoObserve(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	histo, exists := m.histograms[name]
 	if !exists {
-		histo = promauto.NewHistogram(prometheus.HistogramOpts{
+		histo = registerCollector(prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: name,
 			// used to store microseconds
 			Buckets: []float64{100, 250, 500, 1_000, 2_500, 5_000, 10_000, 25_000, 50_000, 100_000, 2_500_000},
-		})
+		})).(prometheus.Histogram)
 		m.histograms[name] = histo
 	}
 	histo.Observe(value)
 }
 
+// SetGauge sets the value of a gauge
+// A new gauge will be created if it does not exist already
+func (m *Metrics) SetGauge(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gauge, exists := m.gauges[name]
+	if !exists {
+		gauge = registerCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: name,
+		})).(prometheus.Gauge)
+		m.gauges[name] = gauge
+	}
+	gauge.Set(value)
+}
+
+// GetGaugeValue returns the current value of a gauge, 0 if it does not exist
+func (m *Metrics) GetGaugeValue(name string) float64 {
+	m.mu.Lock()
+	gauge, exists := m.gauges[name]
+	m.mu.Unlock()
+
+	if !exists {
+		return 0
+	}
+
+	pb := &dto.Metric{}
+	_ = gauge.Write(pb)
+	return pb.GetGauge().GetValue()
+}
+
+// registerCollector registers a collector with the default registry.
+// The collector registered earlier is returned when one with the same name
+// exists already, e.g. when metrics are initialized more than once. A
+// collector that cannot be registered, e.g. a gauge with the name of a
+// counter, is still usable but not exported
+func registerCollector(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		log.Warnf("Unable to register metric. %+v", err)
+	}
+	return c
+}
+
 // InitPromHTTP starts the Http Listener that export the Prometheus metrics
 // that can be scraped by Prometheus
 func InitPromHTTP(addr string) error {
@@ -73,5 +127,6 @@ func InitMetrics() *Metrics {
 	return &Metrics{
 		counters:   map[string]prometheus.Counter{},
 		histograms: map[string]prometheus.Histogram{},
+		gauges:     map[string]prometheus.Gauge{},
 	}
 }
@@ -0,0 +1,439 @@
+package gtmcdc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkMqtt is the name of the MQTT sink in GTMCDC_SINKS
+const SinkMqtt = "mqtt"
+
+// MQTT protocol versions
+const (
+	MqttV311 = "3.1.1"
+	MqttV5   = "5"
+)
+
+// characters not allowed in the topic of a PUBLISH
+var mqttTopicReplacer = strings.NewReplacer("+", "_", "#", "_", "\x00", "_")
+
+// mqttClient publishes to a broker with one of the protocol versions
+type mqttClient interface {
+	publish(topic string, payload []byte, qos byte, retained bool) error
+	connected() bool
+	close()
+}
+
+// MqttSink publishes the JSON of every journal record with a global to a
+// topic rendered from the JournalEvent, e.g. gtmcdc/{{.Global}}/{{.Key}}.
+// The QoS is 1 or 2 so that a record is published once the broker acknowledged it.
+// When retained is true, the messages are retained by the broker so that
+// a new subscriber gets the latest value of every node, and KILL and ZKILL
+// are published with an empty payload which removes the retained message.
+// The characters + and # in the topic are replaced by _
+type MqttSink struct {
+	client   mqttClient
+	topic    *NameTemplate
+	qos      byte
+	retained bool
+	metrics  *Metrics
+}
+
+// NewMqttSink connects to the MQTT broker in the configuration
+func NewMqttSink(conf *Config, metrics *Metrics) (*MqttSink, error) {
+	if conf.MqttBroker == "" || conf.MqttBroker == "off" {
+		return nil, errors.New("invalid mqtt broker")
+	}
+	if conf.MqttQoS < 1 || conf.MqttQoS > 2 {
+		// messages published with QoS 0 are not acknowledged
+		return nil, fmt.Errorf("invalid mqtt qos %d, must be 1 or 2", conf.MqttQoS)
+	}
+
+	topic, err := NewNameTemplate("topic", conf.MqttTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	var client mqttClient
+	switch conf.MqttVersion {
+	case MqttV311:
+		client, err = newMqttV311Client(conf)
+	case MqttV5:
+		client, err = newMqttV5Client(conf)
+	default:
+		err = errors.New("unsupported mqtt version " + conf.MqttVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &MqttSink{
+		client:   client,
+		topic:    topic,
+		qos:      byte(conf.MqttQoS),
+		retained: conf.MqttRetained,
+		metrics:  metrics,
+	}, nil
+}
+
+// Name returns the name of the sink
+func (m *MqttSink) Name() string {
+	return SinkMqtt
+}
+
+// Publish the records of the unit in order
+func (m *MqttSink) Publish(unit *Unit) error {
+	for _, rec := range unit.Records {
+		event := rec.Event()
+		if event.Global == "" {
+			// nothing changed in the database
+			log.Debugf("%s without global not published to mqtt", rec.opcode)
+			continue
+		}
+
+		topic, err := m.topic.Execute(event)
+		if err != nil {
+			return err
+		}
+
+		var payload []byte
+		if !m.retained || !isKill(rec) {
+			jsonstr, err := rec.JSON()
+			if err != nil {
+				return err
+			}
+			payload = []byte(jsonstr)
+		}
+
+		start := time.Now()
+		if err = m.client.publish(mqttTopicReplacer.Replace(topic), payload, m.qos, m.retained); err != nil {
+			log.Warnf("Unable to publish record to mqtt. %+v", err)
+			m.metrics.IncrCounter("mqtt_records_not_published")
+			return err
+		}
+
+		m.metrics.IncrCounter("mqtt_records_published")
+		elapsed := time.Since(start)
+		m.metrics.HistoObserve("message_publish_to_mqtt", float64(elapsed/time.Microsecond))
+	}
+
+	return nil
+}
+
+// Flush does nothing because records are acknowledged before Publish returns
+func (m *MqttSink) Flush() error {
+	return nil
+}
+
+// Close disconnects from the broker
+func (m *MqttSink) Close() error {
+	m.client.close()
+	return nil
+}
+
+// Healthy returns true while connected to the broker
+func (m *MqttSink) Healthy() bool {
+	return m.client.connected()
+}
+
+// mqttV311Client uses the paho client, which reconnects automatically
+type mqttV311Client struct {
+	client  mqtt.Client
+	timeout time.Duration
+}
+
+func newMqttV311Client(conf *Config) (*mqttV311Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(conf.MqttBroker).
+		SetClientID(conf.MqttClientID).
+		SetUsername(conf.MqttUser).
+		SetPassword(conf.MqttPassword).
+		SetConnectTimeout(conf.MqttTimeout).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnf("disconnected from mqtt broker. %+v", err)
+		})
+
+	c := &mqttV311Client{client: mqtt.NewClient(opts), timeout: conf.MqttTimeout}
+	if err := c.wait(c.client.Connect()); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *mqttV311Client) publish(topic string, payload []byte, qos byte, retained bool) error {
+	return c.wait(c.client.Publish(topic, qos, retained, payload))
+}
+
+func (c *mqttV311Client) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(c.timeout) {
+		return errors.New("mqtt timed out")
+	}
+	return token.Error()
+}
+
+func (c *mqttV311Client) connected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqttV311Client) close() {
+	c.client.Disconnect(uint(c.timeout / time.Millisecond))
+}
+
+// the backoff between attempts to reconnect to an MQTT 5 broker
+const (
+	mqttReconnectBackoff    = time.Second
+	mqttMaxReconnectBackoff = time.Minute
+)
+
+// mqttV5Client uses the paho MQTT 5 client, which does not reconnect by
+// itself. The connection is dropped on errors and established again in
+// the background, with exponential backoff between the attempts.
+type mqttV5Client struct {
+	mu      sync.Mutex
+	conf    *Config
+	client  *paho.Client
+	timeout time.Duration
+	closed  bool
+	stop    chan struct{}
+
+	// closed once the reconnect in the background is over,
+	// nil when there is no reconnect in the background
+	reconnecting chan struct{}
+}
+
+func newMqttV5Client(conf *Config) (*mqttV5Client, error) {
+	c := &mqttV5Client{conf: conf, timeout: conf.MqttTimeout, stop: make(chan struct{})}
+
+	client, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+
+	return c, nil
+}
+
+// connect dials the broker, it is called without the lock held
+func (c *mqttV5Client) connect() (*paho.Client, error) {
+	u, err := url.Parse(c.conf.MqttBroker)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: c.timeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", u.Host)
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		err = errors.New("unsupported mqtt scheme " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the callbacks drop the connection of this client only
+	var client *paho.Client
+	client = paho.NewClient(paho.ClientConfig{
+		ClientID: c.conf.MqttClientID,
+		Conn:     conn,
+		OnClientError: func(err error) {
+			log.Warnf("disconnected from mqtt broker. %+v", err)
+			c.drop(client)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			log.Warnf("mqtt broker disconnected with reason code %d", d.ReasonCode)
+			c.drop(client)
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	connack, err := client.Connect(ctx, &paho.Connect{
+		ClientID:     c.conf.MqttClientID,
+		KeepAlive:    30,
+		CleanStart:   true,
+		Username:     c.conf.MqttUser,
+		UsernameFlag: c.conf.MqttUser != "",
+		Password:     []byte(c.conf.MqttPassword),
+		PasswordFlag: c.conf.MqttPassword != "",
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if connack.ReasonCode != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("mqtt broker refused connection with reason code %d", connack.ReasonCode)
+	}
+
+	return client, nil
+}
+
+// drop closes the connection of the client unless it was dropped
+// already, and starts to reconnect in the background
+func (c *mqttV5Client) drop(client *paho.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client == nil || c.client != client {
+		return
+	}
+
+	_ = client.Conn.Close()
+	c.client = nil
+	c.startReconnect()
+}
+
+// startReconnect must be called with the lock held, it returns the
+// channel closed once the reconnect is over, or nil after close
+func (c *mqttV5Client) startReconnect() chan struct{} {
+	if c.reconnecting == nil && !c.closed {
+		c.reconnecting = make(chan struct{})
+		go c.reconnect(c.reconnecting)
+	}
+	return c.reconnecting
+}
+
+func (c *mqttV5Client) reconnect(done chan struct{}) {
+	defer close(done)
+
+	backoff := mqttReconnectBackoff
+	for {
+		client, err := c.connect()
+		if c.reconnected(client, err) {
+			return
+		}
+
+		log.Debugf("Unable to connect to mqtt broker, retry in %v. %+v", backoff, err)
+		select {
+		case <-c.stop:
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > mqttMaxReconnectBackoff {
+			backoff = mqttMaxReconnectBackoff
+		}
+	}
+}
+
+// reconnected keeps the client if connecting succeeded,
+// it returns true once the reconnect is over
+func (c *mqttV5Client) reconnected(client *paho.Client, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		if err == nil {
+			_ = client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+			_ = client.Conn.Close()
+		}
+		c.reconnecting = nil
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	log.Infof("reconnected to mqtt broker")
+	c.client = client
+	c.reconnecting = nil
+	return true
+}
+
+// publish waits up to the timeout for the reconnect
+// when the connection was dropped
+func (c *mqttV5Client) publish(topic string, payload []byte, qos byte, retained bool) error {
+	c.mu.Lock()
+	client := c.client
+	var reconnecting chan struct{}
+	if client == nil {
+		reconnecting = c.startReconnect()
+	}
+	c.mu.Unlock()
+
+	if client == nil {
+		if reconnecting != nil {
+			select {
+			case <-reconnecting:
+			case <-time.After(c.timeout):
+			}
+		}
+
+		c.mu.Lock()
+		client = c.client
+		c.mu.Unlock()
+
+		if client == nil {
+			return errors.New("not connected to mqtt broker")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	resp, err := client.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	})
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		// the connection is still good
+		return fmt.Errorf("mqtt broker rejected message with reason code %d", resp.ReasonCode)
+	}
+	if err != nil {
+		c.drop(client)
+		return err
+	}
+
+	return nil
+}
+
+// connected returns true if connected to the broker, it does not wait
+// for a dropped connection, which is established again in the background
+func (c *mqttV5Client) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		c.startReconnect()
+		return false
+	}
+
+	return true
+}
+
+func (c *mqttV5Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+
+	if c.client != nil {
+		_ = c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		_ = c.client.Conn.Close()
+		c.client = nil
+	}
+}
@@ -0,0 +1,257 @@
+package gtmcdc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt5 "github.com/eclipse/paho.golang/packets"
+	mqtt3 "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMqttBroker is a minimal in-process broker that acknowledges
+// publishes and keeps the retained message of every topic
+type testMqttBroker struct {
+	listener net.Listener
+	version  string
+	reject   string // topic rejected with reason code 0x87, MQTT 5 only
+
+	mu       sync.Mutex
+	topics   []string
+	retained map[string][]byte
+}
+
+func testMqttServer(t *testing.T, version string) *testMqttBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	b := &testMqttBroker{listener: listener, version: version, retained: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if version == MqttV5 {
+				go b.serveV5(conn)
+			} else {
+				go b.serveV311(conn)
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *testMqttBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testMqttBroker) received(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.topics = append(b.topics, topic)
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+}
+
+func (b *testMqttBroker) serveV311(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := mqtt3.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.(type) {
+		case *mqtt3.ConnectPacket:
+			_ = mqtt3.NewControlPacket(mqtt3.Connack).Write(conn)
+		case *mqtt3.PublishPacket:
+			b.received(p.TopicName, p.Payload, p.Retain)
+			if p.Qos > 0 {
+				ack := mqtt3.NewControlPacket(mqtt3.Puback).(*mqtt3.PubackPacket)
+				ack.MessageID = p.MessageID
+				_ = ack.Write(conn)
+			}
+		case *mqtt3.PingreqPacket:
+			_ = mqtt3.NewControlPacket(mqtt3.Pingresp).Write(conn)
+		case *mqtt3.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *testMqttBroker) serveV5(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := mqtt5.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.Content.(type) {
+		case *mqtt5.Connect:
+			_, _ = mqtt5.NewControlPacket(mqtt5.CONNACK).WriteTo(conn)
+		case *mqtt5.Publish:
+			ack := mqtt5.NewControlPacket(mqtt5.PUBACK)
+			ack.Content.(*mqtt5.Puback).PacketID = p.PacketID
+			if p.Topic == b.reject {
+				ack.Content.(*mqtt5.Puback).ReasonCode = 0x87
+			} else {
+				// the retain flag is not decoded by ReadPacket
+				b.received(p.Topic, p.Payload, cp.Flags&0x1 == 1)
+			}
+			if p.QoS > 0 {
+				_, _ = ack.WriteTo(conn)
+			}
+		case *mqtt5.Pingreq:
+			_, _ = mqtt5.NewControlPacket(mqtt5.PINGRESP).WriteTo(conn)
+		case *mqtt5.Disconnect:
+			return
+		}
+	}
+}
+
+func testMqttConfig(url, version string) *Config {
+	return &Config{
+		MqttBroker:   url,
+		MqttVersion:  version,
+		MqttClientID: "gtmcdc-test",
+		MqttTopic:    "gtmcdc/{{.Global}}/{{.Key}}{{range .Subscripts}}/{{.}}{{end}}",
+		MqttQoS:      1,
+		MqttRetained: true,
+		MqttTimeout:  5 * time.Second,
+	}
+}
+
+func Test_DoFilter_Mqtt(t *testing.T) {
+	for _, version := range []string{MqttV311, MqttV5} {
+		broker := testMqttServer(t, version)
+
+		metrics := InitMetrics()
+		sink, err := NewMqttSink(testMqttConfig(broker.url(), version), metrics)
+		assert.Nil(t, err)
+		assert.True(t, sink.Healthy())
+
+		sinks := NewFanout(metrics)
+		sinks.Add(sink, FailureRequire)
+
+		fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+		(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+		assert.Nil(t, sinks.Close())
+		_ = broker.listener.Close()
+
+		broker.mu.Lock()
+		assert.Equal(t, []string{"gtmcdc/ACN/1234/51", "gtmcdc/ACN/1234/52", "gtmcdc/ACN/5678/51", "gtmcdc/ACN/5678/51"}, broker.topics, version)
+		// the latest value of every node is retained
+		assert.Equal(t, 3, len(broker.retained), version)
+		assert.Contains(t, string(broker.retained["gtmcdc/ACN/5678/51"]), "300.00", version)
+		broker.mu.Unlock()
+	}
+}
+
+func Test_MqttSink_Kill(t *testing.T) {
+	broker := testMqttServer(t, MqttV311)
+	defer broker.listener.Close()
+
+	conf := testMqttConfig(broker.url(), MqttV311)
+	conf.MqttTopic = "gtmcdc/{{.Global}}/{{.Key}}+#"
+	sink, err := NewMqttSink(conf, InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	set := parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`)
+	assert.Nil(t, sink.Publish(&Unit{Records: set, done: true}))
+	assert.Equal(t, 1, len(broker.retained))
+
+	// KILL removes the retained message of the node
+	kill := parseAll(t, `04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)`)
+	assert.Nil(t, sink.Publish(&Unit{Records: kill, done: true}))
+	assert.Equal(t, []string{"gtmcdc/ACN/1234__", "gtmcdc/ACN/1234__"}, broker.topics)
+	assert.Equal(t, 0, len(broker.retained))
+}
+
+func Test_DoFilter_MqttRejected(t *testing.T) {
+	broker := testMqttServer(t, MqttV5)
+	broker.reject = "gtmcdc/ACN/5678/51"
+	defer broker.listener.Close()
+
+	metrics := InitMetrics()
+	sink, err := NewMqttSink(testMqttConfig(broker.url(), MqttV5), metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureStop)
+	defer sinks.Close()
+
+	output, err := testTempFileWithContent([]byte(""))
+	assert.Nil(t, err)
+	defer os.Remove(output)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", output)
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+	_ = fout.Close()
+
+	// only the lines of the first transaction are forwarded
+	// because the broker did not acknowledge the single SET
+	actual, _ := ioutil.ReadFile(output)
+	assert.Equal(t, 4, strings.Count(string(actual), "\n"))
+	assert.True(t, sink.Healthy())
+}
+
+func Test_NewMqttSink_Invalid(t *testing.T) {
+	_, err := NewMqttSink(&Config{MqttBroker: "off"}, nil)
+	assert.NotNil(t, err)
+
+	conf := testMqttConfig("tcp://127.0.0.1:1883", "4")
+	_, err = NewMqttSink(conf, nil)
+	assert.NotNil(t, err)
+
+	conf = testMqttConfig("tcp://127.0.0.1:1883", MqttV311)
+	conf.MqttQoS = 3
+	_, err = NewMqttSink(conf, nil)
+	assert.NotNil(t, err)
+
+	// QoS 0 is not acknowledged by the broker
+	conf.MqttQoS = 0
+	_, err = NewMqttSink(conf, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_MqttSink_V5Healthy(t *testing.T) {
+	broker := testMqttServer(t, MqttV5)
+
+	sink, err := NewMqttSink(testMqttConfig(broker.url(), MqttV5), InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	// a dropped connection is established again in the background
+	client := sink.client.(*mqttV5Client)
+	dropped := client.client
+	client.drop(dropped)
+	assert.False(t, sink.Healthy())
+	assert.Eventually(t, sink.Healthy, 5*time.Second, 10*time.Millisecond)
+
+	// callbacks of the dropped client leave the new connection alone
+	client.drop(dropped)
+	assert.True(t, sink.Healthy())
+
+	// not healthy while the broker is down, publish gives up after the timeout
+	_ = broker.listener.Close()
+	client.timeout = 100 * time.Millisecond
+	client.drop(client.client)
+	assert.False(t, sink.Healthy())
+	unit := &Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`), done: true}
+	assert.NotNil(t, sink.Publish(unit))
+}
@@ -0,0 +1,151 @@
+package gtmcdc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkNats is the name of the NATS sink in GTMCDC_SINKS
+const SinkNats = "nats"
+
+// NatsSink publishes the JSON of every journal record to the subject
+// <prefix>.<global>.<operand>, e.g. gtmcdc.ACN.SET, or <prefix>.<operand>
+// for records without a global. With JetStream, a record is published once
+// the stream acknowledges it, and the Nats-Msg-Id header lets JetStream
+// discard records resent after a restart. Without JetStream, a record is
+// published once the server has received it.
+type NatsSink struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	prefix  string
+	timeout time.Duration
+	metrics *Metrics
+}
+
+// NewNatsSink connects to the NATS servers in the configuration
+func NewNatsSink(conf *Config, metrics *Metrics) (*NatsSink, error) {
+	if conf.NatsURL == "" || conf.NatsURL == "off" {
+		return nil, errors.New("invalid nats url")
+	}
+
+	opts := []nats.Option{
+		nats.Name("gtmcdc"),
+		nats.Timeout(conf.NatsTimeout),
+		// keep reconnecting for as long as the filter runs
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warnf("disconnected from nats. %+v", err)
+		}),
+	}
+	if conf.NatsCreds != "" {
+		opts = append(opts, nats.UserCredentials(conf.NatsCreds))
+	}
+
+	conn, err := nats.Connect(conf.NatsURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &NatsSink{
+		conn:    conn,
+		prefix:  conf.NatsSubjectPrefix,
+		timeout: conf.NatsTimeout,
+		metrics: metrics,
+	}
+
+	if conf.NatsJetStream {
+		sink.js, err = conn.JetStream(nats.MaxWait(conf.NatsTimeout))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return sink, nil
+}
+
+// Name returns the name of the sink
+func (n *NatsSink) Name() string {
+	return SinkNats
+}
+
+// Subject returns the subject a journal record is published to
+func (n *NatsSink) Subject(rec *JournalRecord) string {
+	tokens := []string{n.prefix}
+	if node := rec.detail.node; node != nil {
+		tokens = append(tokens, strings.ToUpper(node.Global))
+	}
+	return strings.Join(append(tokens, rec.opcode), ".")
+}
+
+// Publish the records of the unit in order
+func (n *NatsSink) Publish(unit *Unit) error {
+	for i, rec := range unit.Records {
+		jsonstr, err := rec.JSON()
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		if err = n.publish(n.Subject(rec), n.msgID(unit, i), []byte(jsonstr)); err != nil {
+			log.Warnf("Unable to publish record to nats. %+v", err)
+			n.metrics.IncrCounter("nats_records_not_published")
+			return err
+		}
+
+		n.metrics.IncrCounter("nats_records_published")
+		elapsed := time.Since(start)
+		n.metrics.HistoObserve("message_publish_to_nats", float64(elapsed/time.Microsecond))
+	}
+
+	return nil
+}
+
+func (n *NatsSink) publish(subject, msgID string, data []byte) error {
+	if n.js != nil {
+		var opts []nats.PubOpt
+		if msgID != "" {
+			opts = append(opts, nats.MsgId(msgID))
+		}
+		_, err := n.js.Publish(subject, data, opts...)
+		return err
+	}
+
+	if err := n.conn.Publish(subject, data); err != nil {
+		return err
+	}
+	return n.conn.FlushTimeout(n.timeout)
+}
+
+// msgID identifies the i-th record of the unit by the position of the
+// record, which is unique within the replication stream except for the
+// records of a TP transaction that are told apart by i. Records without
+// a position, e.g. the updates of a ZTSTART...ZTCOM transaction, have
+// no id so that they are not discarded as duplicates
+func (n *NatsSink) msgID(unit *Unit, i int) string {
+	stream, pos := unit.Records[i].position()
+	if pos == (Position{}) {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", stream, pos.StreamSeq, pos.JournalSeq, i)
+}
+
+// Flush waits until the server has received everything published
+func (n *NatsSink) Flush() error {
+	return n.conn.FlushTimeout(n.timeout)
+}
+
+// Close drains and closes the connection
+func (n *NatsSink) Close() error {
+	return n.conn.Drain()
+}
+
+// Healthy returns true while connected to the server
+func (n *NatsSink) Healthy() bool {
+	return n.conn.IsConnected()
+}
@@ -0,0 +1,149 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNatsServer starts an embedded nats server with JetStream
+// and a stream that captures all subjects under gtmcdc
+func testNatsServer(t *testing.T) (*server.Server, string) {
+	dir, err := ioutil.TempDir("", "nats_test")
+	assert.Nil(t, err)
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  dir,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	assert.Nil(t, err)
+
+	go ns.Start()
+	assert.True(t, ns.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(ns.ClientURL())
+	assert.Nil(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.Nil(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "GTMCDC", Subjects: []string{"gtmcdc.>"}})
+	assert.Nil(t, err)
+
+	return ns, dir
+}
+
+func testNatsConfig(url string) *Config {
+	return &Config{
+		NatsURL:           url,
+		NatsSubjectPrefix: "gtmcdc",
+		NatsJetStream:     true,
+		NatsTimeout:       5 * time.Second,
+	}
+}
+
+func Test_DoFilter_Nats(t *testing.T) {
+	ns, dir := testNatsServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.Shutdown()
+
+	metrics := InitMetrics()
+	sink, err := NewNatsSink(testNatsConfig(ns.ClientURL()), metrics)
+	assert.Nil(t, err)
+	assert.True(t, sink.Healthy())
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	assert.Nil(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	assert.Nil(t, err)
+
+	info, err := js.StreamInfo("GTMCDC")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), info.State.Msgs)
+
+	msg, err := js.GetMsg("GTMCDC", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "gtmcdc.ACN.SET", msg.Subject)
+	event := JournalEvent{}
+	assert.Nil(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "ACN", event.Global)
+
+	// records resent after a restart are discarded by JetStream,
+	// except the ZTP update which has no position
+	fin, fout = InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+	info, err = js.StreamInfo("GTMCDC")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), info.State.Msgs)
+
+	assert.Nil(t, sinks.Close())
+}
+
+func Test_NatsSink_NoJetStream(t *testing.T) {
+	ns, dir := testNatsServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.Shutdown()
+
+	conf := testNatsConfig(ns.ClientURL())
+	conf.NatsJetStream = false
+	sink, err := NewNatsSink(conf, InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	assert.Nil(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("gtmcdc.>")
+	assert.Nil(t, err)
+	assert.Nil(t, nc.Flush())
+
+	recs := parseAll(t, `04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)`)
+	assert.Nil(t, sink.Publish(&Unit{Records: recs, done: true}))
+
+	msg, err := sub.NextMsg(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "gtmcdc.ACN.KILL", msg.Subject)
+
+	_, err = NewNatsSink(&Config{NatsURL: "off"}, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_NatsSink_msgID(t *testing.T) {
+	n := &NatsSink{}
+	lines := []string{
+		`06\65287,62156\5\0\0\9001`,
+		`05\65287,62156\5\0\0\9001\0\0\1\0\^ACN(5678,51)="300.00"`,
+		`07\65287,62156\6\0\0\9001\1`,
+		`05\65287,62157\7\0\0\9001\0\0\0\0\^ACN(5678,53)="2"`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	var units []*Unit
+	for i, rec := range recs {
+		units = append(units, a.Add(rec, lines[i])...)
+	}
+	assert.Equal(t, 2, len(units))
+
+	// the token of a ZTSTART...ZTCOM transaction is not a position, the
+	// update is not deduplicated with the record at journal_seq 9001
+	assert.Equal(t, "", n.msgID(units[0], 0))
+	assert.Equal(t, "0:0:9001:0", n.msgID(units[1], 0))
+}
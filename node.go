@@ -0,0 +1,333 @@
+package gtmcdc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Error Messages
+const (
+	ErrorInvalidNode  = "invalid global node reference"
+	ErrorInvalidValue = "invalid node value"
+)
+
+// Subscript is one subscript of a global node reference.
+// Numeric is true when the subscript was written as a canonical
+// number instead of a string literal, e.g. 51 vs "51"
+type Subscript struct {
+	Value   string
+	Numeric bool
+}
+
+// Node is a global node reference parsed from a journal record,
+// e.g. ^ACN("A,B",51)
+type Node struct {
+	Global     string
+	Subscripts []Subscript
+}
+
+// Key returns the first subscript of the node or empty string
+// if the global is not subscripted
+func (n *Node) Key() string {
+	if len(n.Subscripts) == 0 {
+		return ""
+	}
+	return n.Subscripts[0].Value
+}
+
+// SubscriptValues returns values of all subscripts
+func (n *Node) SubscriptValues() []string {
+	values := make([]string, len(n.Subscripts))
+	for i, sub := range n.Subscripts {
+		values[i] = sub.Value
+	}
+	return values
+}
+
+// String returns the node reference in ZWRITE style, e.g. ^ACN("A,B",51)
+func (n *Node) String() string {
+	if len(n.Subscripts) == 0 {
+		return "^" + n.Global
+	}
+
+	subs := make([]string, len(n.Subscripts))
+	for i, sub := range n.Subscripts {
+		subs[i] = subscriptString(sub.Value)
+	}
+
+	return "^" + n.Global + "(" + strings.Join(subs, ",") + ")"
+}
+
+// subscriptString returns a subscript as a canonical number
+// or a string literal
+func subscriptString(value string) string {
+	if num, err := canonicNumber(value); err == nil && num == value {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+// mscanner tokenizes the ZWRITE style node and value syntax used
+// by GT.M and YottaDB journal extracts, e.g.
+//
+//	^ACN("A,B",51)="abc"_$C(10)_"say ""hi"""
+type mscanner struct {
+	s   string
+	pos int
+}
+
+func (sc *mscanner) eof() bool {
+	return sc.pos >= len(sc.s)
+}
+
+func (sc *mscanner) peek() byte {
+	if sc.eof() {
+		return 0
+	}
+	return sc.s[sc.pos]
+}
+
+// accept consumes the next byte if it is c
+func (sc *mscanner) accept(c byte) bool {
+	if sc.peek() == c && !sc.eof() {
+		sc.pos++
+		return true
+	}
+	return false
+}
+
+// name reads a M name, i.e. % or alpha followed by alphanumerics
+func (sc *mscanner) name() string {
+	start := sc.pos
+	for !sc.eof() {
+		c := sc.peek()
+		isAlpha := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+		isDigit := c >= '0' && c <= '9'
+		if isAlpha || (c == '%' && sc.pos == start) || (isDigit && sc.pos > start) {
+			sc.pos++
+			continue
+		}
+		break
+	}
+	return sc.s[start:sc.pos]
+}
+
+// node reads a global reference ^NAME or ^NAME(sub1,sub2...)
+func (sc *mscanner) node() (*Node, error) {
+	if !sc.accept('^') {
+		return nil, errors.New(ErrorInvalidNode)
+	}
+
+	global := sc.name()
+	if global == "" {
+		return nil, errors.New(ErrorInvalidNode)
+	}
+
+	node := &Node{Global: global}
+	if !sc.accept('(') {
+		return node, nil
+	}
+
+	for {
+		val, numeric, err := sc.expr()
+		if err != nil {
+			return nil, errors.New(ErrorInvalidNode)
+		}
+		node.Subscripts = append(node.Subscripts, Subscript{Value: val, Numeric: numeric})
+
+		if sc.accept(',') {
+			continue
+		}
+		if sc.accept(')') {
+			return node, nil
+		}
+		return nil, errors.New(ErrorInvalidNode)
+	}
+}
+
+// expr reads one or more terms joined by the _ concatenation operator.
+// numeric is true only if the expression is a single number literal
+func (sc *mscanner) expr() (string, bool, error) {
+	var sb strings.Builder
+	terms := 0
+	numeric := false
+
+	for {
+		val, isNum, err := sc.term()
+		if err != nil {
+			return "", false, err
+		}
+		sb.WriteString(val)
+		numeric = isNum
+		terms++
+
+		if !sc.accept('_') {
+			break
+		}
+	}
+
+	return sb.String(), numeric && terms == 1, nil
+}
+
+// term reads a string literal, a number or a $C()/$ZCH() function call
+func (sc *mscanner) term() (string, bool, error) {
+	switch c := sc.peek(); {
+	case c == '"':
+		s, err := sc.str()
+		return s, false, err
+	case c == '$':
+		s, err := sc.char()
+		return s, false, err
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		s, err := sc.number()
+		return s, true, err
+	default:
+		return "", false, errors.New(ErrorInvalidValue)
+	}
+}
+
+// str reads a quoted string literal, embedded quotes are doubled
+func (sc *mscanner) str() (string, error) {
+	if !sc.accept('"') {
+		return "", errors.New(ErrorInvalidValue)
+	}
+
+	var sb strings.Builder
+	for !sc.eof() {
+		c := sc.s[sc.pos]
+		sc.pos++
+		if c != '"' {
+			sb.WriteByte(c)
+			continue
+		}
+		if !sc.accept('"') {
+			return sb.String(), nil
+		}
+		sb.WriteByte('"')
+	}
+
+	// unterminated string
+	return "", errors.New(ErrorInvalidValue)
+}
+
+// number reads a numeric literal and returns it in M canonical form
+func (sc *mscanner) number() (string, error) {
+	start := sc.pos
+	sc.accept('-')
+	for !sc.eof() {
+		c := sc.peek()
+		if (c >= '0' && c <= '9') || c == '.' || c == 'E' || c == 'e' ||
+			((c == '-' || c == '+') && (sc.s[sc.pos-1] == 'E' || sc.s[sc.pos-1] == 'e')) {
+			sc.pos++
+			continue
+		}
+		break
+	}
+
+	return canonicNumber(sc.s[start:sc.pos])
+}
+
+// char reads $C(n,...), $CHAR(n,...), $ZCH(n,...) or $ZCHAR(n,...)
+// and returns the characters as a string
+func (sc *mscanner) char() (string, error) {
+	if !sc.accept('$') {
+		return "", errors.New(ErrorInvalidValue)
+	}
+
+	fn := strings.ToUpper(sc.name())
+	isChar := fn == "C" || fn == "CHAR"
+	isZChar := fn == "ZCH" || fn == "ZCHAR"
+	if (!isChar && !isZChar) || !sc.accept('(') {
+		return "", errors.New(ErrorInvalidValue)
+	}
+
+	var sb strings.Builder
+	for {
+		start := sc.pos
+		for !sc.eof() && sc.peek() >= '0' && sc.peek() <= '9' {
+			sc.pos++
+		}
+		code, err := strconv.Atoi(sc.s[start:sc.pos])
+		if err != nil {
+			return "", errors.New(ErrorInvalidValue)
+		}
+
+		switch {
+		case isZChar && code <= 255:
+			sb.WriteByte(byte(code))
+		case isChar && code <= 0x10FFFF:
+			sb.WriteRune(rune(code))
+		default:
+			return "", errors.New(ErrorInvalidValue)
+		}
+
+		if sc.accept(',') {
+			continue
+		}
+		if sc.accept(')') {
+			return sb.String(), nil
+		}
+		return "", errors.New(ErrorInvalidValue)
+	}
+}
+
+// canonicNumber converts a numeric literal to M canonical form,
+// i.e. no leading zeros, no trailing zeros after the decimal point
+// and no leading zero before the decimal point, e.g. 0.50 becomes .5
+func canonicNumber(num string) (string, error) {
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || num == "" {
+		return "", errors.New(ErrorInvalidValue)
+	}
+
+	// integers without exponent are kept as is to avoid losing
+	// precision on long numbers such as account numbers
+	if !strings.ContainsAny(num, ".eE") {
+		neg := strings.HasPrefix(num, "-")
+		digits := strings.TrimLeft(strings.TrimPrefix(num, "-"), "0")
+		if digits == "" {
+			return "0", nil
+		}
+		if neg {
+			return "-" + digits, nil
+		}
+		return digits, nil
+	}
+
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if strings.HasPrefix(s, "0.") {
+		s = s[1:]
+	} else if strings.HasPrefix(s, "-0.") {
+		s = "-" + s[2:]
+	}
+
+	return s, nil
+}
+
+// parseNode parses a global node reference with an optional value
+// in the form of ^GLOBAL(sub1,sub2,...)=value. hasValue is false when
+// the input contains only the node reference, e.g. for KILL records
+func parseNode(input string) (node *Node, value string, hasValue bool, err error) {
+	sc := &mscanner{s: input}
+
+	node, err = sc.node()
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if sc.eof() {
+		return node, "", false, nil
+	}
+
+	if !sc.accept('=') {
+		return nil, "", false, errors.New(ErrorInvalidNode)
+	}
+
+	value, _, err = sc.expr()
+	if err != nil || !sc.eof() {
+		return nil, "", false, errors.New(ErrorInvalidValue)
+	}
+
+	return node, value, true, nil
+}
@@ -0,0 +1,130 @@
+package gtmcdc
+
+import (
+	"errors"
+	"strings"
+)
+
+// Error Messages
+const (
+	ErrorInvalidPattern = "invalid node pattern"
+)
+
+// SubscriptPattern is one subscript of a NodePattern, either a literal
+// that must be equal to the subscript, * that matches any subscript,
+// or a name that matches any subscript and names its value
+type SubscriptPattern struct {
+	Value string
+	Name  string
+	Any   bool
+}
+
+// NodePattern matches global nodes, e.g. ^ACN(*,51) or ^ACN(acct,51).
+// Literals are written as in a node reference, i.e. numbers or
+// quoted strings, names are M names
+type NodePattern struct {
+	Global     string
+	Subscripts []SubscriptPattern
+}
+
+// ParseNodePattern parses a pattern in the form of ^GLOBAL(sub1,sub2,...)
+func ParseNodePattern(input string) (*NodePattern, error) {
+	sc := &mscanner{s: strings.TrimSpace(input)}
+	if !sc.accept('^') {
+		return nil, errors.New(ErrorInvalidPattern)
+	}
+
+	global := sc.name()
+	if global == "" {
+		return nil, errors.New(ErrorInvalidPattern)
+	}
+
+	pattern := &NodePattern{Global: strings.ToUpper(global)}
+	if !sc.accept('(') {
+		if !sc.eof() {
+			return nil, errors.New(ErrorInvalidPattern)
+		}
+		return pattern, nil
+	}
+
+	for {
+		var sub SubscriptPattern
+		switch c := sc.peek(); {
+		case c == '*':
+			sc.pos++
+			sub.Any = true
+		case c == '%' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+			sub.Name = sc.name()
+			sub.Any = true
+		default:
+			val, _, err := sc.expr()
+			if err != nil {
+				return nil, errors.New(ErrorInvalidPattern)
+			}
+			sub.Value = val
+		}
+		pattern.Subscripts = append(pattern.Subscripts, sub)
+
+		if sc.accept(',') {
+			continue
+		}
+		if sc.accept(')') && sc.eof() {
+			return pattern, nil
+		}
+		return nil, errors.New(ErrorInvalidPattern)
+	}
+}
+
+// Match returns true if the node has the global and subscripts of the pattern
+func (p *NodePattern) Match(node *Node) bool {
+	return node != nil && len(node.Subscripts) == len(p.Subscripts) && p.MatchPrefix(node)
+}
+
+// MatchPrefix returns true if the node is matched by the pattern or is an
+// ancestor of the nodes matched, e.g. ^ACN(1234) for ^ACN(*,51)
+func (p *NodePattern) MatchPrefix(node *Node) bool {
+	if node == nil || !strings.EqualFold(node.Global, p.Global) || len(node.Subscripts) > len(p.Subscripts) {
+		return false
+	}
+
+	for i, sub := range node.Subscripts {
+		if !p.Subscripts[i].Any && p.Subscripts[i].Value != sub.Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Names returns the values of the named subscripts of the node, the
+// node must match the pattern or its prefix
+func (p *NodePattern) Names(node *Node) map[string]string {
+	names := map[string]string{}
+	for i, sub := range node.Subscripts {
+		if name := p.Subscripts[i].Name; name != "" {
+			names[name] = sub.Value
+		}
+	}
+	return names
+}
+
+// String returns the pattern as in the input
+func (p *NodePattern) String() string {
+	if len(p.Subscripts) == 0 {
+		return "^" + p.Global
+	}
+
+	subs := make([]string, len(p.Subscripts))
+	for i, sub := range p.Subscripts {
+		switch {
+		case sub.Name != "":
+			subs[i] = sub.Name
+		case sub.Any:
+			subs[i] = "*"
+		default:
+			subs[i] = subscriptString(sub.Value)
+		}
+	}
+
+	return "^" + p.Global + "(" + strings.Join(subs, ",") + ")"
+}
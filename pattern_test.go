@@ -0,0 +1,50 @@
+package gtmcdc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseNodePattern(t *testing.T) {
+	for _, input := range []string{`^ACN`, `^ACN(*,51)`, `^ACN(acct,51)`, `^%ZZ("A,B",acct,*)`, `^ACN("007")`} {
+		pattern, err := ParseNodePattern(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, input, pattern.String())
+	}
+
+	pattern, err := ParseNodePattern(`^acn(acct,51,"X"_$C(65))`)
+	assert.Nil(t, err)
+	assert.Equal(t, "ACN", pattern.Global)
+	assert.Equal(t, SubscriptPattern{Name: "acct", Any: true}, pattern.Subscripts[0])
+	assert.Equal(t, SubscriptPattern{Value: "XA"}, pattern.Subscripts[2])
+
+	for _, input := range []string{``, `ACN(1)`, `^ACN(`, `^ACN(1,)`, `^ACN(1)x`, `^ACN x`} {
+		_, err := ParseNodePattern(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func Test_NodePattern_Match(t *testing.T) {
+	pattern, _ := ParseNodePattern(`^ACN(acct,51)`)
+
+	node := func(input string) *Node {
+		n, _, _, err := parseNode(input)
+		assert.Nil(t, err)
+		return n
+	}
+
+	assert.True(t, pattern.Match(node(`^ACN(1234,51)`)))
+	assert.True(t, pattern.Match(node(`^acn(1234,"51")`)))
+	assert.False(t, pattern.Match(node(`^ACN(1234,52)`)))
+	assert.False(t, pattern.Match(node(`^ACN(1234)`)))
+	assert.False(t, pattern.Match(node(`^XYZ(1234,51)`)))
+	assert.False(t, pattern.Match(nil))
+
+	assert.True(t, pattern.MatchPrefix(node(`^ACN`)))
+	assert.True(t, pattern.MatchPrefix(node(`^ACN(1234)`)))
+	assert.False(t, pattern.MatchPrefix(node(`^ACN(1234,51,1)`)))
+
+	assert.Equal(t, map[string]string{"acct": "1234"}, pattern.Names(node(`^ACN(1234,51)`)))
+	assert.Equal(t, map[string]string{}, pattern.Names(node(`^ACN`)))
+}
@@ -1,73 +1,410 @@
 package gtmcdc
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
 	log "github.com/sirupsen/logrus"
 )
 
+// Message is a message to be published to Kafka. Empty key means
+// the message is published without a key. A tombstone is published
+// with a null value regardless of Value.
+type Message struct {
+	Key       string            `json:"key,omitempty"`
+	Value     string            `json:"value"`
+	Tombstone bool              `json:"tombstone,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// plainMessage has the fields of Message without its JSON methods
+type plainMessage Message
+
+// MarshalJSON writes the value as a string, or base64 encoded when
+// the value is binary, e.g. Avro, so that it can be spooled
+func (m *Message) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(m.Value) {
+		return json.Marshal((*plainMessage)(m))
+	}
+
+	return json.Marshal(&struct {
+		*plainMessage
+		Value  string `json:"value"`
+		Binary bool   `json:"binary"`
+	}{(*plainMessage)(m), base64.StdEncoding.EncodeToString([]byte(m.Value)), true})
+}
+
+// UnmarshalJSON reads a message written by MarshalJSON
+func (m *Message) UnmarshalJSON(data []byte) error {
+	msg := struct {
+		*plainMessage
+		Binary bool `json:"binary"`
+	}{plainMessage: (*plainMessage)(m)}
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	if msg.Binary {
+		value, err := base64.StdEncoding.DecodeString(m.Value)
+		if err != nil {
+			return err
+		}
+		m.Value = string(value)
+	}
+
+	return nil
+}
+
+// PublishResult is the acknowledgement of a message sent by PublishAsync
+type PublishResult struct {
+	Message  *Message
+	Metadata interface{}
+	Err      error
+}
+
+// asyncMetadata is attached to the sarama message to find the
+// original message when the acknowledgement is received
+type asyncMetadata struct {
+	message  *Message
+	metadata interface{}
+}
+
+// Producer publishes messages to a Kafka topic. It may be connected
+// later by the spool drainer, so the client and the producers are
+// guarded by mu, and connect makes sure only one connection is made
 type Producer struct {
-	syncProducer sarama.SyncProducer
-	topic        string
+	mu            sync.RWMutex
+	connect       sync.Mutex
+	client        sarama.Client
+	syncProducer  sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+	results       chan *PublishResult
+	topic         string
+	brokerList    []string
+	config        *sarama.Config
+	async         bool
 }
 
 func (p *Producer) CleanupProducer() {
-	if p != nil && p.syncProducer != nil {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	client, syncProducer, asyncProducer, results := p.client, p.syncProducer, p.asyncProducer, p.results
+	p.client, p.syncProducer, p.asyncProducer = nil, nil, nil
+	p.mu.Unlock()
+
+	if asyncProducer != nil {
+		log.Debug("cleanup async producer")
+		// results channel is closed once all acknowledgements are collected
+		asyncProducer.AsyncClose()
+		for range results {
+		}
+	}
+
+	if syncProducer != nil {
 		log.Debug("cleanup producer")
-		_ = p.syncProducer.Close()
+		_ = syncProducer.Close()
+	}
+
+	if client != nil {
+		_ = client.Close()
 	}
 }
 
-func (p *Producer) PublishMessage(message string) error {
-	if p.syncProducer == nil {
+// producers returns the sync and the async producer, nil if not connected
+func (p *Producer) producers() (sarama.SyncProducer, sarama.AsyncProducer) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.syncProducer, p.asyncProducer
+}
+
+func (p *Producer) PublishMessage(message *Message) error {
+	return p.PublishMessages([]*Message{message})
+}
+
+// PublishMessages publishes the messages in order and stops at the first
+// failure. When the producer is transactional, the messages are published
+// in one Kafka transaction so that either all or none of them are visible
+// to consumers with read_committed isolation.
+func (p *Producer) PublishMessages(messages []*Message) error {
+	syncProducer, _ := p.producers()
+	if syncProducer == nil {
 		return errors.New("producer not available")
 	}
 
-	_, _, err := p.syncProducer.SendMessage(&sarama.ProducerMessage{
-		Topic: p.topic,
-		Value: sarama.StringEncoder(message),
-	})
+	if syncProducer.IsTransactional() {
+		return p.publishTransaction(syncProducer, messages)
+	}
+
+	for _, message := range messages {
+		_, _, err := syncProducer.SendMessage(p.producerMessage(message))
+		if err != nil {
+			log.Info("Unable to publish message")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Producer) publishTransaction(syncProducer sarama.SyncProducer, messages []*Message) error {
+	if err := syncProducer.BeginTxn(); err != nil {
+		log.Info("Unable to begin transaction")
+		return err
+	}
+
+	msgs := make([]*sarama.ProducerMessage, len(messages))
+	for i, message := range messages {
+		msgs[i] = p.producerMessage(message)
+	}
+
+	err := syncProducer.SendMessages(msgs)
+	if err == nil {
+		err = syncProducer.CommitTxn()
+	}
 
 	if err != nil {
-		log.Info("Unable to publish message")
+		log.Info("Unable to publish messages in transaction")
+		if abortErr := syncProducer.AbortTxn(); abortErr != nil {
+			log.Warnf("Unable to abort transaction. %+v", abortErr)
+		}
 		return err
 	}
 
 	return nil
 }
 
-func InitProducer(brokers, topic string) (*Producer, error) {
-	brokerList := strings.Split(brokers, ",")
-	if len(brokerList) < 1 || brokerList[0] == "off" || topic == "" {
+// PublishAsync sends a message without waiting for it to be acknowledged.
+// The result is delivered to the channel returned by Results along with
+// the metadata. This is only available when the producer is in async mode.
+func (p *Producer) PublishAsync(message *Message, metadata interface{}) error {
+	_, asyncProducer := p.producers()
+	if asyncProducer == nil {
+		return errors.New("async producer not available")
+	}
+
+	msg := p.producerMessage(message)
+	msg.Metadata = &asyncMetadata{message: message, metadata: metadata}
+	asyncProducer.Input() <- msg
+
+	return nil
+}
+
+// Results returns the channel where the results of PublishAsync are
+// delivered. A new channel is used every time the producer is connected
+func (p *Producer) Results() <-chan *PublishResult {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.results
+}
+
+func (p *Producer) producerMessage(message *Message) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: p.topic,
+	}
+	if !message.Tombstone {
+		msg.Value = sarama.StringEncoder(message.Value)
+	}
+	if message.Key != "" {
+		msg.Key = sarama.StringEncoder(message.Key)
+	}
+	for k, v := range message.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+
+	return msg
+}
+
+// InitProducer creates the Kafka producer from the configuration
+func InitProducer(conf *Config) (*Producer, error) {
+	brokerList := strings.Split(conf.KafkaBrokerList, ",")
+	if len(brokerList) < 1 || brokerList[0] == "off" || conf.KafkaTopic == "" {
 		return nil, errors.New("invalid kafka broker list or topic specified")
 	}
 
+	config, err := newSaramaConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	producer := &Producer{
+		topic:      conf.KafkaTopic,
+		brokerList: brokerList,
+		config:     config,
+		async:      conf.KafkaAsync,
+	}
+
+	// the producer is returned even if the brokers are not reachable
+	// so that it can be connected later by calling Connect
+	return producer, producer.Connect()
+}
+
+func newSaramaConfig(conf *Config) (*sarama.Config, error) {
 	config := sarama.NewConfig()
 	config.Producer.RequiredAcks = sarama.WaitForLocal
 	config.Producer.Retry.Max = 10
 	config.Producer.Return.Successes = true
 	config.Version = sarama.MaxVersion
 
+	codec, err := compressionCodec(conf.KafkaCompression)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Compression = codec
+
+	if err = configureTLS(config, conf); err != nil {
+		return nil, err
+	}
+
+	if err = configureSASL(config, conf); err != nil {
+		return nil, err
+	}
+
+	if conf.KafkaIdempotent || conf.KafkaTransactionalID != "" {
+		// the broker discards duplicates caused by retries
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if conf.KafkaTransactionalID != "" {
+		config.Producer.Transaction.ID = conf.KafkaTransactionalID
+	}
+
+	if conf.KafkaAsync {
+		// messages are sent once either limit is reached
+		config.Producer.Flush.Messages = conf.KafkaBatchSize
+		config.Producer.Flush.Frequency = conf.KafkaLinger
+	}
+
+	return config, config.Validate()
+}
+
+func compressionCodec(name string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	}
+
+	return sarama.CompressionNone, errors.New("invalid compression codec " + name)
+}
+
+// Connect to the Kafka brokers if not connected already
+func (p *Producer) Connect() error {
+	p.connect.Lock()
+	defer p.connect.Unlock()
+
+	if p.IsKafkaAvailable() {
+		return nil
+	}
+
 	// On the broker side, you may want to change the following settings to get
 	// stronger consistency guarantees:
 	// - For your broker, set `unclean.leader.election.enable` to false
 	// - For the topic, you could increase `min.insync.replicas`.
-	syncProducer, err := sarama.NewSyncProducer(brokerList, config)
+	client, err := sarama.NewClient(p.brokerList, p.config)
 	if err != nil {
 		log.Errorln("Failed to start Sarama producer:", err)
-		return nil, err
+		return err
 	}
 
-	producer := &Producer{
-		syncProducer: syncProducer,
-		topic:        topic,
+	// the sync producer is always created because the spool
+	// is drained with it even in async mode
+	syncProducer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		log.Errorln("Failed to start Sarama producer:", err)
+		return err
 	}
 
-	return producer, nil
+	var asyncProducer sarama.AsyncProducer
+	if p.async && syncProducer.IsTransactional() {
+		log.Warn("async mode is not used with transactional producer")
+	} else if p.async {
+		asyncProducer, err = sarama.NewAsyncProducerFromClient(client)
+		if err != nil {
+			_ = syncProducer.Close()
+			_ = client.Close()
+			log.Errorln("Failed to start Sarama async producer:", err)
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if asyncProducer != nil {
+		p.setAsyncProducer(asyncProducer)
+	}
+	p.client = client
+	p.syncProducer = syncProducer
+	return nil
+}
+
+// setAsyncProducer starts collecting acknowledgements of the async
+// producer into a new results channel, must be called with mu held
+func (p *Producer) setAsyncProducer(asyncProducer sarama.AsyncProducer) {
+	results := make(chan *PublishResult, p.config.ChannelBufferSize)
+	p.asyncProducer = asyncProducer
+	p.results = results
+
+	go func() {
+		defer close(results)
+
+		successes, errs := asyncProducer.Successes(), asyncProducer.Errors()
+		for successes != nil || errs != nil {
+			select {
+			case msg, ok := <-successes:
+				if !ok {
+					successes = nil
+					continue
+				}
+				meta := msg.Metadata.(*asyncMetadata)
+				results <- &PublishResult{Message: meta.message, Metadata: meta.metadata}
+
+			case perr, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				meta := perr.Msg.Metadata.(*asyncMetadata)
+				results <- &PublishResult{Message: meta.message, Metadata: meta.metadata, Err: perr.Err}
+			}
+		}
+	}()
 }
 
 func (p *Producer) IsKafkaAvailable() bool {
-	return p != nil && p.syncProducer != nil
+	if p == nil {
+		return false
+	}
+	syncProducer, _ := p.producers()
+	return syncProducer != nil
+}
+
+// IsAsync returns true if messages can be published with PublishAsync
+func (p *Producer) IsAsync() bool {
+	if p == nil {
+		return false
+	}
+	_, asyncProducer := p.producers()
+	return asyncProducer != nil
 }
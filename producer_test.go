@@ -1,14 +1,18 @@
 package gtmcdc
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_InitProducer(t *testing.T) {
-	p, err := InitProducer("off", "blah")
+	p, err := InitProducer(&Config{KafkaBrokerList: "off", KafkaTopic: "blah"})
 	assert.NotNil(t, err)
 	assert.False(t, p.IsKafkaAvailable())
 }
@@ -18,3 +22,150 @@ func Test_InitPromHttp(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // slight delay to allow gather test coverage
 	assert.Nil(t, err)
 }
+
+func Test_compressionCodec(t *testing.T) {
+	for _, name := range []string{"", "none", "gzip", "snappy", "lz4", "ZSTD"} {
+		_, err := compressionCodec(name)
+		assert.Nil(t, err, name)
+	}
+
+	_, err := compressionCodec("zip")
+	assert.NotNil(t, err)
+
+	_, err = newSaramaConfig(&Config{KafkaCompression: "zip"})
+	assert.NotNil(t, err)
+}
+
+func Test_newSaramaConfig_Async(t *testing.T) {
+	config, err := newSaramaConfig(&Config{
+		KafkaAsync:       true,
+		KafkaBatchSize:   500,
+		KafkaLinger:      50 * time.Millisecond,
+		KafkaCompression: "lz4",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 500, config.Producer.Flush.Messages)
+	assert.Equal(t, 50*time.Millisecond, config.Producer.Flush.Frequency)
+	assert.Equal(t, sarama.CompressionLZ4, config.Producer.Compression)
+}
+
+// testAsyncProducer returns a producer in async mode backed by a mock
+func testAsyncProducer(t *testing.T) (*Producer, *mocks.AsyncProducer) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+
+	ap := mocks.NewAsyncProducer(t, config)
+	producer := &Producer{
+		syncProducer: mocks.NewSyncProducer(t, nil),
+		topic:        "async",
+		config:       config,
+	}
+	producer.setAsyncProducer(ap)
+
+	return producer, ap
+}
+
+func Test_Producer_PublishAsync(t *testing.T) {
+	producer, ap := testAsyncProducer(t)
+	assert.True(t, producer.IsAsync())
+
+	ap.ExpectInputAndSucceed()
+	ap.ExpectInputAndFail(errors.New("send message failed"))
+
+	assert.Nil(t, producer.PublishAsync(&Message{Value: "1"}, 1))
+	assert.Nil(t, producer.PublishAsync(&Message{Value: "2"}, 2))
+
+	// successes and errors are not delivered in any particular order
+	results := map[interface{}]*PublishResult{}
+	for i := 0; i < 2; i++ {
+		res := <-producer.Results()
+		results[res.Metadata] = res
+	}
+	assert.Nil(t, results[1].Err)
+	assert.Equal(t, "2", results[2].Message.Value)
+	assert.NotNil(t, results[2].Err)
+
+	producer.CleanupProducer()
+
+	sync := &Producer{}
+	assert.False(t, sync.IsAsync())
+	assert.NotNil(t, sync.PublishAsync(&Message{Value: "1"}, nil))
+}
+
+func Test_KafkaSink_PublishAsync_Reconnect(t *testing.T) {
+	producer, ap := testAsyncProducer(t)
+	defer producer.CleanupProducer()
+
+	metrics := InitMetrics()
+	sink := &KafkaSink{Producer: producer, Metrics: metrics}
+
+	publish := func() error {
+		done := make(chan error, 1)
+		sink.PublishAsync(&Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234)="1"`), done: true},
+			func() {}, func(err error) { done <- err })
+		return <-done
+	}
+
+	ap.ExpectInputAndSucceed()
+	assert.Nil(t, publish())
+
+	// the results of the new producer are collected after a reconnect
+	ap2 := mocks.NewAsyncProducer(t, producer.config)
+	producer.mu.Lock()
+	producer.setAsyncProducer(ap2)
+	producer.mu.Unlock()
+	_ = ap.Close()
+
+	ap2.ExpectInputAndSucceed()
+	assert.Nil(t, publish())
+}
+
+func Test_newSaramaConfig_Transactional(t *testing.T) {
+	config, err := newSaramaConfig(&Config{KafkaIdempotent: true})
+	assert.Nil(t, err)
+	assert.True(t, config.Producer.Idempotent)
+	assert.Equal(t, sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.Equal(t, 1, config.Net.MaxOpenRequests)
+	assert.Equal(t, "", config.Producer.Transaction.ID)
+
+	// transactional id implies idempotent
+	config, err = newSaramaConfig(&Config{KafkaTransactionalID: "cdcfilter-1"})
+	assert.Nil(t, err)
+	assert.True(t, config.Producer.Idempotent)
+	assert.Equal(t, "cdcfilter-1", config.Producer.Transaction.ID)
+}
+
+func Test_Producer_PublishMessages_Transactional(t *testing.T) {
+	config, err := newSaramaConfig(&Config{KafkaTransactionalID: "cdcfilter-1"})
+	assert.Nil(t, err)
+
+	sp := mocks.NewSyncProducer(t, config)
+	producer := &Producer{syncProducer: sp, topic: "txn", config: config}
+	defer producer.CleanupProducer()
+
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndSucceed()
+	assert.Nil(t, producer.PublishMessages([]*Message{{Value: "1"}, {Value: "2"}}))
+	assert.Equal(t, sarama.ProducerTxnFlagReady, sp.TxnStatus())
+
+	// the transaction is aborted when any message fails
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	assert.NotNil(t, producer.PublishMessages([]*Message{{Value: "3"}, {Value: "4"}}))
+	assert.Equal(t, sarama.ProducerTxnFlagReady, sp.TxnStatus())
+}
+
+func Test_Message_BinaryJSON(t *testing.T) {
+	msg := &Message{Key: "k", Value: "\x00\x00\x00\x00\x01\xff\xfe"}
+	data, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"binary":true`)
+
+	decoded := &Message{}
+	assert.Nil(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, msg, decoded)
+
+	data, err = json.Marshal(&Message{Value: "{}"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"value":"{}"}`, string(data))
+}
@@ -0,0 +1,272 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"gtmcdc/cdcpb"
+)
+
+// protobufEncoder encodes a unit as a cdcpb.Change, see cdcpb/event.proto
+type protobufEncoder struct{}
+
+func (protobufEncoder) Encode(unit *Unit) (*Message, error) {
+	change, err := ProtoChange(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := proto.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Value: string(value)}, nil
+}
+
+// ProtoChange returns the protobuf message of a committed unit
+func ProtoChange(unit *Unit) (*cdcpb.Change, error) {
+	if !unit.done {
+		return nil, errors.New("transaction not committed")
+	}
+
+	if unit.IsTransaction() {
+		return &cdcpb.Change{Event: &cdcpb.Change_Transaction{
+			Transaction: ProtoTransactionEvent(unit.transactionEvent()),
+		}}, nil
+	}
+
+	return &cdcpb.Change{Event: &cdcpb.Change_Record{
+		Record: ProtoJournalEvent(unit.Records[0].Event()),
+	}}, nil
+}
+
+// DecodeProtobuf decodes a message value in the protobuf format and
+// returns either a *JournalEvent or a *TransactionEvent, which can be
+// marshalled to the JSON format
+func DecodeProtobuf(value []byte) (interface{}, error) {
+	change := &cdcpb.Change{}
+	if err := proto.Unmarshal(value, change); err != nil {
+		return nil, err
+	}
+
+	switch event := change.Event.(type) {
+	case *cdcpb.Change_Record:
+		return JournalEventFromProto(event.Record), nil
+	case *cdcpb.Change_Transaction:
+		return TransactionEventFromProto(event.Transaction), nil
+	}
+
+	return nil, errors.New("no event in message")
+}
+
+// ProtoJournalEvent converts the JSON form of a journal record to protobuf
+func ProtoJournalEvent(event *JournalEvent) *cdcpb.JournalEvent {
+	pb := &cdcpb.JournalEvent{
+		Operand: event.Operand,
+		Header: &cdcpb.Header{
+			TimeStamp: event.TimeStamp,
+			Pid:       int32(event.ProcessID),
+			ClientPid: int32(event.ClientProcessID),
+		},
+		Replication: &cdcpb.Replication{
+			StreamNum:  uint32(event.StreamNum),
+			StreamSeq:  uint64(event.StreamSeq),
+			JournalSeq: uint64(event.JournalSeq),
+		},
+		Transaction: &cdcpb.Transaction{
+			TransactionNum: event.TransactionNum,
+			Token:          event.Token,
+			TokenSeq:       uint64(event.TokenSeq),
+			UpdateNum:      uint32(event.UpdateNum),
+			Partners:       event.Partners,
+			TransactionTag: event.TransactionTag,
+		},
+		Pieces: event.NodeValues,
+		Record: event.Record,
+	}
+
+	if event.Global != "" {
+		pb.Node = &cdcpb.Node{Global: event.Global, Subscripts: protoSubscripts(event.Key, event.Subscripts)}
+	}
+
+	if event.Fields != nil {
+		pb.Fields = map[string]*cdcpb.FieldValue{}
+		for name, value := range event.Fields {
+			pb.Fields[name] = protoFieldValue(value)
+		}
+	}
+
+	pb.PreviousPieces = event.PreviousValues
+	for _, change := range event.Changes {
+		pb.Changes = append(pb.Changes, &cdcpb.PieceChange{
+			Piece: uint32(change.Piece), Old: change.Old, New: change.New,
+		})
+	}
+	for _, deleted := range event.Deleted {
+		pb.Deleted = append(pb.Deleted, &cdcpb.DeletedNode{
+			Subscripts: protoSubscripts(deleted.Key, deleted.Subscripts),
+			Pieces:     deleted.NodeValues,
+		})
+	}
+
+	return pb
+}
+
+// JournalEventFromProto converts a protobuf journal record to the JSON form
+func JournalEventFromProto(pb *cdcpb.JournalEvent) *JournalEvent {
+	event := &JournalEvent{
+		Operand:         pb.Operand,
+		TransactionNum:  pb.GetTransaction().GetTransactionNum(),
+		Token:           pb.GetTransaction().GetToken(),
+		TokenSeq:        int(pb.GetTransaction().GetTokenSeq()),
+		UpdateNum:       int(pb.GetTransaction().GetUpdateNum()),
+		StreamNum:       int(pb.GetReplication().GetStreamNum()),
+		StreamSeq:       int(pb.GetReplication().GetStreamSeq()),
+		JournalSeq:      int(pb.GetReplication().GetJournalSeq()),
+		Partners:        pb.GetTransaction().GetPartners(),
+		TransactionTag:  pb.GetTransaction().GetTransactionTag(),
+		ProcessID:       int16(pb.GetHeader().GetPid()),
+		ClientProcessID: int16(pb.GetHeader().GetClientPid()),
+		NodeValues:      pb.Pieces,
+		TimeStamp:       pb.GetHeader().GetTimeStamp(),
+		Record:          pb.Record,
+	}
+
+	if node := pb.Node; node != nil {
+		event.Global = strings.ToUpper(node.Global)
+		event.Key, event.Subscripts = subscriptsFromProto(node.Subscripts)
+	}
+
+	if pb.Fields != nil {
+		event.Fields = map[string]interface{}{}
+		for name, value := range pb.Fields {
+			event.Fields[name] = fieldValueFromProto(value)
+		}
+	}
+
+	event.PreviousValues = pb.PreviousPieces
+	for _, change := range pb.Changes {
+		event.Changes = append(event.Changes, &PieceChange{
+			Piece: int(change.Piece), Old: change.Old, New: change.New,
+		})
+	}
+	for _, deleted := range pb.Deleted {
+		node := &DeletedNode{NodeValues: deleted.Pieces}
+		node.Key, node.Subscripts = subscriptsFromProto(deleted.Subscripts)
+		event.Deleted = append(event.Deleted, node)
+	}
+
+	return event
+}
+
+// protoSubscripts returns the key and subscripts of the JSON form as subscripts
+func protoSubscripts(key string, subscripts []string) []*cdcpb.Subscript {
+	if key == "" {
+		return nil
+	}
+
+	var pb []*cdcpb.Subscript
+	for _, sub := range append([]string{key}, subscripts...) {
+		// numbers and numeric strings are the same subscript in M
+		canonic, err := canonicNumber(sub)
+		pb = append(pb, &cdcpb.Subscript{
+			Value:   sub,
+			Numeric: err == nil && canonic == sub,
+		})
+	}
+	return pb
+}
+
+// subscriptsFromProto returns the key and the other subscripts
+func subscriptsFromProto(pb []*cdcpb.Subscript) (key string, subscripts []string) {
+	for i, sub := range pb {
+		if i == 0 {
+			key = sub.Value
+		} else {
+			subscripts = append(subscripts, sub.Value)
+		}
+	}
+	return key, subscripts
+}
+
+// ProtoTransactionEvent converts the JSON form of a transaction to protobuf
+func ProtoTransactionEvent(event *TransactionEvent) *cdcpb.TransactionEvent {
+	pb := &cdcpb.TransactionEvent{
+		Operand: event.Operand,
+		Header:  &cdcpb.Header{TimeStamp: event.TimeStamp},
+		Replication: &cdcpb.Replication{
+			StreamNum:  uint32(event.StreamNum),
+			StreamSeq:  uint64(event.StreamSeq),
+			JournalSeq: uint64(event.JournalSeq),
+		},
+		Transaction: &cdcpb.Transaction{
+			TransactionNum: event.TransactionNum,
+			Token:          event.Token,
+			TokenSeq:       uint64(event.TokenSeq),
+			Partners:       event.Partners,
+			TransactionTag: event.TransactionTag,
+		},
+	}
+
+	for _, update := range event.Updates {
+		pb.Updates = append(pb.Updates, ProtoJournalEvent(update))
+	}
+
+	return pb
+}
+
+// TransactionEventFromProto converts a protobuf transaction to the JSON form
+func TransactionEventFromProto(pb *cdcpb.TransactionEvent) *TransactionEvent {
+	event := &TransactionEvent{
+		Operand:        pb.Operand,
+		TransactionNum: pb.GetTransaction().GetTransactionNum(),
+		Token:          pb.GetTransaction().GetToken(),
+		TokenSeq:       int(pb.GetTransaction().GetTokenSeq()),
+		StreamNum:      int(pb.GetReplication().GetStreamNum()),
+		StreamSeq:      int(pb.GetReplication().GetStreamSeq()),
+		JournalSeq:     int(pb.GetReplication().GetJournalSeq()),
+		Partners:       pb.GetTransaction().GetPartners(),
+		TransactionTag: pb.GetTransaction().GetTransactionTag(),
+		TimeStamp:      pb.GetHeader().GetTimeStamp(),
+		Updates:        []*JournalEvent{},
+	}
+
+	for _, update := range pb.Updates {
+		event.Updates = append(event.Updates, JournalEventFromProto(update))
+	}
+
+	return event
+}
+
+// protoFieldValue converts a dictionary field, decimals are json.Number
+func protoFieldValue(value interface{}) *cdcpb.FieldValue {
+	switch v := value.(type) {
+	case string:
+		return &cdcpb.FieldValue{Value: &cdcpb.FieldValue_StringValue{StringValue: v}}
+	case json.Number:
+		return &cdcpb.FieldValue{Value: &cdcpb.FieldValue_DecimalValue{DecimalValue: string(v)}}
+	case int64:
+		return &cdcpb.FieldValue{Value: &cdcpb.FieldValue_IntegerValue{IntegerValue: v}}
+	case bool:
+		return &cdcpb.FieldValue{Value: &cdcpb.FieldValue_BooleanValue{BooleanValue: v}}
+	}
+	return &cdcpb.FieldValue{}
+}
+
+func fieldValueFromProto(value *cdcpb.FieldValue) interface{} {
+	switch v := value.GetValue().(type) {
+	case *cdcpb.FieldValue_StringValue:
+		return v.StringValue
+	case *cdcpb.FieldValue_DecimalValue:
+		return json.Number(v.DecimalValue)
+	case *cdcpb.FieldValue_IntegerValue:
+		return v.IntegerValue
+	case *cdcpb.FieldValue_BooleanValue:
+		return v.BooleanValue
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package gtmcdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"gtmcdc/cdcpb"
+)
+
+func Test_ProtobufEncoder_RoundTrip(t *testing.T) {
+	encoder, err := NewEncoder(&Config{Format: FormatProtobuf})
+	assert.Nil(t, err)
+
+	for _, unit := range testAvroUnits(t) {
+		jsonstr, err := unit.JSON()
+		assert.Nil(t, err)
+
+		msg, err := encoder.Encode(unit)
+		assert.Nil(t, err)
+
+		event, err := DecodeProtobuf([]byte(msg.Value))
+		assert.Nil(t, err)
+
+		decoded, err := json.Marshal(event)
+		assert.Nil(t, err)
+		assert.Equal(t, jsonstr, string(decoded))
+	}
+}
+
+func Test_ProtobufEncoder_Record(t *testing.T) {
+	recs := parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^acn("A1",51,"x")="-.50|65287,62154"`,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN`,
+	)
+
+	msg, err := protobufEncoder{}.Encode(&Unit{Records: recs[:1], done: true})
+	assert.Nil(t, err)
+
+	change := &cdcpb.Change{}
+	assert.Nil(t, proto.Unmarshal([]byte(msg.Value), change))
+
+	event := change.GetRecord()
+	assert.Equal(t, "SET", event.Operand)
+	assert.Equal(t, uint64(28), event.Transaction.TokenSeq)
+	assert.Equal(t, "ACN", event.Node.Global)
+	assert.Equal(t, []string{"A1", "51", "x"}, []string{
+		event.Node.Subscripts[0].Value, event.Node.Subscripts[1].Value, event.Node.Subscripts[2].Value,
+	})
+	assert.Equal(t, []bool{false, true, false}, []bool{
+		event.Node.Subscripts[0].Numeric, event.Node.Subscripts[1].Numeric, event.Node.Subscripts[2].Numeric,
+	})
+	assert.Equal(t, []string{"-.50", "65287,62154"}, event.Pieces)
+	assert.Nil(t, event.Fields)
+
+	// unsubscripted global
+	msg, err = protobufEncoder{}.Encode(&Unit{Records: recs[1:], done: true})
+	assert.Nil(t, err)
+	decoded, err := DecodeProtobuf([]byte(msg.Value))
+	assert.Nil(t, err)
+	assert.Equal(t, recs[1].Event(), decoded)
+
+	_, err = DecodeProtobuf([]byte{0xff})
+	assert.NotNil(t, err)
+}
+
+func Test_ProtoJournalEvent_FromJSON(t *testing.T) {
+	for _, unit := range testAvroUnits(t) {
+		for _, rec := range unit.Records {
+			jsonstr, err := rec.JSON()
+			assert.Nil(t, err)
+
+			// JSON form to protobuf and back
+			event := &JournalEvent{}
+			decoder := json.NewDecoder(bytes.NewReader([]byte(jsonstr)))
+			decoder.UseNumber()
+			assert.Nil(t, decoder.Decode(event))
+
+			data, err := proto.Marshal(ProtoJournalEvent(event))
+			assert.Nil(t, err)
+
+			pb := &cdcpb.JournalEvent{}
+			assert.Nil(t, proto.Unmarshal(data, pb))
+
+			decoded, err := json.Marshal(JournalEventFromProto(pb))
+			assert.Nil(t, err)
+			assert.Equal(t, jsonstr, string(decoded))
+		}
+	}
+
+	fields := ProtoJournalEvent(&JournalEvent{Fields: map[string]interface{}{
+		"a": int64(12), "b": true, "c": nil,
+	}}).Fields
+	assert.Equal(t, int64(12), fields["a"].GetIntegerValue())
+	assert.Equal(t, true, fields["b"].GetBooleanValue())
+	assert.Nil(t, fields["c"].GetValue())
+}
@@ -0,0 +1,171 @@
+package gtmcdc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkRedis is the name of the Redis Streams sink in GTMCDC_SINKS
+const SinkRedis = "redis"
+
+// RedisSink adds every journal record with a global to a Redis stream
+// whose name is rendered from the JournalEvent, gtmcdc:{{.Global}} by
+// default. Each entry has the fields
+//
+//	event        JSON of the journal record
+//	stream_num   replication stream of the record
+//	stream_seq   position of the record in the replication stream
+//	journal_seq  position of the record in the journal
+//
+// so that consumers can discard records resent after a restart. The
+// records of a unit are added in a MULTI/EXEC transaction. When maxLen
+// is greater than 0, streams are trimmed to about maxLen entries.
+type RedisSink struct {
+	client  *redis.Client
+	stream  *NameTemplate
+	maxLen  int64
+	timeout time.Duration
+	metrics *Metrics
+
+	// set when adding to redis failed, redis is checked with
+	// PING before trying again
+	failed int32
+}
+
+// NewRedisSink creates the Redis sink from the configuration
+func NewRedisSink(conf *Config, metrics *Metrics) (*RedisSink, error) {
+	if conf.RedisAddr == "" || conf.RedisAddr == "off" {
+		return nil, errors.New("invalid redis address")
+	}
+
+	stream, err := NewNameTemplate("stream", conf.RedisStream)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:        conf.RedisAddr,
+		Password:    conf.RedisPassword,
+		DB:          conf.RedisDB,
+		DialTimeout: conf.RedisTimeout,
+	})
+
+	return &RedisSink{
+		client:  client,
+		stream:  stream,
+		maxLen:  conf.RedisMaxLen,
+		timeout: conf.RedisTimeout,
+		metrics: metrics,
+	}, nil
+}
+
+// Name returns the name of the sink
+func (r *RedisSink) Name() string {
+	return SinkRedis
+}
+
+// Publish adds the records of the unit to their streams
+func (r *RedisSink) Publish(unit *Unit) error {
+	var args []*redis.XAddArgs
+	for _, rec := range unit.Records {
+		event := rec.Event()
+		if event.Global == "" {
+			// nothing changed in the database
+			log.Debugf("%s without global not added to redis", rec.opcode)
+			continue
+		}
+
+		xadd, err := r.xaddArgs(rec, event)
+		if err != nil {
+			return err
+		}
+		args = append(args, xadd)
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, xadd := range args {
+			pipe.XAdd(ctx, xadd)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Unable to add records to redis. %+v", err)
+		atomic.StoreInt32(&r.failed, 1)
+		r.metrics.IncrCounter("redis_records_not_published")
+		return err
+	}
+
+	for range args {
+		r.metrics.IncrCounter("redis_records_published")
+	}
+	elapsed := time.Since(start)
+	r.metrics.HistoObserve("message_publish_to_redis", float64(elapsed/time.Microsecond))
+
+	return nil
+}
+
+func (r *RedisSink) xaddArgs(rec *JournalRecord, event *JournalEvent) (*redis.XAddArgs, error) {
+	stream, err := r.stream.Execute(event)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonstr, err := rec.JSON()
+	if err != nil {
+		return nil, err
+	}
+
+	streamNum, pos := rec.position()
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: r.maxLen,
+		Approx: r.maxLen > 0,
+		Values: []interface{}{
+			"event", jsonstr,
+			"stream_num", streamNum,
+			"stream_seq", pos.StreamSeq,
+			"journal_seq", pos.JournalSeq,
+		},
+	}, nil
+}
+
+// Flush does nothing because records are added before Publish returns
+func (r *RedisSink) Flush() error {
+	return nil
+}
+
+// Close the connections to redis
+func (r *RedisSink) Close() error {
+	return r.client.Close()
+}
+
+// Healthy returns true unless the last attempt failed
+// and redis does not respond to PING
+func (r *RedisSink) Healthy() bool {
+	if atomic.LoadInt32(&r.failed) == 0 {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	if r.client.Ping(ctx).Err() != nil {
+		return false
+	}
+
+	atomic.StoreInt32(&r.failed, 0)
+	return true
+}
@@ -0,0 +1,71 @@
+package gtmcdc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRedisConfig(addr string) *Config {
+	return &Config{
+		RedisAddr:    addr,
+		RedisStream:  "gtmcdc:{{.Global}}",
+		RedisMaxLen:  2,
+		RedisTimeout: time.Second,
+	}
+}
+
+func Test_DoFilter_Redis(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	metrics := InitMetrics()
+	sink, err := NewRedisSink(testRedisConfig(mr.Addr()), metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	defer sinks.Close()
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	// 4 records added, trimmed to the last 2
+	entries, err := mr.Stream("gtmcdc:ACN")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	fields := map[string]string{}
+	for i := 0; i+1 < len(entries[1].Values); i += 2 {
+		fields[entries[1].Values[i]] = entries[1].Values[i+1]
+	}
+	assert.Equal(t, "0", fields["journal_seq"])
+	assert.Contains(t, fields["event"], `"global":"ACN"`)
+}
+
+func Test_RedisSink_Unavailable(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	sink, err := NewRedisSink(testRedisConfig(mr.Addr()), InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	unit := &Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`), done: true}
+	mr.SetError("server is down")
+	assert.NotNil(t, sink.Publish(unit))
+	assert.False(t, sink.Healthy())
+
+	mr.SetError("")
+	assert.True(t, sink.Healthy())
+	assert.Nil(t, sink.Publish(unit))
+
+	_, err = NewRedisSink(&Config{RedisAddr: "off"}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRedisSink(&Config{RedisAddr: mr.Addr(), RedisStream: "{{.Global"}, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,260 @@
+package gtmcdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error Messages
+const (
+	ErrorSchemaNotFound = "schema not found"
+)
+
+const (
+	registryContentType = "application/vnd.schemaregistry.v1+json"
+	registryFile        = "schemas.json"
+)
+
+// SchemaRegistry registers schemas under a subject and looks up schemas
+// by id, as the Confluent Schema Registry does
+type SchemaRegistry interface {
+	Register(subject, schema string) (int, error)
+	Schema(id int) (string, error)
+}
+
+// NewSchemaRegistry returns the registry in the configuration, the Schema
+// Registry REST API for a http or https URL, otherwise a file registry
+// in the directory. The file registry is used instead of a Schema Registry
+// for offline testing, not when the Schema Registry is unavailable because
+// its ids are not the ids of the Schema Registry.
+func NewSchemaRegistry(conf *Config) (SchemaRegistry, error) {
+	location := conf.SchemaRegistry
+	switch {
+	case location == "" || location == "off":
+		return nil, errors.New("invalid schema registry")
+
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		return &httpSchemaRegistry{
+			url:      strings.TrimSuffix(location, "/"),
+			user:     conf.SchemaRegistryUser,
+			password: conf.SchemaRegistryPassword,
+			client:   &http.Client{Timeout: 10 * time.Second},
+			ids:      map[string]int{},
+			schemas:  map[int]string{},
+		}, nil
+	}
+
+	return OpenFileSchemaRegistry(strings.TrimPrefix(location, "file://"))
+}
+
+// httpSchemaRegistry uses the Schema Registry REST API,
+// ids and schemas are cached
+type httpSchemaRegistry struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	ids     map[string]int // subject and schema
+	schemas map[int]string
+}
+
+func (r *httpSchemaRegistry) Register(subject, schema string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, exists := r.ids[subject+"\n"+schema]; exists {
+		return id, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"schema": schema})
+	var result struct {
+		ID int `json:"id"`
+	}
+	err := r.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &result)
+	if err != nil {
+		return 0, err
+	}
+
+	r.ids[subject+"\n"+schema] = result.ID
+	r.schemas[result.ID] = schema
+	return result.ID, nil
+}
+
+func (r *httpSchemaRegistry) Schema(id int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if schema, exists := r.schemas[id]; exists {
+		return schema, nil
+	}
+
+	var result struct {
+		Schema string `json:"schema"`
+	}
+	if err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &result); err != nil {
+		return "", err
+	}
+
+	r.schemas[id] = result.Schema
+	return result.Schema, nil
+}
+
+func (r *httpSchemaRegistry) do(method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return &registryUnavailable{err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var registryErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &registryErr)
+		err := fmt.Errorf("schema registry returned %s. %s", resp.Status, registryErr.Message)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s. %s", ErrorSchemaNotFound, registryErr.Message)
+		case http.StatusConflict, http.StatusUnprocessableEntity:
+			// the schema is incompatible or invalid
+			return err
+		}
+		return &registryUnavailable{err: err}
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// registryUnavailable is a failure of the Schema Registry that
+// may succeed when it is retried later
+type registryUnavailable struct {
+	err error
+}
+
+func (e *registryUnavailable) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryUnavailable) Unwrap() error {
+	return e.err
+}
+
+// isRegistryUnavailable returns true if the request to the
+// Schema Registry can be retried
+func isRegistryUnavailable(err error) bool {
+	var unavailable *registryUnavailable
+	return errors.As(err, &unavailable)
+}
+
+// FileSchemaRegistry keeps the schemas in schemas.json in a directory,
+// for testing and running without a schema registry. Like the Schema
+// Registry, the same schema has the same id under all subjects.
+type FileSchemaRegistry struct {
+	Schemas []*RegisteredSchema `json:"schemas"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// RegisteredSchema is a schema in the FileSchemaRegistry
+type RegisteredSchema struct {
+	ID       int      `json:"id"`
+	Subjects []string `json:"subjects"`
+	Schema   string   `json:"schema"`
+}
+
+// OpenFileSchemaRegistry loads the schemas in the directory
+func OpenFileSchemaRegistry(dir string) (*FileSchemaRegistry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &FileSchemaRegistry{path: filepath.Join(dir, registryFile)}
+	data, err := ioutil.ReadFile(r.path)
+	switch {
+	case os.IsNotExist(err):
+		return r, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Register returns the id of the schema, the schema is added
+// to the file if it is not registered under the subject
+func (r *FileSchemaRegistry) Register(subject, schema string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var registered *RegisteredSchema
+	for _, s := range r.Schemas {
+		if s.Schema == schema {
+			registered = s
+			break
+		}
+	}
+
+	if registered == nil {
+		registered = &RegisteredSchema{ID: len(r.Schemas) + 1, Schema: schema}
+		r.Schemas = append(r.Schemas, registered)
+	}
+
+	for _, s := range registered.Subjects {
+		if s == subject {
+			return registered.ID, nil
+		}
+	}
+	registered.Subjects = append(registered.Subjects, subject)
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	return registered.ID, writeFileAtomic(r.path, data)
+}
+
+// Schema returns the schema with the id
+func (r *FileSchemaRegistry) Schema(id int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > len(r.Schemas) {
+		return "", errors.New(ErrorSchemaNotFound)
+	}
+	return r.Schemas[id-1].Schema, nil
+}
@@ -0,0 +1,117 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSchemaRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry, err := NewSchemaRegistry(&Config{SchemaRegistry: "file://" + dir})
+	assert.Nil(t, err)
+
+	id, err := registry.Register("a-value", `"string"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, id)
+
+	// same schema under another subject has the same id
+	id, err = registry.Register("b-value", `"string"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, id)
+
+	id, err = registry.Register("a-value", `"long"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, id)
+
+	reopened, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a-value", "b-value"}, reopened.Schemas[0].Subjects)
+
+	schema, err := reopened.Schema(2)
+	assert.Nil(t, err)
+	assert.Equal(t, `"long"`, schema)
+
+	_, err = reopened.Schema(3)
+	assert.Equal(t, ErrorSchemaNotFound, err.Error())
+}
+
+func Test_HTTPSchemaRegistry(t *testing.T) {
+	var schemas []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, _ := r.BasicAuth()
+		if user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/subjects/cdc-gtmcdc.JournalEvent/versions":
+			assert.Equal(t, registryContentType, r.Header.Get("Content-Type"))
+			var body map[string]string
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			schemas = append(schemas, body["schema"])
+			fmt.Fprintf(w, `{"id":%d}`, 100+len(schemas))
+
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+			var id int
+			fmt.Sscanf(r.URL.Path, "/schemas/ids/%d", &id)
+			if id <= 100 || id > 100+len(schemas) {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error_code":40403,"message":"Schema not found"}`)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"schema": schemas[id-101]})
+
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	registry, err := NewSchemaRegistry(&Config{
+		SchemaRegistry:         server.URL,
+		SchemaRegistryUser:     "user",
+		SchemaRegistryPassword: "secret",
+	})
+	assert.Nil(t, err)
+
+	id, err := registry.Register("cdc-gtmcdc.JournalEvent", `"string"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, id)
+
+	// cached
+	id, err = registry.Register("cdc-gtmcdc.JournalEvent", `"string"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, id)
+	schema, err := registry.Schema(101)
+	assert.Nil(t, err)
+	assert.Equal(t, `"string"`, schema)
+	assert.Equal(t, 1, requests)
+
+	_, err = registry.Schema(200)
+	assert.True(t, strings.HasPrefix(err.Error(), ErrorSchemaNotFound))
+
+	_, err = registry.Register("other", `"string"`)
+	assert.NotNil(t, err)
+
+	unauthorized, err := NewSchemaRegistry(&Config{SchemaRegistry: server.URL})
+	assert.Nil(t, err)
+	_, err = unauthorized.Schema(101)
+	assert.NotNil(t, err)
+
+	_, err = NewSchemaRegistry(&Config{SchemaRegistry: "off"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,113 @@
+package gtmcdc
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// configureTLS enables TLS on the sarama config when GTMCDC_KAFKA_TLS is set.
+// The CA file is used to verify the brokers instead of the system CA pool,
+// the client certificate and key are used for mutual TLS authentication
+func configureTLS(config *sarama.Config, conf *Config) error {
+	if !conf.KafkaTLS {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		// #nosec G402 skipping verification is only for testing environments
+		InsecureSkipVerify: conf.KafkaTLSSkipVerify,
+	}
+
+	if conf.KafkaTLSCA != "" {
+		pem, err := ioutil.ReadFile(conf.KafkaTLSCA)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + conf.KafkaTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.KafkaTLSCert != "" || conf.KafkaTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.KafkaTLSCert, conf.KafkaTLSKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+
+	return nil
+}
+
+// configureSASL enables SASL authentication on the sarama config when
+// GTMCDC_KAFKA_SASL_MECHANISM is one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+func configureSASL(config *sarama.Config, conf *Config) error {
+	mechanism := strings.ToUpper(conf.KafkaSASLMechanism)
+
+	switch mechanism {
+	case "", "OFF":
+		return nil
+
+	case sarama.SASLTypePlaintext:
+
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha256.New}
+		}
+
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha512.New}
+		}
+
+	default:
+		return errors.New("unsupported SASL mechanism " + conf.KafkaSASLMechanism)
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	config.Net.SASL.User = conf.KafkaSASLUser
+	config.Net.SASL.Password = conf.KafkaSASLPassword
+
+	return nil
+}
+
+// scramClient implements sarama.SCRAMClient
+type scramClient struct {
+	hashGenerator func() hash.Hash
+	conversation  *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := scram.HashGeneratorFcn(c.hashGenerator).NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
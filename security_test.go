@@ -0,0 +1,127 @@
+package gtmcdc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate writes a self signed certificate and its key to dir
+func testCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gtmcdc"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func Test_configureTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := testCertificate(t, dir)
+
+	config := sarama.NewConfig()
+	assert.Nil(t, configureTLS(config, &Config{}))
+	assert.False(t, config.Net.TLS.Enable)
+
+	conf := &Config{
+		KafkaTLS:     true,
+		KafkaTLSCA:   certFile,
+		KafkaTLSCert: certFile,
+		KafkaTLSKey:  keyFile,
+	}
+	assert.Nil(t, configureTLS(config, conf))
+	assert.True(t, config.Net.TLS.Enable)
+	assert.NotNil(t, config.Net.TLS.Config.RootCAs)
+	assert.Equal(t, 1, len(config.Net.TLS.Config.Certificates))
+	assert.False(t, config.Net.TLS.Config.InsecureSkipVerify)
+
+	// key file is not a certificate
+	conf.KafkaTLSCA = keyFile
+	assert.NotNil(t, configureTLS(sarama.NewConfig(), conf))
+
+	conf.KafkaTLSCA = filepath.Join(dir, "no_such_file")
+	assert.NotNil(t, configureTLS(sarama.NewConfig(), conf))
+
+	conf.KafkaTLSCA = ""
+	conf.KafkaTLSKey = ""
+	assert.NotNil(t, configureTLS(sarama.NewConfig(), conf))
+}
+
+func Test_configureSASL(t *testing.T) {
+	config := sarama.NewConfig()
+	assert.Nil(t, configureSASL(config, &Config{KafkaSASLMechanism: "off"}))
+	assert.False(t, config.Net.SASL.Enable)
+
+	for _, mechanism := range []string{"PLAIN", "scram-sha-256", "SCRAM-SHA-512"} {
+		config := sarama.NewConfig()
+		conf := &Config{
+			KafkaSASLMechanism: mechanism,
+			KafkaSASLUser:      "user",
+			KafkaSASLPassword:  "secret",
+		}
+		assert.Nil(t, configureSASL(config, conf))
+		assert.True(t, config.Net.SASL.Enable)
+		assert.Equal(t, strings.ToUpper(mechanism), string(config.Net.SASL.Mechanism))
+		assert.Equal(t, "user", config.Net.SASL.User)
+		assert.Nil(t, config.Validate())
+	}
+
+	assert.NotNil(t, configureSASL(sarama.NewConfig(), &Config{KafkaSASLMechanism: "GSSAPI"}))
+}
+
+func Test_scramClient(t *testing.T) {
+	config := sarama.NewConfig()
+	assert.Nil(t, configureSASL(config, &Config{KafkaSASLMechanism: "SCRAM-SHA-256"}))
+
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	assert.Nil(t, client.Begin("user", "secret", ""))
+
+	first, err := client.Step("")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(first, "n,,n=user,r="))
+	assert.False(t, client.Done())
+
+	// server first message with a different nonce is rejected
+	_, err = client.Step("r=bogus,s=c2FsdA==,i=4096")
+	assert.NotNil(t, err)
+}
+
+func Test_Config_String(t *testing.T) {
+	conf := &Config{KafkaSASLUser: "user", KafkaSASLPassword: "secret"}
+	assert.NotContains(t, conf.String(), "secret")
+	assert.Contains(t, conf.String(), "KafkaSASLUser:user")
+}
@@ -0,0 +1,304 @@
+package gtmcdc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Error Messages
+const (
+	ErrorSinkUnavailable = "sink not available"
+)
+
+// Sink is a destination of the change events
+type Sink interface {
+	// Name identifies the sink in configurations, logs and metrics
+	Name() string
+	// Publish publishes a committed unit and returns once
+	// the destination accepted it
+	Publish(unit *Unit) error
+	// Flush returns once everything published is delivered
+	Flush() error
+	// Close releases the resources used by the sink
+	Close() error
+	// Healthy returns true if the sink can accept units, it is called
+	// before every unit and probes the destination only after a failure
+	Healthy() bool
+}
+
+// AsyncSink is a sink that can publish a unit without waiting for the
+// destination to accept it. track is called before each message is sent
+// and blocks while too many messages are in flight. ack is called once for
+// each tracked message when it is accepted, or failed when err is not nil.
+type AsyncSink interface {
+	Sink
+	IsAsync() bool
+	PublishAsync(unit *Unit, track func(), ack func(err error))
+}
+
+// ReplicaSink is a sink that keeps a replica of the globals. It gets all
+// units, including those suppressed by the ChangeDetector, so that no SET
+// is missing from the replica.
+type ReplicaSink interface {
+	Sink
+	IsReplica() bool
+}
+
+// isReplica returns true if the sink is a ReplicaSink
+func isReplica(sink Sink) bool {
+	replica, ok := sink.(ReplicaSink)
+	return ok && replica.IsReplica()
+}
+
+// Failure policies decide what happens to a unit when a sink fails to publish it
+//
+//	require  the unit is published again up to the retries of the fanout,
+//	         the filter stops without forwarding it if it still fails
+//	ignore   the failure is logged and counted only
+//	stop     the filter stops without forwarding the unit
+//
+// A unit is never forwarded after a failure of a sink whose policy is not
+// ignore, otherwise the checkpoint would move past it with the next unit
+// and the event would be lost. Sinks in async mode, or with a spool, are
+// not retried by the fanout since they retry on their own.
+const (
+	FailureRequire = "require"
+	FailureIgnore  = "ignore"
+	FailureStop    = "stop"
+)
+
+// SinkError is returned when a sink fails to publish a unit
+type SinkError struct {
+	Sink   string
+	Policy string
+	Err    error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("sink %s failed: %v", e.Sink, e.Err)
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// IsStop returns true if the error requires the filter to stop
+func IsStop(err error) bool {
+	var serr *SinkError
+	return errors.As(err, &serr) && serr.Policy != FailureIgnore
+}
+
+// ParseSinkSpec parses a sink in GTMCDC_SINKS, which is the name of the
+// sink optionally followed by the failure policy, e.g. kafka:require
+func ParseSinkSpec(spec string) (name, policy string, err error) {
+	name, policy = strings.TrimSpace(spec), FailureRequire
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, policy = name[:i], name[i+1:]
+	}
+
+	if name == "" {
+		return "", "", errors.New("empty sink name in " + spec)
+	}
+
+	switch policy {
+	case FailureRequire, FailureIgnore, FailureStop:
+		return name, policy, nil
+	}
+
+	return "", "", errors.New("invalid failure policy " + policy)
+}
+
+type sinkEntry struct {
+	sink   Sink
+	policy string
+}
+
+// Fanout publishes every unit to all of its sinks, each with its own
+// failure policy. A sink with the require policy is retried Retries
+// times, RetryBackoff after the failure and twice as long every time.
+type Fanout struct {
+	Retries      int
+	RetryBackoff time.Duration
+
+	sinks   []*sinkEntry
+	metrics *Metrics
+}
+
+// NewFanout returns a Fanout without sinks
+func NewFanout(metrics *Metrics) *Fanout {
+	return &Fanout{metrics: metrics}
+}
+
+// Add a sink with the failure policy
+func (f *Fanout) Add(sink Sink, policy string) {
+	f.sinks = append(f.sinks, &sinkEntry{sink: sink, policy: policy})
+}
+
+// Len returns the number of sinks
+func (f *Fanout) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.sinks)
+}
+
+// IsAsync returns true if any of the sinks publishes asynchronously
+func (f *Fanout) IsAsync() bool {
+	if f == nil {
+		return false
+	}
+
+	for _, entry := range f.sinks {
+		if async, ok := entry.sink.(AsyncSink); ok && async.IsAsync() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Publish publishes the unit to all sinks and returns the first failure
+// of the sinks whose policy is not ignore
+func (f *Fanout) Publish(unit *Unit) error {
+	if f == nil {
+		return nil
+	}
+
+	var result error
+	for _, entry := range f.sinks {
+		err := f.check(entry, f.publishRetry(entry, unit))
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// PublishAsync publishes the unit to all sinks. Sync sinks are acknowledged
+// as soon as they return, the failures are reported to ack as in Publish
+func (f *Fanout) PublishAsync(unit *Unit, track func(), ack func(err error)) {
+	if f == nil {
+		return
+	}
+
+	for _, entry := range f.sinks {
+		entry := entry
+		if f.skip(entry, unit) {
+			continue
+		}
+
+		async, ok := entry.sink.(AsyncSink)
+		if !ok || !async.IsAsync() || !async.Healthy() {
+			track()
+			ack(f.check(entry, f.publishRetry(entry, unit)))
+			continue
+		}
+
+		async.PublishAsync(unit, track, func(err error) {
+			ack(f.check(entry, err))
+		})
+	}
+}
+
+// skip returns true if the unit is suppressed by the ChangeDetector
+// and the sink is not a replica
+func (f *Fanout) skip(entry *sinkEntry, unit *Unit) bool {
+	return unit.isSuppressed() && !isReplica(entry.sink)
+}
+
+// publishRetry publishes the unit and retries a sink with the require policy
+func (f *Fanout) publishRetry(entry *sinkEntry, unit *Unit) error {
+	err := f.publish(entry, unit)
+
+	backoff := f.RetryBackoff
+	for i := 0; err != nil && entry.policy == FailureRequire && i < f.Retries; i++ {
+		name := entry.sink.Name()
+		log.Warnf("sink %s failed, retry in %v. %+v", name, backoff, err)
+		f.metrics.IncrCounter("sink_" + name + "_retries")
+
+		time.Sleep(backoff)
+		backoff *= 2
+		err = f.publish(entry, unit)
+	}
+
+	return err
+}
+
+func (f *Fanout) publish(entry *sinkEntry, unit *Unit) error {
+	if f.skip(entry, unit) {
+		return nil
+	}
+	if !entry.sink.Healthy() {
+		return errors.New(ErrorSinkUnavailable)
+	}
+	return entry.sink.Publish(unit)
+}
+
+// check applies the failure policy of the sink to the error
+func (f *Fanout) check(entry *sinkEntry, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	name := entry.sink.Name()
+	f.metrics.IncrCounter("sink_" + name + "_failures")
+
+	if entry.policy == FailureIgnore {
+		log.Debugf("failure of sink %s ignored. %+v", name, err)
+		return nil
+	}
+
+	return &SinkError{Sink: name, Policy: entry.policy, Err: err}
+}
+
+// Flush all sinks and returns the first error
+func (f *Fanout) Flush() error {
+	if f == nil {
+		return nil
+	}
+
+	var result error
+	for _, entry := range f.sinks {
+		if err := entry.sink.Flush(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// Close all sinks in reverse order and returns the first error
+func (f *Fanout) Close() error {
+	if f == nil {
+		return nil
+	}
+
+	var result error
+	for i := len(f.sinks) - 1; i >= 0; i-- {
+		if err := f.sinks[i].sink.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// Healthy returns true if all sinks whose failures are not ignored are healthy
+func (f *Fanout) Healthy() bool {
+	if f == nil {
+		return true
+	}
+
+	for _, entry := range f.sinks {
+		if entry.policy != FailureIgnore && !entry.sink.Healthy() {
+			return false
+		}
+	}
+
+	return true
+}
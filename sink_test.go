@@ -0,0 +1,111 @@
+package gtmcdc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSink records the units published to it and fails
+// the units from the failAt-th one on
+type testSink struct {
+	name   string
+	failAt int
+	units  []*Unit
+	closed bool
+}
+
+func (s *testSink) Name() string { return s.name }
+
+func (s *testSink) Publish(unit *Unit) error {
+	s.units = append(s.units, unit)
+	if s.failAt > 0 && len(s.units) >= s.failAt {
+		return errors.New("publish failed")
+	}
+	return nil
+}
+
+func (s *testSink) Flush() error  { return nil }
+func (s *testSink) Close() error  { s.closed = true; return nil }
+func (s *testSink) Healthy() bool { return true }
+
+// testKafkaSinks returns a fanout with only the Kafka sink using the producer
+func testKafkaSinks(producer *Producer, metrics *Metrics) *Fanout {
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{Producer: producer, Metrics: metrics}, FailureRequire)
+	return sinks
+}
+
+func Test_ParseSinkSpec(t *testing.T) {
+	name, policy, err := ParseSinkSpec("kafka")
+	assert.Nil(t, err)
+	assert.Equal(t, "kafka", name)
+	assert.Equal(t, FailureRequire, policy)
+
+	name, policy, err = ParseSinkSpec(" file:ignore")
+	assert.Nil(t, err)
+	assert.Equal(t, "file", name)
+	assert.Equal(t, FailureIgnore, policy)
+
+	_, _, err = ParseSinkSpec("kafka:sometimes")
+	assert.NotNil(t, err)
+
+	_, _, err = ParseSinkSpec(":stop")
+	assert.NotNil(t, err)
+}
+
+func Test_Fanout_Policy(t *testing.T) {
+	metrics := InitMetrics()
+	unit := &Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`), done: true}
+
+	required, ignored := &testSink{name: "required", failAt: 1}, &testSink{name: "ignored", failAt: 1}
+	sinks := NewFanout(metrics)
+	sinks.Retries = 2
+	sinks.Add(ignored, FailureIgnore)
+	assert.Nil(t, sinks.Publish(unit))
+
+	// the required sink is retried and then stops the filter
+	sinks.Add(required, FailureRequire)
+	err := sinks.Publish(unit)
+	assert.NotNil(t, err)
+	assert.True(t, IsStop(err))
+	assert.Equal(t, 2.0, metrics.GetCounterValue("sink_required_retries"))
+
+	// every sink receives the unit even if an earlier one fails
+	assert.Equal(t, 2, len(ignored.units))
+	assert.Equal(t, 3, len(required.units))
+
+	sinks.Add(&testSink{name: "stop", failAt: 1}, FailureStop)
+	assert.True(t, IsStop(sinks.Publish(unit)))
+
+	assert.Nil(t, sinks.Close())
+	assert.True(t, ignored.closed && required.closed)
+}
+
+func Test_DoFilter_FanoutStop(t *testing.T) {
+	metrics := InitMetrics()
+
+	// the single SET, which is the 2nd unit, stops the filter
+	audit, stop := &testSink{name: "audit"}, &testSink{name: "stop", failAt: 2}
+	sinks := NewFanout(metrics)
+	sinks.Add(audit, FailureRequire)
+	sinks.Add(stop, FailureStop)
+
+	output, err := testTempFileWithContent([]byte(""))
+	assert.Nil(t, err)
+	defer os.Remove(output)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", output)
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+	_ = fout.Close()
+
+	assert.Equal(t, 2, len(audit.units))
+
+	// only the lines of the first transaction are forwarded
+	actual, _ := ioutil.ReadFile(output)
+	assert.Equal(t, 4, strings.Count(string(actual), "\n"))
+}
@@ -0,0 +1,481 @@
+package gtmcdc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Error Messages
+const (
+	ErrorSpoolCorrupted = "spool record is corrupted"
+)
+
+const (
+	spoolSegmentExt    = ".seg"
+	spoolHeaderSize    = 16
+	spoolMaxRecordSize = 64 * 1024 * 1024
+)
+
+// Spool is a write-ahead log on local disk that stores messages that
+// cannot be published to Kafka. The spool consists of segment files,
+// each record in a segment is written as
+//
+//	length (4 bytes) | crc32 (4 bytes) | timestamp (8 bytes) | messages
+//
+// where messages is a JSON array of the messages of one unit, which are
+// published together, and crc32 covers the timestamp and the messages.
+// Records are replayed to Kafka in the same order they were written by a
+// background drainer.
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	metrics     *Metrics
+
+	segments []int64 // indexes of segment files, oldest first
+	writer   *os.File
+	written  int64 // size of the segment being written
+
+	reader   *os.File
+	readSeg  int64
+	readNext *spoolRecord // record at the head of the spool, if read already
+
+	depth int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type spoolRecord struct {
+	timestamp time.Time
+	message   []byte
+}
+
+// OpenSpool opens the spool in directory dir, the directory is created
+// if it does not exist. Records left in the spool from previous runs
+// will be drained once the drainer is started
+func OpenSpool(dir string, segmentSize int64, metrics *Metrics) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		metrics:     metrics,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		var idx int64
+		if _, err := fmt.Sscanf(f.Name(), "%016d"+spoolSegmentExt, &idx); err == nil {
+			s.segments = append(s.segments, idx)
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	for _, idx := range s.segments {
+		n, err := countSpoolRecords(s.segmentPath(idx))
+		if err != nil {
+			log.Warnf("spool segment %d: %+v", idx, err)
+		}
+		s.depth += n
+	}
+
+	if s.depth == 0 {
+		s.removeAll()
+	} else {
+		log.Infof("spool has %d records from previous run", s.depth)
+	}
+
+	s.updateMetrics()
+
+	return s, nil
+}
+
+// Depth returns number of records in the spool
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.depth
+}
+
+// Publish publishes the messages with the producer when the spool
+// is empty. Otherwise, or when the publish fails, the messages are written
+// to the spool so that the order of messages is kept. spooled is true if the
+// messages are in the spool.
+func (s *Spool) Publish(producer *Producer, messages ...*Message) (spooled bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth == 0 && producer.IsKafkaAvailable() {
+		if err = producer.PublishMessages(messages); err == nil {
+			return false, nil
+		}
+		log.Infof("message will be spooled. %+v", err)
+	}
+
+	if err = s.write(messages); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Write appends the messages to the spool as one record
+// without trying to publish them
+func (s *Spool) Write(messages ...*Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(messages)
+}
+
+func (s *Spool) write(messages []*Message) error {
+	bytes, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	return s.append(bytes)
+}
+
+// StartDrainer starts a background goroutine that publishes the records
+// in the spool to Kafka every interval, until Close is called.
+func (s *Spool) StartDrainer(producer *Producer, interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				n, err := s.Drain(producer)
+				if n > 0 || err != nil {
+					log.Infof("drained %d records from spool. %+v", n, err)
+				}
+			}
+		}
+	}()
+}
+
+// Drain publishes records in the spool in order until the spool is empty
+// or publish fails. It returns the number of records published
+func (s *Spool) Drain(producer *Producer) (int, error) {
+	count := 0
+	for {
+		published, err := s.drainOne(producer)
+		if err != nil || !published {
+			return count, err
+		}
+		count++
+	}
+}
+
+// drainOne holds the lock for one record only so that Publish is not
+// blocked for the whole duration of draining
+func (s *Spool) drainOne(producer *Producer) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth == 0 {
+		return false, nil
+	}
+
+	if producer == nil {
+		return false, errors.New("producer not available")
+	}
+
+	if !producer.IsKafkaAvailable() {
+		if err := producer.Connect(); err != nil {
+			return false, err
+		}
+	}
+
+	rec, err := s.peek()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var messages []*Message
+	if err := json.Unmarshal(rec.message, &messages); err != nil {
+		// nothing can be done about it, skip the record
+		log.Errorf("spooled message cannot be decoded, skipped. %+v", err)
+		s.metrics.IncrCounter("spool_records_corrupted")
+		s.advance()
+		return true, nil
+	}
+
+	if err := producer.PublishMessages(messages); err != nil {
+		return false, err
+	}
+
+	s.metrics.IncrCounter("spool_records_drained")
+	s.advance()
+
+	return true, nil
+}
+
+// Close stops the drainer and closes the spool files
+func (s *Spool) Close() {
+	if s == nil {
+		return
+	}
+
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeReader()
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+}
+
+func (s *Spool) segmentPath(idx int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d"+spoolSegmentExt, idx))
+}
+
+// append writes a record to the last segment and sync it to disk
+func (s *Spool) append(message []byte) error {
+	if s.writer == nil || s.written >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, spoolHeaderSize+len(message))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(message)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+	copy(buf[spoolHeaderSize:], message)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+
+	if _, err := s.writer.Write(buf); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+
+	s.written += int64(len(buf))
+	s.depth++
+	s.metrics.IncrCounter("spool_records_written")
+	s.updateMetrics()
+
+	return nil
+}
+
+// rotate closes the current segment and starts a new one
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+
+	idx := int64(1)
+	if len(s.segments) > 0 {
+		idx = s.segments[len(s.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(idx), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.writer = f
+	s.written = 0
+	s.segments = append(s.segments, idx)
+
+	return syncDir(s.dir)
+}
+
+// peek returns the record at the head of the spool without removing it
+func (s *Spool) peek() (*spoolRecord, error) {
+	for s.readNext == nil {
+		if len(s.segments) == 0 {
+			s.depth = 0
+			return nil, io.EOF
+		}
+
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(s.segments[0]))
+			if err != nil {
+				return nil, err
+			}
+			s.reader = f
+			s.readSeg = s.segments[0]
+		}
+
+		rec, err := readSpoolRecord(s.reader)
+		if err == nil {
+			s.readNext = rec
+			break
+		}
+
+		if err != io.EOF {
+			// the rest of the segment cannot be trusted, e.g. the
+			// filter crashed in the middle of writing a record
+			log.Errorf("spool segment %d: %+v, rest of segment skipped", s.readSeg, err)
+			s.metrics.IncrCounter("spool_records_corrupted")
+		}
+
+		if s.writer != nil && s.segments[0] == s.segments[len(s.segments)-1] {
+			// reached the end of the segment being written
+			s.depth = 0
+			return nil, io.EOF
+		}
+
+		s.closeReader()
+		_ = os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+
+	return s.readNext, nil
+}
+
+// advance removes the record at the head of the spool
+func (s *Spool) advance() {
+	s.readNext = nil
+	s.depth--
+
+	if s.depth <= 0 {
+		s.depth = 0
+		s.removeAll()
+	}
+
+	s.updateMetrics()
+}
+
+// removeAll deletes all segment files once the spool is fully drained
+func (s *Spool) removeAll() {
+	s.closeReader()
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+
+	for _, idx := range s.segments {
+		_ = os.Remove(s.segmentPath(idx))
+	}
+	s.segments = nil
+}
+
+func (s *Spool) closeReader() {
+	if s.reader != nil {
+		_ = s.reader.Close()
+		s.reader = nil
+	}
+	s.readNext = nil
+}
+
+func (s *Spool) updateMetrics() {
+	s.metrics.SetGauge("spool_depth", float64(s.depth))
+
+	age := 0.0
+	if s.depth > 0 {
+		if rec, err := s.peek(); err == nil {
+			age = time.Since(rec.timestamp).Seconds()
+		}
+	}
+	s.metrics.SetGauge("spool_oldest_record_age_seconds", age)
+}
+
+func readSpoolRecord(r io.Reader) (*spoolRecord, error) {
+	header := make([]byte, spoolHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New(ErrorSpoolCorrupted)
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > spoolMaxRecordSize {
+		return nil, errors.New(ErrorSpoolCorrupted)
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, errors.New(ErrorSpoolCorrupted)
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[8:16])
+	_, _ = crc.Write(message)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New(ErrorSpoolCorrupted)
+	}
+
+	return &spoolRecord{
+		timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))),
+		message:   message,
+	}, nil
+}
+
+// countSpoolRecords returns the number of valid records in a segment file
+func countSpoolRecords(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	count := 0
+	for {
+		_, err := readSpoolRecord(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// syncDir flushes directory entries to disk so that a newly
+// created file survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,162 @@
+package gtmcdc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool_test")
+	assert.Nil(t, err)
+	return dir
+}
+
+func Test_Spool_PublishAndDrain(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	spool, err := OpenSpool(dir, 64, metrics)
+	assert.Nil(t, err)
+	defer spool.Close()
+
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{syncProducer: sp, topic: "spool"}
+	defer producer.CleanupProducer()
+
+	// first message fails and is spooled, the following ones must
+	// be spooled too in order to keep the order
+	sp.ExpectSendMessageAndFail(errors.New("send message failed"))
+	for _, msg := range []string{"msg1", "msg2", "msg3"} {
+		spooled, err := spool.Publish(producer, &Message{Value: msg})
+		assert.Nil(t, err)
+		assert.True(t, spooled)
+	}
+	assert.Equal(t, 3, spool.Depth())
+	assert.Equal(t, 3.0, metrics.GetGaugeValue("spool_depth"))
+
+	var drained []string
+	checker := func(val []byte) error {
+		drained = append(drained, string(val))
+		return nil
+	}
+	sp.ExpectSendMessageWithCheckerFunctionAndSucceed(checker)
+	sp.ExpectSendMessageWithCheckerFunctionAndFail(checker, errors.New("send message failed"))
+
+	n, err := spool.Drain(producer)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, spool.Depth())
+
+	sp.ExpectSendMessageWithCheckerFunctionAndSucceed(checker)
+	sp.ExpectSendMessageWithCheckerFunctionAndSucceed(checker)
+
+	n, err = spool.Drain(producer)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, spool.Depth())
+	assert.Equal(t, []string{"msg1", "msg2", "msg2", "msg3"}, drained)
+
+	// the spool is empty, message is published directly
+	sp.ExpectSendMessageAndSucceed()
+	spooled, err := spool.Publish(producer, &Message{Value: "msg4"})
+	assert.Nil(t, err)
+	assert.False(t, spooled)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func Test_Spool_Reopen(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	spool, err := OpenSpool(dir, 40, metrics)
+	assert.Nil(t, err)
+
+	// producer without kafka connection
+	producer := &Producer{}
+	for _, msg := range []string{"msg1", "msg2", "msg3"} {
+		_, err := spool.Publish(producer, &Message{Value: msg})
+		assert.Nil(t, err)
+	}
+	spool.Close()
+
+	// 2 records fit in one segment
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 2, len(files))
+
+	// corrupt the last record
+	last := filepath.Join(dir, files[1].Name())
+	content, _ := ioutil.ReadFile(last)
+	content[len(content)-1] = 'x'
+	assert.Nil(t, ioutil.WriteFile(last, content, 0644))
+
+	spool, err = OpenSpool(dir, 40, metrics)
+	assert.Nil(t, err)
+	defer spool.Close()
+	assert.Equal(t, 2, spool.Depth())
+
+	sp := mocks.NewSyncProducer(t, nil)
+	producer.syncProducer = sp
+	defer producer.CleanupProducer()
+
+	var drained []string
+	checker := func(val []byte) error {
+		drained = append(drained, string(val))
+		return nil
+	}
+	sp.ExpectSendMessageWithCheckerFunctionAndSucceed(checker)
+	sp.ExpectSendMessageWithCheckerFunctionAndSucceed(checker)
+
+	n, err := spool.Drain(producer)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"msg1", "msg2"}, drained)
+	assert.Equal(t, 0, spool.Depth())
+}
+
+func Test_DoFilter_Spool(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	spool, err := OpenSpool(dir, 1024, metrics)
+	assert.Nil(t, err)
+	defer spool.Close()
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	sp := mocks.NewSyncProducer(t, config)
+	producer := &Producer{syncProducer: sp, topic: "spool"}
+	defer producer.CleanupProducer()
+
+	sp.ExpectSendMessageAndSucceed()
+	sp.ExpectSendMessageAndFail(errors.New("send message failed"))
+
+	counters := []string{
+		"lines_output_written",
+		"lines_parsed_and_published",
+		"lines_parsed_and_spooled",
+	}
+	prevValues := getCounters(metrics, counters)
+
+	fin, fout := InitInputAndOutput("testdata/test1.txt", nullFile())
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{Producer: producer, Spool: spool, Metrics: metrics}, FailureRequire)
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	currentValues := getCounters(metrics, counters)
+	deltas, err := deltaCounters(prevValues, currentValues)
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{2.0, 1.0, 1.0}, deltas)
+	assert.Equal(t, 1, spool.Depth())
+}
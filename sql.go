@@ -0,0 +1,569 @@
+package gtmcdc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // mysql driver
+	_ "github.com/lib/pq"              // postgres driver
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// SinkSQL is the name of the database/sql apply sink in GTMCDC_SINKS
+const SinkSQL = "sql"
+
+// SQL drivers
+const (
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+	DriverSqlite   = "sqlite3"
+)
+
+// SQLMapping maps global nodes to the rows of existing tables,
+// it is loaded from a YAML file, e.g.
+//
+//	tables:
+//	  - node: ^ACN(acct,51)
+//	    table: account_balance
+//	    columns: [ledger_balance, last_txn_date]
+//
+// The named subscripts of the node are the key columns of the table, which
+// must be its primary key or have a unique index. The columns are the
+// pieces of the value separated by |, an empty column skips the piece.
+type SQLMapping struct {
+	Tables []*SQLTableMapping `yaml:"tables"`
+}
+
+// SQLTableMapping maps the nodes matching a pattern to a table
+type SQLTableMapping struct {
+	Node    string   `yaml:"node"`
+	Table   string   `yaml:"table"`
+	Columns []string `yaml:"columns"`
+
+	pattern *NodePattern
+	keys    []string
+}
+
+// LoadSQLMapping reads and validates the mapping file
+func LoadSQLMapping(path string) (*SQLMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := &SQLMapping{}
+	if err = yaml.Unmarshal(data, mapping); err != nil {
+		return nil, err
+	}
+
+	if len(mapping.Tables) == 0 {
+		return nil, errors.New("no tables in sql mapping " + path)
+	}
+
+	for _, m := range mapping.Tables {
+		if m.pattern, err = ParseNodePattern(m.Node); err != nil {
+			return nil, fmt.Errorf("%s %s", ErrorInvalidPattern, m.Node)
+		}
+		if m.Table == "" {
+			return nil, errors.New("no table for " + m.Node)
+		}
+
+		names := map[string]bool{}
+		for _, sub := range m.pattern.Subscripts {
+			if sub.Name == "" {
+				continue
+			}
+			if names[sub.Name] {
+				return nil, fmt.Errorf("subscript %s used more than once in %s", sub.Name, m.Node)
+			}
+			names[sub.Name] = true
+			m.keys = append(m.keys, sub.Name)
+		}
+		if len(m.keys) == 0 {
+			return nil, errors.New("no named subscript as key in " + m.Node)
+		}
+	}
+
+	return mapping, nil
+}
+
+// columns returns the key columns followed by the value columns
+func (m *SQLTableMapping) columns() []string {
+	columns := append([]string{}, m.keys...)
+	for _, column := range m.Columns {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// row returns the values of the key columns and value columns of a SET
+func (m *SQLTableMapping) row(rec *JournalRecord) []interface{} {
+	names := m.pattern.Names(rec.detail.node)
+	pieces := strings.Split(rec.detail.value, "|")
+
+	var row []interface{}
+	for _, key := range m.keys {
+		row = append(row, names[key])
+	}
+	for i, column := range m.Columns {
+		switch {
+		case column == "":
+		case i < len(pieces):
+			row = append(row, pieces[i])
+		default:
+			row = append(row, nil)
+		}
+	}
+
+	return row
+}
+
+// sqlDialect generates the parts of statements that differ between databases
+type sqlDialect interface {
+	quote(ident string) string
+	placeholder(n int) string
+	onConflict(keys, columns []string) string
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+func (postgresDialect) placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (d postgresDialect) onConflict(keys, columns []string) string {
+	var assign []string
+	for _, column := range columns {
+		assign = append(assign, fmt.Sprintf("%s = EXCLUDED.%s", d.quote(column), d.quote(column)))
+	}
+	if len(assign) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", sqlQuoteAll(d, keys))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", sqlQuoteAll(d, keys), strings.Join(assign, ", "))
+}
+
+// sqliteDialect is postgres with ? placeholders
+type sqliteDialect struct {
+	postgresDialect
+}
+
+func (sqliteDialect) placeholder(n int) string {
+	return "?"
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+func (mysqlDialect) placeholder(n int) string {
+	return "?"
+}
+
+func (d mysqlDialect) onConflict(keys, columns []string) string {
+	var assign []string
+	for _, column := range columns {
+		assign = append(assign, fmt.Sprintf("%s = VALUES(%s)", d.quote(column), d.quote(column)))
+	}
+	if len(assign) == 0 {
+		// nothing to update but the duplicate is not an error
+		assign = append(assign, fmt.Sprintf("%s = %s", d.quote(keys[0]), d.quote(keys[0])))
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(assign, ", ")
+}
+
+func sqlQuoteAll(d sqlDialect, idents []string) string {
+	quoted := make([]string, len(idents))
+	for i, ident := range idents {
+		quoted[i] = d.quote(ident)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// sqlOp is one statement, it upserts or deletes up to batchSize rows of a table
+type sqlOp struct {
+	table  *SQLTableMapping
+	delete bool
+	keys   []string        // key columns in the WHERE clause of a delete
+	rows   [][]interface{} // values of the keys, followed by the columns for an upsert
+}
+
+// sqlItem is a unit waiting in the batch to be applied
+type sqlItem struct {
+	unit *Unit
+	ack  func(err error)
+}
+
+// SQLSink applies SET, KILL and ZKILL to the tables of a database through
+// database/sql. A SET upserts the row of every mapping whose node matches
+// the node set. A KILL deletes the rows of the node and its descendants,
+// i.e. the rows with the key columns of the subscripts given in the KILL,
+// a ZKILL deletes the row of the node only. Consecutive rows of a table
+// are upserted or deleted with one statement of up to batchSize rows.
+// When batchSize is more than 1, the units are applied in batches of up
+// to batchSize rows, or less if no more units arrive within linger, each
+// batch in one SQL transaction. Otherwise every unit is applied in one
+// SQL transaction.
+type SQLSink struct {
+	db        *sql.DB
+	dialect   sqlDialect
+	mapping   *SQLMapping
+	batchSize int
+	linger    time.Duration
+	metrics   *Metrics
+
+	// set when applying to the database failed, the database is
+	// checked with a ping before trying again
+	failed int32
+
+	sending sync.Mutex
+	mu      sync.Mutex
+	batch   []*sqlItem
+	rows    int
+	timer   *time.Timer
+}
+
+// NewSQLSink connects to the database in the configuration
+func NewSQLSink(conf *Config, metrics *Metrics) (*SQLSink, error) {
+	if conf.SQLDSN == "" || conf.SQLDSN == "off" {
+		return nil, errors.New("invalid sql dsn")
+	}
+
+	mapping, err := LoadSQLMapping(conf.SQLMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(conf.SQLDriver, conf.SQLDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := newSQLSink(db, conf.SQLDriver, mapping, conf.SQLBatchSize, conf.SQLLinger, metrics)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func newSQLSink(db *sql.DB, driver string, mapping *SQLMapping, batchSize int, linger time.Duration, metrics *Metrics) (*SQLSink, error) {
+	var dialect sqlDialect
+	switch driver {
+	case DriverPostgres:
+		dialect = postgresDialect{}
+	case DriverMySQL:
+		dialect = mysqlDialect{}
+	case DriverSqlite:
+		dialect = sqliteDialect{}
+	default:
+		return nil, errors.New("unsupported sql driver " + driver)
+	}
+
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	return &SQLSink{
+		db:        db,
+		dialect:   dialect,
+		mapping:   mapping,
+		batchSize: batchSize,
+		linger:    linger,
+		metrics:   metrics,
+	}, nil
+}
+
+// Name returns the name of the sink
+func (s *SQLSink) Name() string {
+	return SinkSQL
+}
+
+// IsReplica returns true, the unchanged SETs are applied too
+func (s *SQLSink) IsReplica() bool {
+	return true
+}
+
+// Publish applies the records of the unit in one transaction
+func (s *SQLSink) Publish(unit *Unit) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	return s.apply(s.ops(unit))
+}
+
+// IsAsync returns true if the units are applied in batches
+func (s *SQLSink) IsAsync() bool {
+	return s.batchSize > 1
+}
+
+// PublishAsync adds the unit to the batch, the batch is applied once it
+// has batchSize rows or linger has passed since the first unit in it.
+// A unit without rows in the mapped tables is acknowledged right away
+func (s *SQLSink) PublishAsync(unit *Unit, track func(), ack func(err error)) {
+	track()
+
+	rows := 0
+	for _, op := range s.ops(unit) {
+		rows += len(op.rows)
+	}
+	if rows == 0 {
+		ack(nil)
+		return
+	}
+
+	s.mu.Lock()
+	s.batch = append(s.batch, &sqlItem{unit: unit, ack: ack})
+	s.rows += rows
+	full := s.rows >= s.batchSize
+	if !full && s.timer == nil {
+		s.timer = time.AfterFunc(s.linger, func() {
+			_ = s.Flush()
+		})
+	}
+	s.mu.Unlock()
+
+	if full {
+		_ = s.Flush()
+	}
+}
+
+// Flush applies the units in the batch in one transaction
+// and acknowledges them
+func (s *SQLSink) Flush() error {
+	// batches are applied one at a time to keep the order
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	batch := s.batch
+	s.batch, s.rows = nil, 0
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	units := make([]*Unit, len(batch))
+	for i, item := range batch {
+		units[i] = item.unit
+	}
+
+	err := s.apply(s.ops(units...))
+	for _, item := range batch {
+		item.ack(err)
+	}
+
+	return err
+}
+
+// apply the statements in one transaction
+func (s *SQLSink) apply(ops []*sqlOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Warnf("Unable to apply records to database. %+v", err)
+		atomic.StoreInt32(&s.failed, 1)
+		s.metrics.IncrCounter("sql_units_not_applied")
+		return err
+	}
+
+	var upserted, deleted int64
+	for _, op := range ops {
+		var result sql.Result
+		stmt, args := s.statement(op)
+		if result, err = tx.Exec(stmt, args...); err != nil {
+			break
+		}
+
+		if op.delete {
+			n, _ := result.RowsAffected()
+			deleted += n
+		} else {
+			upserted += int64(len(op.rows))
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.Warnf("Unable to apply records to database. %+v", err)
+		atomic.StoreInt32(&s.failed, 1)
+		s.metrics.IncrCounter("sql_units_not_applied")
+		return err
+	}
+
+	for i := int64(0); i < upserted; i++ {
+		s.metrics.IncrCounter("sql_rows_upserted")
+	}
+	for i := int64(0); i < deleted; i++ {
+		s.metrics.IncrCounter("sql_rows_deleted")
+	}
+	elapsed := time.Since(start)
+	s.metrics.HistoObserve("unit_apply_to_sql", float64(elapsed/time.Microsecond))
+
+	return nil
+}
+
+// ops returns the statements for the records of the units
+func (s *SQLSink) ops(units ...*Unit) []*sqlOp {
+	var ops []*sqlOp
+	for _, unit := range units {
+		ops = s.unitOps(ops, unit)
+	}
+	return ops
+}
+
+// unitOps adds the statements for the records of the unit to ops
+func (s *SQLSink) unitOps(ops []*sqlOp, unit *Unit) []*sqlOp {
+	for _, rec := range unit.Records {
+		node := rec.detail.node
+		if node == nil {
+			continue
+		}
+
+		for _, m := range s.mapping.Tables {
+			switch {
+			case rec.opcode == "SET" && m.pattern.Match(node):
+				ops = s.add(ops, m, false, m.keys, m.row(rec))
+
+			case rec.opcode == "ZKILL" && m.pattern.Match(node),
+				rec.opcode == "KILL" && m.pattern.MatchPrefix(node):
+				names := m.pattern.Names(node)
+				var keys []string
+				var row []interface{}
+				for _, key := range m.keys {
+					if value, ok := names[key]; ok {
+						keys = append(keys, key)
+						row = append(row, value)
+					}
+				}
+				ops = s.add(ops, m, true, keys, row)
+			}
+		}
+	}
+
+	return ops
+}
+
+// add the row to the last statement if it is for the same table and keys,
+// the last upsert of the same row replaces the earlier ones
+func (s *SQLSink) add(ops []*sqlOp, m *SQLTableMapping, delete bool, keys []string, row []interface{}) []*sqlOp {
+	if len(ops) > 0 {
+		last := ops[len(ops)-1]
+		if last.table == m && last.delete == delete && strings.Join(last.keys, ",") == strings.Join(keys, ",") {
+			for i, prev := range last.rows {
+				if fmt.Sprint(prev[:len(keys)]) == fmt.Sprint(row[:len(keys)]) {
+					last.rows[i] = row
+					return ops
+				}
+			}
+			if len(last.rows) < s.batchSize {
+				last.rows = append(last.rows, row)
+				return ops
+			}
+		}
+	}
+
+	return append(ops, &sqlOp{table: m, delete: delete, keys: keys, rows: [][]interface{}{row}})
+}
+
+// statement returns the SQL and arguments of the operation
+func (s *SQLSink) statement(op *sqlOp) (string, []interface{}) {
+	d := s.dialect
+	table := d.quote(op.table.Table)
+
+	var args []interface{}
+	var tuples []string
+	for _, row := range op.rows {
+		var values []string
+		for i, value := range row {
+			args = append(args, value)
+			if op.delete {
+				values = append(values, fmt.Sprintf("%s = %s", d.quote(op.keys[i]), d.placeholder(len(args))))
+			} else {
+				values = append(values, d.placeholder(len(args)))
+			}
+		}
+
+		if op.delete {
+			tuples = append(tuples, "("+strings.Join(values, " AND ")+")")
+		} else {
+			tuples = append(tuples, "("+strings.Join(values, ", ")+")")
+		}
+	}
+
+	if op.delete {
+		if len(op.keys) == 0 {
+			// KILL of the whole global
+			return "DELETE FROM " + table, nil
+		}
+		return fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(tuples, " OR ")), args
+	}
+
+	columns := op.table.columns()
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s%s", table, sqlQuoteAll(d, columns),
+		strings.Join(tuples, ", "), d.onConflict(op.table.keys, columns[len(op.table.keys):])), args
+}
+
+// Close applies the remaining units and closes the database
+func (s *SQLSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Healthy returns true unless the last attempt failed
+// and the database does not respond to a ping
+func (s *SQLSink) Healthy() bool {
+	if atomic.LoadInt32(&s.failed) == 0 {
+		return true
+	}
+
+	if s.db.Ping() != nil {
+		return false
+	}
+
+	atomic.StoreInt32(&s.failed, 0)
+	return true
+}
@@ -0,0 +1,202 @@
+package gtmcdc
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DoFilter_SQL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dsn := filepath.Join(dir, "cdc.db")
+	db, err := sql.Open(DriverSqlite, dsn)
+	assert.Nil(t, err)
+	_, err = db.Exec(`CREATE TABLE account_balance (acct TEXT PRIMARY KEY, ledger_balance TEXT, last_txn_date TEXT)`)
+	assert.Nil(t, err)
+	_, err = db.Exec(`CREATE TABLE account_status (acct TEXT PRIMARY KEY, status TEXT)`)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	conf := &Config{SQLDriver: DriverSqlite, SQLDSN: dsn, SQLMapping: "testdata/sql_mapping.yaml", SQLBatchSize: 10}
+	metrics := InitMetrics()
+	sink, err := NewSQLSink(conf, metrics)
+	assert.Nil(t, err)
+	assert.True(t, sink.Healthy())
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	defer sinks.Close()
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	rows := testSqliteRows(t, db, "SELECT acct, ledger_balance, last_txn_date FROM account_balance ORDER BY acct")
+	assert.Equal(t, [][]string{{"1234", "100.00", "61212"}, {"5678", "300.00", ""}}, rows)
+	rows = testSqliteRows(t, db, "SELECT acct, status FROM account_status")
+	assert.Equal(t, [][]string{{"1234", "1"}}, rows)
+
+	kill := parseAll(t, `04\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234)`)
+	assert.Nil(t, sink.Publish(&Unit{Records: kill, done: true}))
+	rows = testSqliteRows(t, db, "SELECT acct FROM account_balance UNION ALL SELECT acct FROM account_status")
+	assert.Equal(t, [][]string{{"5678"}}, rows)
+}
+
+func testSQLMock(t *testing.T, driver string) (*SQLSink, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+
+	mapping, err := LoadSQLMapping("testdata/sql_mapping.yaml")
+	assert.Nil(t, err)
+
+	sink, err := newSQLSink(db, driver, mapping, 2, 0, InitMetrics())
+	assert.Nil(t, err)
+
+	return sink, mock
+}
+
+func Test_SQLSink_Postgres(t *testing.T) {
+	sink, mock := testSQLMock(t, DriverPostgres)
+	defer sink.Close()
+
+	// the 2nd SET of ^ACN(1,51) replaces the 1st one in the batch,
+	// ^ACN(3,51) starts a new batch
+	unit := &Unit{Records: parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="1.00"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(2,51)="2.00|65000"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="1.50"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(3,51)="3.00"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(3,99)="not mapped"`,
+		`10\65282,59700\28\0\0\28\0\0\0\0\^ACN(2,52)`,
+	), done: true}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "account_balance" ("acct", "ledger_balance", "last_txn_date") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT ("acct") DO UPDATE SET "ledger_balance" = EXCLUDED."ledger_balance", "last_txn_date" = EXCLUDED."last_txn_date"`).
+		WithArgs("1", "1.50", nil, "2", "2.00", "65000").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO "account_balance" ("acct", "ledger_balance", "last_txn_date") VALUES ($1, $2, $3) ON CONFLICT ("acct") DO UPDATE SET "ledger_balance" = EXCLUDED."ledger_balance", "last_txn_date" = EXCLUDED."last_txn_date"`).
+		WithArgs("3", "3.00", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM "account_status" WHERE ("acct" = $1)`).
+		WithArgs("2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, sink.Publish(unit))
+
+	// KILL of the global deletes all rows, the unit is rolled back on errors
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "account_balance"`).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`DELETE FROM "account_status"`).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	kill := parseAll(t, `04\65282,59700\30\0\0\30\0\0\0\0\^ACN`)
+	assert.NotNil(t, sink.Publish(&Unit{Records: kill, done: true}))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_SQLSink_MySQL(t *testing.T) {
+	sink, mock := testSQLMock(t, DriverMySQL)
+	defer sink.Close()
+
+	unit := &Unit{Records: parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,52)="A"`,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN(2)`,
+	), done: true}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO `account_status` (`acct`, `status`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `status` = VALUES(`status`)").
+		WithArgs("1", "A").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM `account_balance` WHERE (`acct` = ?)").
+		WithArgs("2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM `account_status` WHERE (`acct` = ?)").
+		WithArgs("2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.Nil(t, sink.Publish(unit))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_SQLSink_PublishAsync(t *testing.T) {
+	sink, mock := testSQLMock(t, DriverPostgres)
+	sink.linger = time.Hour
+	defer sink.Close()
+	assert.True(t, sink.IsAsync())
+
+	var acks []error
+	ack := func(err error) {
+		acks = append(acks, err)
+	}
+
+	// the rows of both units are in one statement of one transaction
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "account_balance" ("acct", "ledger_balance", "last_txn_date") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT ("acct") DO UPDATE SET "ledger_balance" = EXCLUDED."ledger_balance", "last_txn_date" = EXCLUDED."last_txn_date"`).
+		WithArgs("1", "1.00", nil, "2", "2.00", nil).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	for _, line := range []string{
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,51)="1.00"`,
+		`05\65282,59700\29\0\0\29\0\0\0\0\^ACN(2,51)="2.00"`,
+	} {
+		sink.PublishAsync(&Unit{Records: parseAll(t, line), done: true}, func() {}, ack)
+	}
+	assert.Equal(t, []error{nil, nil}, acks)
+
+	// a unit without rows in the mapped tables does not wait for the batch
+	other := parseAll(t, `05\65282,59700\29\0\0\29\0\0\0\0\^XYZ(1)="x"`)
+	sink.PublishAsync(&Unit{Records: other, done: true}, func() {}, ack)
+	assert.Equal(t, []error{nil, nil, nil}, acks)
+
+	// the unit is applied by Flush before the batch is full
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "account_status" WHERE ("acct" = $1)`).
+		WithArgs("3").
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	zkill := parseAll(t, `10\65282,59700\30\0\0\30\0\0\0\0\^ACN(3,52)`)
+	sink.PublishAsync(&Unit{Records: zkill, done: true}, func() {}, ack)
+	assert.Equal(t, 3, len(acks))
+	assert.NotNil(t, sink.Flush())
+	assert.Equal(t, 4, len(acks))
+	assert.NotNil(t, acks[3])
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_LoadSQLMapping_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"tables: []",
+		"tables:\n  - node: ACN(acct)\n    table: t",
+		"tables:\n  - node: ^ACN(acct)",
+		"tables:\n  - node: ^ACN(*,51)\n    table: t",
+		"tables:\n  - node: ^ACN(acct,acct)\n    table: t",
+		"tables: [",
+	} {
+		path, err := testTempFileWithContent([]byte(content))
+		assert.Nil(t, err)
+		_, err = LoadSQLMapping(path)
+		assert.NotNil(t, err, content)
+		os.Remove(path)
+	}
+
+	_, err := LoadSQLMapping("testdata/no_such_file.yaml")
+	assert.NotNil(t, err)
+
+	db, _, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	_, err = newSQLSink(db, "oracle", &SQLMapping{}, 1, 0, nil)
+	assert.NotNil(t, err)
+}
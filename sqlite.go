@@ -0,0 +1,427 @@
+package gtmcdc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // sqlite driver
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkSqlite is the name of the SQLite apply sink in GTMCDC_SINKS
+const SinkSqlite = "sqlite"
+
+// SqliteSink applies SET, KILL and ZKILL to a SQLite database which is a
+// relational replica of the globals. Each global is a table named after
+// the global in lower case with % replaced by _, and a suffix for the case
+// when the global has lower case letters, e.g.
+//
+//	^ACN(1234,51)="100.00|61212"
+//
+// is the row sub1='1234', sub2='51', piece1='100.00', piece2='61212' of
+// table acn, and ^acn is table acn_111. Columns are added when a node with more subscripts or value
+// pieces than seen before is set, missing subscripts are empty. KILL deletes
+// the rows of the node and its descendants, ZKILL the row of the node only.
+// The records of a unit are applied in one SQL transaction.
+type SqliteSink struct {
+	db      *sql.DB
+	globals map[string]bool
+	tables  map[string]*sqliteTable
+	metrics *Metrics
+
+	// set when applying to the database failed, the database is
+	// checked with a ping before trying again
+	failed int32
+}
+
+// sqliteTable is the shape of the table of a global
+type sqliteTable struct {
+	name   string
+	subs   int
+	pieces int
+	rows   int64
+}
+
+// NewSqliteSink opens the SQLite database in the configuration,
+// only the globals in the configuration are applied if any
+func NewSqliteSink(conf *Config, metrics *Metrics) (*SqliteSink, error) {
+	if conf.SqliteFile == "" || conf.SqliteFile == "off" {
+		return nil, errors.New("invalid sqlite file")
+	}
+
+	db, err := sql.Open("sqlite3", conf.SqliteFile)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	globals := map[string]bool{}
+	for _, global := range conf.SqliteGlobals {
+		globals[strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(global), "^"))] = true
+	}
+
+	return &SqliteSink{
+		db:      db,
+		globals: globals,
+		tables:  map[string]*sqliteTable{},
+		metrics: metrics,
+	}, nil
+}
+
+// Name returns the name of the sink
+func (s *SqliteSink) Name() string {
+	return SinkSqlite
+}
+
+// IsReplica returns true, the unchanged SETs are applied too
+func (s *SqliteSink) IsReplica() bool {
+	return true
+}
+
+// Publish applies the records of the unit in one transaction
+func (s *SqliteSink) Publish(unit *Unit) error {
+	var recs []*JournalRecord
+	for _, rec := range unit.Records {
+		if s.applies(rec) {
+			recs = append(recs, rec)
+		}
+	}
+
+	if len(recs) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		atomic.StoreInt32(&s.failed, 1)
+		return err
+	}
+
+	upserted, deleted := 0, 0
+	changes := map[*sqliteTable]int64{}
+	for _, rec := range recs {
+		var table *sqliteTable
+		table, err = s.table(tx, rec)
+		if err != nil {
+			break
+		}
+
+		var n int64
+		if rec.opcode == "SET" {
+			n, err = s.set(tx, table, rec)
+			upserted++
+		} else {
+			n, err = s.kill(tx, table, rec)
+			deleted += int(-n)
+		}
+		if err != nil {
+			break
+		}
+		changes[table] += n
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.Warnf("Unable to apply records to sqlite. %+v", err)
+		atomic.StoreInt32(&s.failed, 1)
+		s.metrics.IncrCounter("sqlite_units_not_applied")
+		// tables created or altered in the transaction are gone
+		s.tables = map[string]*sqliteTable{}
+		return err
+	}
+
+	for i := 0; i < upserted; i++ {
+		s.metrics.IncrCounter("sqlite_rows_upserted")
+	}
+	for i := 0; i < deleted; i++ {
+		s.metrics.IncrCounter("sqlite_rows_deleted")
+	}
+	for table, n := range changes {
+		table.rows += n
+		s.metrics.SetGauge("sqlite_rows_"+table.name, float64(table.rows))
+	}
+	elapsed := time.Since(start)
+	s.metrics.HistoObserve("unit_apply_to_sqlite", float64(elapsed/time.Microsecond))
+
+	return nil
+}
+
+// applies returns true for the records that change a selected global
+func (s *SqliteSink) applies(rec *JournalRecord) bool {
+	if rec.detail.node == nil || (rec.opcode != "SET" && !isKill(rec)) {
+		return false
+	}
+	return len(s.globals) == 0 || s.globals[strings.ToUpper(rec.detail.node.Global)]
+}
+
+// set updates the row of the node or inserts it if it does not exist,
+// returns the number of rows added
+func (s *SqliteSink) set(tx *sql.Tx, table *sqliteTable, rec *JournalRecord) (int64, error) {
+	subs := sqliteSubscripts(rec.detail.node, table.subs)
+	pieces := strings.Split(rec.detail.value, "|")
+
+	var assign []string
+	var args []interface{}
+	for i := 0; i < table.pieces; i++ {
+		assign = append(assign, fmt.Sprintf("piece%d = ?", i+1))
+		if i < len(pieces) {
+			args = append(args, pieces[i])
+		} else {
+			args = append(args, nil)
+		}
+	}
+	where, whereArgs := sqliteWhere(subs)
+
+	stmt := fmt.Sprintf(`UPDATE "%s" SET %s%s`, table.name, strings.Join(assign, ", "), where)
+	result, err := tx.Exec(stmt, append(args, whereArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return 0, nil
+	}
+
+	var columns, marks []string
+	for i := range subs {
+		columns = append(columns, fmt.Sprintf("sub%d", i+1))
+		marks = append(marks, "?")
+	}
+	for i := 0; i < table.pieces; i++ {
+		columns = append(columns, fmt.Sprintf("piece%d", i+1))
+		marks = append(marks, "?")
+	}
+
+	stmt = fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, table.name, strings.Join(columns, ", "), strings.Join(marks, ", "))
+	if _, err = tx.Exec(stmt, append(whereArgs, args...)...); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// kill deletes the row of the node, and of its descendants for KILL,
+// returns the negative number of rows deleted
+func (s *SqliteSink) kill(tx *sql.Tx, table *sqliteTable, rec *JournalRecord) (int64, error) {
+	subs := rec.detail.node.SubscriptValues()
+	if table.pieces == 0 || len(subs) > table.subs {
+		// no such rows
+		return 0, nil
+	}
+
+	if rec.opcode == "ZKILL" {
+		subs = sqliteSubscripts(rec.detail.node, table.subs)
+	}
+	where, args := sqliteWhere(subs)
+
+	result, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s"%s`, table.name, where), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return -n, err
+}
+
+// table returns the table of the global, the table is created
+// or altered to fit the node and value of a SET
+func (s *SqliteSink) table(tx *sql.Tx, rec *JournalRecord) (*sqliteTable, error) {
+	name := sqliteTableName(rec.detail.node.Global)
+
+	table, exists := s.tables[name]
+	if !exists {
+		var err error
+		if table, err = s.loadTable(tx, name); err != nil {
+			return nil, err
+		}
+		s.tables[name] = table
+	}
+
+	if isKill(rec) {
+		// nothing to delete from a table that does not exist
+		return table, nil
+	}
+
+	subs := len(rec.detail.node.Subscripts)
+	pieces := len(strings.Split(rec.detail.value, "|"))
+
+	if table.pieces == 0 {
+		var columns []string
+		for i := 0; i < subs; i++ {
+			columns = append(columns, fmt.Sprintf("sub%d TEXT NOT NULL DEFAULT ''", i+1))
+		}
+		for i := 0; i < pieces; i++ {
+			columns = append(columns, fmt.Sprintf("piece%d TEXT", i+1))
+		}
+		stmt := fmt.Sprintf(`CREATE TABLE "%s" (%s)`, name, strings.Join(columns, ", "))
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+		table.subs, table.pieces = subs, pieces
+		return table, s.index(tx, table)
+	}
+
+	for ; table.pieces < pieces; table.pieces++ {
+		stmt := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN piece%d TEXT`, name, table.pieces+1)
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	if subs > table.subs {
+		for ; table.subs < subs; table.subs++ {
+			stmt := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN sub%d TEXT NOT NULL DEFAULT ''`, name, table.subs+1)
+			if _, err := tx.Exec(stmt); err != nil {
+				return nil, err
+			}
+		}
+		return table, s.index(tx, table)
+	}
+
+	return table, nil
+}
+
+// index creates the unique index on the subscripts, which are the key of the rows
+func (s *SqliteSink) index(tx *sql.Tx, table *sqliteTable) error {
+	if table.subs == 0 {
+		// a global without subscripts has one row
+		return nil
+	}
+
+	var columns []string
+	for i := 0; i < table.subs; i++ {
+		columns = append(columns, fmt.Sprintf("sub%d", i+1))
+	}
+
+	stmts := []string{
+		fmt.Sprintf(`DROP INDEX IF EXISTS "%s_key"`, table.name),
+		fmt.Sprintf(`CREATE UNIQUE INDEX "%s_key" ON "%s" (%s)`, table.name, table.name, strings.Join(columns, ", ")),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadTable returns the shape of an existing table,
+// subs and pieces are 0 if the table does not exist
+func (s *SqliteSink) loadTable(tx *sql.Tx, name string) (*sqliteTable, error) {
+	table := &sqliteTable{name: name}
+
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var column, ctype string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &column, &ctype, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(column, "sub") {
+			table.subs++
+		} else if strings.HasPrefix(column, "piece") {
+			table.pieces++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if table.pieces > 0 {
+		err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, name)).Scan(&table.rows)
+	}
+
+	return table, err
+}
+
+// Flush does nothing because units are committed before Publish returns
+func (s *SqliteSink) Flush() error {
+	return nil
+}
+
+// Close the database
+func (s *SqliteSink) Close() error {
+	return s.db.Close()
+}
+
+// Healthy returns true unless the last attempt failed
+// and the database does not respond to a ping
+func (s *SqliteSink) Healthy() bool {
+	if atomic.LoadInt32(&s.failed) == 0 {
+		return true
+	}
+
+	if s.db.Ping() != nil {
+		return false
+	}
+
+	atomic.StoreInt32(&s.failed, 0)
+	return true
+}
+
+// sqliteTableName returns the table name of a global. Table names are
+// not case sensitive in SQLite, a global with lower case letters has the
+// suffix _ followed by 1 for every lower case and 0 for every other
+// character so that e.g. ^ACN, ^acn and ^Acn are different tables
+func sqliteTableName(global string) string {
+	name := strings.ToLower(strings.ReplaceAll(global, "%", "_"))
+	if strings.ToUpper(global) == global {
+		return name
+	}
+
+	var suffix strings.Builder
+	for _, c := range global {
+		if c >= 'a' && c <= 'z' {
+			suffix.WriteByte('1')
+		} else {
+			suffix.WriteByte('0')
+		}
+	}
+	return name + "_" + suffix.String()
+}
+
+// sqliteSubscripts returns the subscripts of the node padded
+// with empty strings to the number of subscript columns
+func sqliteSubscripts(node *Node, n int) []string {
+	subs := node.SubscriptValues()
+	for len(subs) < n {
+		subs = append(subs, "")
+	}
+	return subs
+}
+
+// sqliteWhere returns the WHERE clause matching the subscripts
+func sqliteWhere(subs []string) (string, []interface{}) {
+	if len(subs) == 0 {
+		return "", nil
+	}
+
+	var conds []string
+	var args []interface{}
+	for i, sub := range subs {
+		conds = append(conds, fmt.Sprintf("sub%d = ?", i+1))
+		args = append(args, sub)
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
@@ -0,0 +1,148 @@
+package gtmcdc
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSqliteRows(t *testing.T, db *sql.DB, query string) [][]string {
+	rows, err := db.Query(query)
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	columns, _ := rows.Columns()
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		assert.Nil(t, rows.Scan(dest...))
+
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		result = append(result, row)
+	}
+
+	return result
+}
+
+func Test_DoFilter_Sqlite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	metrics := InitMetrics()
+	sink, err := NewSqliteSink(&Config{SqliteFile: filepath.Join(dir, "cdc.db")}, metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	defer sinks.Close()
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, Metrics: metrics}).DoFilter(fin, fout)
+
+	rows := testSqliteRows(t, sink.db, "SELECT sub1, sub2, piece1, piece2 FROM acn ORDER BY sub1, sub2")
+	assert.Equal(t, [][]string{
+		{"1234", "51", "100.00", "61212"},
+		{"1234", "52", "1", ""},
+		{"5678", "51", "300.00", ""},
+	}, rows)
+	assert.Equal(t, float64(3), metrics.GetGaugeValue("sqlite_rows_acn"))
+}
+
+func Test_SqliteSink_Kill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{SqliteFile: filepath.Join(dir, "cdc.db"), SqliteGlobals: []string{"^ACN"}}
+	metrics := InitMetrics()
+	sink, err := NewSqliteSink(conf, metrics)
+	assert.Nil(t, err)
+
+	// one transaction with nodes of different depths
+	unit := &Unit{Records: parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,2)="a|b"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1,2,3)="c"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1)="x"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(2,1)="y"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^XYZ(1)="not applied"`,
+	), done: true}
+	assert.Nil(t, sink.Publish(unit))
+	assert.Equal(t, float64(4), metrics.GetGaugeValue("sqlite_rows_acn"))
+	assert.Nil(t, sink.Close())
+
+	// the tables are loaded again after a restart
+	sink, err = NewSqliteSink(conf, metrics)
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	zkill := parseAll(t, `10\65282,59700\29\0\0\29\0\0\0\0\^ACN(1)`)
+	assert.Nil(t, sink.Publish(&Unit{Records: zkill, done: true}))
+	assert.Equal(t, float64(3), metrics.GetGaugeValue("sqlite_rows_acn"))
+
+	kill := parseAll(t, `04\65282,59700\30\0\0\30\0\0\0\0\^ACN(1)`)
+	assert.Nil(t, sink.Publish(&Unit{Records: kill, done: true}))
+
+	rows := testSqliteRows(t, sink.db, "SELECT sub1, sub2, sub3, piece1 FROM acn")
+	assert.Equal(t, [][]string{{"2", "1", "", "y"}}, rows)
+	assert.Equal(t, float64(1), metrics.GetGaugeValue("sqlite_rows_acn"))
+
+	tables := testSqliteRows(t, sink.db, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	assert.Equal(t, [][]string{{"acn"}}, tables)
+
+	_, err = NewSqliteSink(&Config{SqliteFile: "off"}, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_SqliteSink_Healthy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := NewSqliteSink(&Config{SqliteFile: filepath.Join(dir, "cdc.db")}, InitMetrics())
+	assert.Nil(t, err)
+
+	// the database is checked only after a failure
+	assert.Nil(t, sink.db.Close())
+	assert.True(t, sink.Healthy())
+
+	unit := &Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`), done: true}
+	assert.NotNil(t, sink.Publish(unit))
+	assert.False(t, sink.Healthy())
+}
+
+func Test_sqliteTableName(t *testing.T) {
+	assert.Equal(t, "acn", sqliteTableName("ACN"))
+	assert.Equal(t, "_acn2", sqliteTableName("%ACN2"))
+	assert.Equal(t, "acn_111", sqliteTableName("acn"))
+	assert.Equal(t, "acn_011", sqliteTableName("Acn"))
+	assert.Equal(t, "_acn_0100", sqliteTableName("%aCN"))
+
+	dir, err := ioutil.TempDir("", "sqlite_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := NewSqliteSink(&Config{SqliteFile: filepath.Join(dir, "cdc.db")}, InitMetrics())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	// globals that differ in case only are different tables
+	unit := &Unit{Records: parseAll(t,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1)="upper"`,
+		`05\65282,59700\28\0\0\28\0\0\0\0\^acn(1)="lower"`,
+	), done: true}
+	assert.Nil(t, sink.Publish(unit))
+	assert.Equal(t, [][]string{{"1", "upper"}}, testSqliteRows(t, sink.db, "SELECT sub1, piece1 FROM acn"))
+	assert.Equal(t, [][]string{{"1", "lower"}}, testSqliteRows(t, sink.db, "SELECT sub1, piece1 FROM acn_111"))
+}
@@ -0,0 +1,257 @@
+package gtmcdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	stateBucket          = "nodes"
+	statePositionsBucket = "positions"
+
+	// separates subscripts in the keys of the state store, a 0
+	// byte in a subscript is escaped so that the keys of all
+	// descendants of a node start with the key of the node
+	stateSeparator = "\x00\x01"
+	stateEscape    = "\x00\xff"
+)
+
+// StateStore keeps the last known value of every global node in a local
+// bbolt file so that events carry the value before a SET, KILL or ZKILL.
+// Nodes that were set before the store was created are not known, their
+// events have no previous value until they are set again.
+//
+// The position of the last unit applied is kept for each stream along with
+// the nodes. A unit at or before it, i.e. resent by the replication source
+// after a restart, is not applied again and its records have no previous
+// value since the value before them is no longer known. Units without a
+// position, e.g. ZTSTART...ZTCOM transactions, are always applied.
+type StateStore struct {
+	db *bolt.DB
+}
+
+// PieceChange is a piece of the value that is different from the
+// previous value, pieces are numbered from 1
+type PieceChange struct {
+	Piece int    `json:"piece"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// DeletedNode is a descendant deleted by a KILL with its last known value
+type DeletedNode struct {
+	Key        string   `json:"key,omitempty"`
+	Subscripts []string `json:"subscripts,omitempty"`
+	NodeValues []string `json:"node_values"`
+}
+
+// beforeImage is the state of the node of a record before the record
+type beforeImage struct {
+	value   string
+	exists  bool
+	deleted []*DeletedNode
+}
+
+// OpenStateStore opens or creates the state store file
+func OpenStateStore(path string) (*StateStore, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{stateBucket, statePositionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &StateStore{db: db}, nil
+}
+
+// Apply sets the before image of a SET, KILL or ZKILL and updates the
+// node in the store. It does nothing if the store is nil.
+func (s *StateStore) Apply(rec *JournalRecord) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return applyState(tx.Bucket([]byte(stateBucket)), rec)
+	})
+}
+
+// ApplyUnit sets the before images of the records of a unit and updates
+// the nodes in the store in one transaction, unless the unit is at or
+// before the position of the last unit applied in its stream. It does
+// nothing if the store is nil.
+func (s *StateStore) ApplyUnit(unit *Unit) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		positions := tx.Bucket([]byte(statePositionsBucket))
+		stream, pos := unit.position()
+		key := []byte(strconv.Itoa(stream))
+
+		if !pos.IsZero() {
+			if value := positions.Get(key); value != nil {
+				last := Position{}
+				if err := json.Unmarshal(value, &last); err != nil {
+					return err
+				}
+				if !pos.After(last) {
+					// applied before the unit was resent
+					return nil
+				}
+			}
+		}
+
+		bucket := tx.Bucket([]byte(stateBucket))
+		for _, rec := range unit.Records {
+			if err := applyState(bucket, rec); err != nil {
+				return err
+			}
+		}
+
+		if pos.IsZero() {
+			return nil
+		}
+		value, err := json.Marshal(pos)
+		if err != nil {
+			return err
+		}
+		return positions.Put(key, value)
+	})
+}
+
+// applyState sets the before image of a record and updates its node
+func applyState(bucket *bolt.Bucket, rec *JournalRecord) error {
+	if rec.detail.node == nil {
+		return nil
+	}
+
+	switch rec.opcode {
+	case "SET", "KILL", "ZKILL":
+	default:
+		return nil
+	}
+
+	key := stateKey(rec.detail.node)
+
+	before := &beforeImage{}
+	if value := bucket.Get(key); value != nil {
+		before.value, before.exists = string(value), true
+	}
+
+	switch rec.opcode {
+	case "SET":
+		if err := bucket.Put(key, []byte(rec.detail.value)); err != nil {
+			return err
+		}
+
+	case "KILL":
+		// the keys are collected first as a cursor may skip
+		// keys after deleting the current key
+		var keys [][]byte
+		prefix := append(append([]byte{}, key...), stateSeparator...)
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+			before.deleted = append(before.deleted, deletedNode(k, v))
+		}
+		for _, k := range append(keys, key) {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+	case "ZKILL":
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	rec.detail.before = before
+	return nil
+}
+
+// Value returns the last known value of a node
+func (s *StateStore) Value(node *Node) (value string, exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(stateBucket)).Get(stateKey(node)); v != nil {
+			value, exists = string(v), true
+		}
+		return nil
+	})
+	return value, exists, err
+}
+
+// Close the state store file
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func stateKey(node *Node) []byte {
+	var sb strings.Builder
+	sb.WriteString(node.Global)
+	for _, sub := range node.Subscripts {
+		sb.WriteString(stateSeparator)
+		sb.WriteString(strings.ReplaceAll(sub.Value, "\x00", stateEscape))
+	}
+	return []byte(sb.String())
+}
+
+// deletedNode returns the node of a key in the state store and its value
+func deletedNode(key, value []byte) *DeletedNode {
+	parts := strings.Split(string(key), stateSeparator)
+	subs := make([]string, len(parts)-1)
+	for i, part := range parts[1:] {
+		subs[i] = strings.ReplaceAll(part, stateEscape, "\x00")
+	}
+
+	deleted := &DeletedNode{NodeValues: strings.Split(string(value), "|")}
+	if len(subs) > 0 {
+		deleted.Key = subs[0]
+	}
+	if len(subs) > 1 {
+		deleted.Subscripts = subs[1:]
+	}
+	return deleted
+}
+
+// pieceChanges returns the pieces of the value that are different from
+// the previous value, missing pieces are empty
+func pieceChanges(previous, value string) []*PieceChange {
+	old, pieces := strings.Split(previous, "|"), strings.Split(value, "|")
+
+	var changes []*PieceChange
+	for i := 0; i < len(old) || i < len(pieces); i++ {
+		var o, n string
+		if i < len(old) {
+			o = old[i]
+		}
+		if i < len(pieces) {
+			n = pieces[i]
+		}
+		if o != n {
+			changes = append(changes, &PieceChange{Piece: i + 1, Old: o, New: n})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,145 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStateStore(t *testing.T) (*StateStore, string) {
+	dir, err := ioutil.TempDir("", "state_test")
+	assert.Nil(t, err)
+
+	state, err := OpenStateStore(filepath.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	return state, dir
+}
+
+func Test_StateStore_Apply(t *testing.T) {
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+
+	recs := parseAll(t,
+		`05\65287,62154\1\0\0\1\0\0\0\0\^ACN(1,51)="a|b"`,
+		`05\65287,62154\2\0\0\2\0\0\0\0\^ACN(1,51)="a|c|d"`,
+		`05\65287,62154\3\0\0\3\0\0\0\0\^ACN(1,52)="x"`,
+		`05\65287,62154\4\0\0\4\0\0\0\0\^ACN(1,"a"_$C(0),1)="y"`,
+		`05\65287,62154\5\0\0\5\0\0\0\0\^ACN(12,51)="z"`,
+		`04\65287,62154\6\0\0\6\0\0\0\0\^ACN(1)`,
+		`10\65287,62154\7\0\0\7\0\0\0\0\^ACN(12,51)`,
+		`05\65287,62154\8\0\0\8\0\0\0\0\^ACN(12,51)="w"`,
+	)
+	for _, rec := range recs {
+		assert.Nil(t, state.Apply(rec))
+	}
+
+	// new node
+	event := recs[0].Event()
+	assert.Nil(t, event.PreviousValues)
+	assert.Equal(t, []*PieceChange{{1, "", "a"}, {2, "", "b"}}, event.Changes)
+
+	event = recs[1].Event()
+	assert.Equal(t, []string{"a", "b"}, event.PreviousValues)
+	assert.Equal(t, []*PieceChange{{2, "b", "c"}, {3, "", "d"}}, event.Changes)
+
+	// KILL without a value enumerates the descendants
+	event = recs[5].Event()
+	assert.Nil(t, event.PreviousValues)
+	assert.Nil(t, event.Changes)
+	assert.Equal(t, []*DeletedNode{
+		{Key: "1", Subscripts: []string{"51"}, NodeValues: []string{"a", "c", "d"}},
+		{Key: "1", Subscripts: []string{"52"}, NodeValues: []string{"x"}},
+		{Key: "1", Subscripts: []string{"a\x00", "1"}, NodeValues: []string{"y"}},
+	}, event.Deleted)
+
+	event = recs[6].Event()
+	assert.Equal(t, []string{"z"}, event.PreviousValues)
+	assert.Nil(t, event.Deleted)
+
+	assert.Nil(t, recs[7].Event().PreviousValues)
+
+	// the state is kept after reopen
+	assert.Nil(t, state.Close())
+	state, err := OpenStateStore(filepath.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer state.Close()
+
+	value, exists, err := state.Value(recs[7].detail.node)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "w", value)
+
+	_, exists, err = state.Value(recs[0].detail.node)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	// nil store does nothing
+	var none *StateStore
+	assert.Nil(t, none.Apply(recs[0]))
+}
+
+func Test_DoFilter_State(t *testing.T) {
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	metrics := InitMetrics()
+	sink := &testSink{name: "test"}
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, State: state, Metrics: metrics}).DoFilter(fin, fout)
+
+	jsonstr, err := sink.units[2].JSON()
+	assert.Nil(t, err)
+	assert.Contains(t, jsonstr, `"previous_values":["200.00"],"changes":[{"piece":1,"old":"200.00","new":"300.00"}]`)
+
+	// the state store fields are kept in the other formats
+	for _, unit := range sink.units {
+		jsonstr, err := unit.JSON()
+		assert.Nil(t, err)
+
+		msg, err := protobufEncoder{}.Encode(unit)
+		assert.Nil(t, err)
+		event, err := DecodeProtobuf([]byte(msg.Value))
+		assert.Nil(t, err)
+		decoded, err := json.Marshal(event)
+		assert.Nil(t, err)
+		assert.Equal(t, jsonstr, string(decoded))
+	}
+
+	registry, err := OpenFileSchemaRegistry(dir)
+	assert.Nil(t, err)
+	msg, err := NewAvroEncoder(registry, "cdc").Encode(sink.units[1])
+	assert.Nil(t, err)
+	native, err := DecodeAvro(registry, []byte(msg.Value))
+	assert.Nil(t, err)
+	changes := native.(map[string]interface{})["changes"].(map[string]interface{})["array"]
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"piece": int64(1), "old": "", "new": "200.00"},
+	}, changes)
+
+	// units resent after a restart are not applied again, the value
+	// before them is unknown instead of the value they set
+	sink = &testSink{name: "test"}
+	sinks = NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+	fin, fout = InitInputAndOutput("testdata/test_tp.txt", nullFile())
+	(&Filter{Sinks: sinks, State: state, Metrics: metrics}).DoFilter(fin, fout)
+
+	assert.Equal(t, 3, len(sink.units))
+	for _, unit := range sink.units[:2] {
+		jsonstr, err := unit.JSON()
+		assert.Nil(t, err)
+		assert.NotContains(t, jsonstr, "previous_values")
+		assert.NotContains(t, jsonstr, "changes")
+	}
+	value, _, err := state.Value(sink.units[1].Records[0].detail.node)
+	assert.Nil(t, err)
+	assert.Equal(t, "300.00", value)
+}
@@ -0,0 +1,124 @@
+package gtmcdc
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tombstone modes
+const (
+	TombstoneOff  = "off"
+	TombstoneAlso = "also"
+	TombstoneOnly = "only"
+)
+
+// TombstoneDeleteHeader is the Kafka header that tells the consumer whether
+// a tombstone deletes only the node (ZKILL) or the node with all its
+// descendants (KILL)
+const TombstoneDeleteHeader = "gtmcdc.delete"
+
+// TombstonePolicy decides whether KILL and ZKILL are published as Kafka
+// tombstones, i.e. a message with the key of the node and a null value,
+// so that compacted topics and sink connectors can treat them as deletes.
+//
+//	off   KILL and ZKILL are published as JSON events only
+//	also  a tombstone is published after the JSON event
+//	only  a tombstone is published instead of the JSON event
+//
+// KILL and ZKILL within a transaction are always kept in the transaction
+// event, their tombstones are published after the transaction event.
+//
+// A tombstone is only published when the key belongs to the killed node
+// alone. With global+key, ^ACN(1234) has the key of all its descendants,
+// so only a KILL of a node with one subscript deletes everything under the
+// key, ZKILL ^ACN(1234) or KILL ^ACN(1234,51) publish no tombstone. A key
+// template is expected to identify the node.
+//
+// When subtree is true, tombstones carry the TombstoneDeleteHeader. A KILL
+// is a subtree delete unless the state store knows the node had no
+// descendants.
+type TombstonePolicy struct {
+	mode    string
+	subtree bool
+}
+
+// NewTombstonePolicy returns the TombstonePolicy for the given mode
+func NewTombstonePolicy(mode string, subtree bool) (*TombstonePolicy, error) {
+	switch mode {
+	case "", TombstoneOff:
+		return &TombstonePolicy{mode: TombstoneOff}, nil
+	case TombstoneAlso, TombstoneOnly:
+		return &TombstonePolicy{mode: mode, subtree: subtree}, nil
+	}
+
+	return nil, errors.New("invalid tombstone mode " + mode)
+}
+
+// IsEnabled returns true if tombstones are published
+func (t *TombstonePolicy) IsEnabled() bool {
+	return t != nil && t.mode != TombstoneOff
+}
+
+func isKill(rec *JournalRecord) bool {
+	return rec.opcode == "KILL" || rec.opcode == "ZKILL"
+}
+
+// ReplacesEvent returns true if the JSON event of the unit is
+// not published because its tombstone is published instead
+func (t *TombstonePolicy) ReplacesEvent(unit *Unit, keys *KeyStrategy) bool {
+	return t.IsEnabled() && t.mode == TombstoneOnly &&
+		!unit.IsTransaction() && len(unit.Records) == 1 && isKill(unit.Records[0]) &&
+		ownsKey(keys, unit.Records[0])
+}
+
+// Tombstones returns the tombstone messages for all KILL and ZKILL in the unit
+func (t *TombstonePolicy) Tombstones(unit *Unit, keys *KeyStrategy) ([]*Message, error) {
+	if !t.IsEnabled() {
+		return nil, nil
+	}
+
+	var tombstones []*Message
+	for _, rec := range unit.Records {
+		if !isKill(rec) {
+			continue
+		}
+
+		if !ownsKey(keys, rec) {
+			log.Debugf("key of %s is shared with other nodes, tombstone not published", rec.detail.node)
+			continue
+		}
+
+		key, err := keys.Key(rec.Event())
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			// a tombstone without key does not delete anything
+			log.Warnf("no key for %s, tombstone not published", rec.opcode)
+			continue
+		}
+
+		tombstone := &Message{Key: key, Tombstone: true}
+		if t.subtree {
+			scope := "node"
+			if before := rec.detail.before; rec.opcode == "KILL" && (before == nil || len(before.deleted) > 0) {
+				scope = "subtree"
+			}
+			tombstone.Headers = map[string]string{TombstoneDeleteHeader: scope}
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+
+	return tombstones, nil
+}
+
+// ownsKey returns true if no node that is left after the KILL or ZKILL
+// of the node of the record has the same key
+func ownsKey(keys *KeyStrategy, rec *JournalRecord) bool {
+	if keys != nil && keys.strategy == KeyGlobalKey {
+		subscripts := len(rec.detail.node.Subscripts)
+		return subscripts == 0 || (subscripts == 1 && rec.opcode == "KILL")
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package gtmcdc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TombstonePolicy(t *testing.T) {
+	_, err := NewTombstonePolicy("sometimes", false)
+	assert.NotNil(t, err)
+
+	off, err := NewTombstonePolicy("off", true)
+	assert.Nil(t, err)
+	assert.False(t, off.IsEnabled())
+
+	keys, _ := NewKeyStrategy("global+subscripts")
+	recs := parseAll(t,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)`,
+		`10\65282,59700\29\0\0\29\0\0\0\0\^ACN(1234,52)`,
+		`05\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,53)="1"`,
+		`09\65282,59700\30\0\0\30\0\0\1\`,
+	)
+	kill := &Unit{Records: recs[:1], done: true}
+	tran := &Unit{Records: recs[:3], commit: recs[3], done: true}
+
+	tombstones, err := off.Tombstones(kill, keys)
+	assert.Nil(t, err)
+	assert.Empty(t, tombstones)
+
+	only, _ := NewTombstonePolicy("only", true)
+	assert.True(t, only.ReplacesEvent(kill, keys))
+	assert.False(t, only.ReplacesEvent(tran, keys))
+	assert.False(t, only.ReplacesEvent(&Unit{Records: recs[2:3], done: true}, keys))
+
+	tombstones, err = only.Tombstones(tran, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Message{
+		{Key: "ACN:1234:51", Tombstone: true, Headers: map[string]string{TombstoneDeleteHeader: "subtree"}},
+		{Key: "ACN:1234:52", Tombstone: true, Headers: map[string]string{TombstoneDeleteHeader: "node"}},
+	}, tombstones)
+
+	also, _ := NewTombstonePolicy("also", false)
+	assert.False(t, also.ReplacesEvent(kill, keys))
+	tombstones, err = also.Tombstones(kill, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Message{{Key: "ACN:1234:51", Tombstone: true}}, tombstones)
+
+	// no tombstone without a key
+	tombstones, err = also.Tombstones(kill, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, tombstones)
+}
+
+func Test_TombstonePolicy_GlobalKey(t *testing.T) {
+	keys, _ := NewKeyStrategy("global+key")
+	policy, _ := NewTombstonePolicy("also", true)
+
+	recs := parseAll(t,
+		`04\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234)`,
+		`10\65282,59700\29\0\0\29\0\0\0\0\^ACN(1234)`,
+		`04\65282,59700\30\0\0\30\0\0\0\0\^ACN(1234,51)`,
+		`10\65282,59700\31\0\0\31\0\0\0\0\^ACN(1234,51)`,
+	)
+
+	// only the KILL of ^ACN(1234) deletes everything with the key ACN:1234,
+	// the event is published when there is no tombstone
+	only, _ := NewTombstonePolicy("only", false)
+	for i, expected := range []int{1, 0, 0, 0} {
+		unit := &Unit{Records: recs[i : i+1], done: true}
+		tombstones, err := policy.Tombstones(unit, keys)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, len(tombstones), recs[i].opcode)
+		assert.Equal(t, expected == 1, only.ReplacesEvent(unit, keys))
+	}
+
+	// a KILL of a leaf is a node delete when the state is known
+	state, dir := testStateStore(t)
+	defer os.RemoveAll(dir)
+	defer state.Close()
+
+	assert.Nil(t, state.Apply(recs[0]))
+	tombstones, err := policy.Tombstones(&Unit{Records: recs[:1], done: true}, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{TombstoneDeleteHeader: "node"}, tombstones[0].Headers)
+}
+
+func Test_DoFilter_Tombstones(t *testing.T) {
+	sp := mocks.NewSyncProducer(t, nil)
+	producer := &Producer{syncProducer: sp, topic: "tombstones"}
+	defer producer.CleanupProducer()
+
+	keys, _ := NewKeyStrategy("global+subscripts")
+	tombstones, _ := NewTombstonePolicy("also", true)
+
+	// SET and KILL in the transaction, the KILL tombstone,
+	// a single KILL and its tombstone
+	for i := 0; i < 4; i++ {
+		sp.ExpectSendMessageAndSucceed()
+	}
+
+	tmpFile, err := testTempFileWithContent([]byte(
+		`08\65287,62154\3\0\0\3\0\0` + "\n" +
+			`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"` + "\n" +
+			`04\65287,62154\3\0\0\3\0\0\2\0\^ACN(1234,52)` + "\n" +
+			`09\65287,62154\3\0\0\3\0\0\1\` + "\n" +
+			`04\65287,62155\4\0\0\4\0\0\0\0\^ACN(5678)` + "\n"))
+	assert.Nil(t, err)
+	defer os.Remove(tmpFile)
+
+	metrics := InitMetrics()
+	prev := metrics.GetCounterValue("lines_parsed_and_published")
+
+	fin, fout := InitInputAndOutput(tmpFile, nullFile())
+	sinks := NewFanout(metrics)
+	sinks.Add(&KafkaSink{
+		Producer:    producer,
+		KeyStrategy: keys,
+		Tombstones:  tombstones,
+		Metrics:     metrics,
+	}, FailureRequire)
+	filter := &Filter{Sinks: sinks, Metrics: metrics}
+	filter.DoFilter(fin, fout)
+
+	assert.Equal(t, 4.0, metrics.GetCounterValue("lines_parsed_and_published")-prev)
+}
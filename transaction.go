@@ -0,0 +1,290 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TransactionEvent is an event published to Kafka for a committed
+// TSTART...TCOM or ZTSTART...ZTCOM transaction. It contains all the
+// updates within the transaction in the order they were journaled
+type TransactionEvent struct {
+	Operand        string          `json:"operand"`
+	TransactionNum string          `json:"transaction_num,omitempty"`
+	Token          string          `json:"token,omitempty"`
+	TokenSeq       int             `json:"token_seq"`
+	StreamNum      int             `json:"stream_num"`
+	StreamSeq      int             `json:"stream_seq"`
+	JournalSeq     int             `json:"journal_seq"`
+	Partners       string          `json:"partners,omitempty"`
+	TransactionTag string          `json:"transaction_tag,omitempty"`
+	TimeStamp      int64           `json:"time_stamp,omitempty"`
+	Updates        []*JournalEvent `json:"updates"`
+}
+
+// Unit is a group of journal records that are published together,
+// either a single journal record or all records of a committed transaction.
+// Lines are the raw journal extract lines of all records in the unit,
+// including TSTART and TCOM, that are written to the output once
+// the unit is published.
+type Unit struct {
+	Records []*JournalRecord
+	Lines   []string
+	commit  *JournalRecord
+	done    bool
+
+	// an uncommitted transaction released before its commit
+	abandoned bool
+	started   time.Time
+}
+
+// IsTransaction returns true if the unit is a committed transaction
+func (u *Unit) IsTransaction() bool {
+	return u.commit != nil
+}
+
+// IsCommitted returns false for a transaction that was started
+// but never committed before the end of input
+func (u *Unit) IsCommitted() bool {
+	return u.done
+}
+
+// JSON representation of the unit. A transaction is represented
+// by a TransactionEvent, otherwise it is the JSON of the only record.
+// An uncommitted transaction has no JSON representation
+func (u *Unit) JSON() (string, error) {
+	if !u.done {
+		return "", errors.New("transaction not committed")
+	}
+
+	if !u.IsTransaction() {
+		return u.Records[0].JSON()
+	}
+
+	bytes, err := json.Marshal(u.transactionEvent())
+	if err != nil {
+		return "", errors.New("unable to parse")
+	}
+
+	return string(bytes), nil
+}
+
+// isSuppressed returns true if the ChangeDetector suppressed all records
+// of the unit. A transaction with any changed record is published whole
+func (u *Unit) isSuppressed() bool {
+	for _, rec := range u.Records {
+		if !rec.detail.suppressed {
+			return false
+		}
+	}
+
+	return len(u.Records) > 0
+}
+
+// transactionEvent returns the TransactionEvent of a committed transaction
+func (u *Unit) transactionEvent() *TransactionEvent {
+	tcom := u.commit
+	event := TransactionEvent{
+		Operand:        tcom.opcode,
+		TransactionNum: tcom.tran.num,
+		Token:          tcom.tran.token,
+		TokenSeq:       tcom.tran.tokenSeq,
+		StreamNum:      tcom.repl.streamNum,
+		StreamSeq:      tcom.repl.streamSeq,
+		JournalSeq:     tcom.repl.journalSeq,
+		Partners:       tcom.tran.partners,
+		TransactionTag: tcom.tran.tag,
+		TimeStamp:      tcom.header.timestamp,
+		Updates:        make([]*JournalEvent, 0, len(u.Records)),
+	}
+
+	for _, rec := range u.Records {
+		event.Updates = append(event.Updates, rec.Event())
+	}
+
+	return &event
+}
+
+// TransactionAssembler groups journal records between TSTART and TCOM
+// (or ZTSTART and ZTCOM) into a single Unit. Units are released in the
+// same order the first of their records arrived, so that the order of
+// lines written to the output is the same as the input.
+//
+// The records after an uncommitted transaction are held back until it
+// is committed. A transaction with more than MaxLines lines, or started
+// more than Timeout ago when a record is added, is abandoned: its lines
+// and those of its later records are forwarded without being published.
+// An abandoned transaction is forgotten after the same limits, counted
+// in lines of input, so that one whose commit never arrives is not kept
+// forever. Zero means no limit.
+type TransactionAssembler struct {
+	MaxLines int
+	Timeout  time.Duration
+
+	pending   map[string]*Unit
+	abandoned map[string]abandonedAt
+	queue     []*Unit
+	lines     int // lines added so far
+	now       func() time.Time
+}
+
+// abandonedAt is when a transaction was abandoned
+type abandonedAt struct {
+	time time.Time
+	line int
+}
+
+// NewTransactionAssembler returns an empty TransactionAssembler
+func NewTransactionAssembler() *TransactionAssembler {
+	return &TransactionAssembler{
+		pending:   map[string]*Unit{},
+		abandoned: map[string]abandonedAt{},
+		now:       time.Now,
+	}
+}
+
+// isAbandoned returns true if the transaction was abandoned
+func (a *TransactionAssembler) isAbandoned(key string) bool {
+	_, exists := a.abandoned[key]
+	return exists
+}
+
+// TP transactions are identified by token_seq within a stream. ZTSTART
+// and ZTCOM have no stream, ZTP transactions are identified by the token
+func transactionKey(rec *JournalRecord) string {
+	if rec.opcode == "ZTSTART" || rec.opcode == "ZTCOM" {
+		return ztpKey(rec)
+	}
+	return fmt.Sprintf("%d:%d", rec.repl.streamNum, rec.tran.tokenSeq)
+}
+
+func ztpKey(rec *JournalRecord) string {
+	return fmt.Sprintf("z:%d", rec.tran.tokenSeq)
+}
+
+// updateKey returns the key of the transaction of an update, the
+// update of a ZTP transaction has the token as its token_seq
+func (a *TransactionAssembler) updateKey(rec *JournalRecord) string {
+	key := transactionKey(rec)
+	if _, exists := a.pending[key]; !exists && !a.isAbandoned(key) {
+		if ztp := ztpKey(rec); a.pending[ztp] != nil || a.isAbandoned(ztp) {
+			return ztp
+		}
+	}
+	return key
+}
+
+// Add a journal record along with its raw line to the assembler and
+// returns the units that are ready to be published, if any.
+func (a *TransactionAssembler) Add(rec *JournalRecord, line string) []*Unit {
+	key := transactionKey(rec)
+	a.lines++
+	a.forget()
+
+	switch rec.opcode {
+	case "TSTART", "ZTSTART":
+		if _, exists := a.pending[key]; exists {
+			log.Warnf("transaction %s started again before commit", key)
+		}
+		delete(a.abandoned, key)
+		unit := &Unit{Lines: []string{line}, started: a.now()}
+		a.pending[key] = unit
+		a.queue = append(a.queue, unit)
+
+	case "TCOM", "ZTCOM":
+		if a.isAbandoned(key) {
+			delete(a.abandoned, key)
+			a.queue = append(a.queue, &Unit{Lines: []string{line}, abandoned: true})
+			break
+		}
+		unit, exists := a.pending[key]
+		if !exists {
+			// commit without a start, e.g. the filter was started
+			// in the middle of a transaction
+			a.queue = append(a.queue, &Unit{Records: []*JournalRecord{rec}, Lines: []string{line}, done: true})
+			break
+		}
+		delete(a.pending, key)
+		unit.Lines = append(unit.Lines, line)
+		unit.commit = rec
+		unit.done = true
+
+	default:
+		key = a.updateKey(rec)
+		if key == ztpKey(rec) {
+			// the token_seq of an update in a ZTP transaction is the
+			// token, which is not a journal sequence number
+			rec.repl.journalSeq = 0
+		}
+		if a.isAbandoned(key) {
+			a.queue = append(a.queue, &Unit{Lines: []string{line}, abandoned: true})
+			break
+		}
+		if unit, exists := a.pending[key]; exists {
+			unit.Lines = append(unit.Lines, line)
+			if rec.detail.node != nil {
+				unit.Records = append(unit.Records, rec)
+			}
+			break
+		}
+		a.queue = append(a.queue, &Unit{Records: []*JournalRecord{rec}, Lines: []string{line}, done: true})
+	}
+
+	a.abandon()
+	return a.ready()
+}
+
+// abandon releases the transactions that exceed MaxLines or Timeout
+func (a *TransactionAssembler) abandon() {
+	now := a.now()
+	for key, unit := range a.pending {
+		tooLong := a.MaxLines > 0 && len(unit.Lines) > a.MaxLines
+		tooOld := a.Timeout > 0 && now.Sub(unit.started) > a.Timeout
+		if tooLong || tooOld {
+			log.Warnf("transaction %s not committed after %d lines, abandoned", key, len(unit.Lines))
+			delete(a.pending, key)
+			a.abandoned[key] = abandonedAt{time: now, line: a.lines}
+			unit.abandoned = true
+		}
+	}
+}
+
+// forget removes the abandoned transactions that exceed MaxLines or
+// Timeout since they were abandoned
+func (a *TransactionAssembler) forget() {
+	now := a.now()
+	for key, at := range a.abandoned {
+		tooLong := a.MaxLines > 0 && a.lines-at.line > a.MaxLines
+		tooOld := a.Timeout > 0 && now.Sub(at.time) > a.Timeout
+		if tooLong || tooOld {
+			log.Debugf("abandoned transaction %s not committed, forgotten", key)
+			delete(a.abandoned, key)
+		}
+	}
+}
+
+// Flush returns all remaining units, including transactions that
+// are not committed. It is called when the input is exhausted
+func (a *TransactionAssembler) Flush() []*Unit {
+	units := a.queue
+	a.queue = nil
+	a.pending = map[string]*Unit{}
+	a.abandoned = map[string]abandonedAt{}
+	return units
+}
+
+// ready removes the completed or abandoned units from the head of the queue
+func (a *TransactionAssembler) ready() []*Unit {
+	i := 0
+	for i < len(a.queue) && (a.queue[i].done || a.queue[i].abandoned) {
+		i++
+	}
+
+	units := a.queue[:i]
+	a.queue = a.queue[i:]
+	return units
+}
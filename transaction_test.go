@@ -0,0 +1,190 @@
+package gtmcdc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseAll(t *testing.T, lines ...string) []*JournalRecord {
+	recs := make([]*JournalRecord, len(lines))
+	for i, line := range lines {
+		rec, err := Parse(line)
+		assert.Nil(t, err)
+		recs[i] = rec
+	}
+	return recs
+}
+
+func Test_TransactionAssembler_TP(t *testing.T) {
+	lines := []string{
+		`08\65287,62154\3\0\0\3\0\0`,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"`,
+		`04\65287,62154\3\0\0\3\0\0\2\0\^ACN(1234,52)`,
+		`09\65287,62154\3\0\0\3\0\0\1\BATCH`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, a.Add(recs[i], lines[i]))
+	}
+
+	units := a.Add(recs[3], lines[3])
+	assert.Equal(t, 1, len(units))
+	assert.True(t, units[0].IsTransaction())
+	assert.Equal(t, lines, units[0].Lines)
+	assert.Equal(t, 2, len(units[0].Records))
+
+	jsonstr, err := units[0].JSON()
+	assert.Nil(t, err)
+
+	event := TransactionEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(jsonstr), &event))
+	assert.Equal(t, "TCOM", event.Operand)
+	assert.Equal(t, "1", event.Partners)
+	assert.Equal(t, "BATCH", event.TransactionTag)
+	assert.Equal(t, 2, len(event.Updates))
+	assert.Equal(t, "SET", event.Updates[0].Operand)
+	assert.Equal(t, "KILL", event.Updates[1].Operand)
+	assert.Equal(t, []string{"52"}, event.Updates[1].Subscripts)
+}
+
+func Test_TransactionAssembler_Order(t *testing.T) {
+	lines := []string{
+		`08\65287,62154\3\0\0\3\0\0`,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"`,
+		`05\65287,62155\4\0\0\4\0\0\0\0\^ACN(5678,51)="200.00"`,
+		`09\65287,62154\3\0\0\3\0\0\1\`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	assert.Empty(t, a.Add(recs[0], lines[0]))
+	assert.Empty(t, a.Add(recs[1], lines[1]))
+	// the record outside the transaction waits for the transaction
+	assert.Empty(t, a.Add(recs[2], lines[2]))
+
+	units := a.Add(recs[3], lines[3])
+	assert.Equal(t, 2, len(units))
+	assert.True(t, units[0].IsTransaction())
+	assert.False(t, units[1].IsTransaction())
+	assert.Equal(t, []string{lines[2]}, units[1].Lines)
+}
+
+func Test_TransactionAssembler_ZTP(t *testing.T) {
+	lines := []string{
+		`06\65287,62156\5\0\0\9001`,
+		`05\65287,62156\5\0\0\9001\0\0\1\0\^ACN(5678,51)="300.00"`,
+		`07\65287,62156\5\0\0\9001\1`,
+	}
+	recs := parseAll(t, lines...)
+	assert.Equal(t, "9001", recs[0].tran.token)
+
+	a := NewTransactionAssembler()
+	a.Add(recs[0], lines[0])
+	a.Add(recs[1], lines[1])
+	units := a.Add(recs[2], lines[2])
+	assert.Equal(t, 1, len(units))
+
+	// the token is not the journal_seq of the update
+	assert.Equal(t, 0, recs[1].repl.journalSeq)
+
+	jsonstr, err := units[0].JSON()
+	assert.Nil(t, err)
+	assert.Contains(t, jsonstr, `"operand":"ZTCOM","transaction_num":"5","token":"9001"`)
+}
+
+func Test_TransactionAssembler_Flush(t *testing.T) {
+	lines := []string{
+		`08\65287,62154\3\0\0\3\0\0`,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	a.Add(recs[0], lines[0])
+	a.Add(recs[1], lines[1])
+
+	units := a.Flush()
+	assert.Equal(t, 1, len(units))
+	assert.False(t, units[0].IsCommitted())
+	assert.Equal(t, lines, units[0].Lines)
+
+	_, err := units[0].JSON()
+	assert.NotNil(t, err)
+	assert.Empty(t, a.Flush())
+}
+
+func Test_TransactionAssembler_ZTPStream(t *testing.T) {
+	// ZTSTART and ZTCOM have no stream, the updates do
+	lines := []string{
+		`06\65287,62156\5\0\0\9001`,
+		`05\65287,62156\5\0\0\9001\2\7\1\0\^ACN(5678,51)="300.00"`,
+		`07\65287,62156\5\0\0\9001\1`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	assert.Empty(t, a.Add(recs[0], lines[0]))
+	assert.Empty(t, a.Add(recs[1], lines[1]))
+	units := a.Add(recs[2], lines[2])
+	assert.Equal(t, 1, len(units))
+	assert.True(t, units[0].IsTransaction())
+	assert.Equal(t, 1, len(units[0].Records))
+}
+
+func Test_TransactionAssembler_Abandon(t *testing.T) {
+	lines := []string{
+		`08\65287,62154\3\0\0\3\0\0`,
+		`05\65287,62154\3\0\0\3\0\0\1\0\^ACN(1234,51)="100.00"`,
+		`05\65287,62155\4\0\0\4\0\0\0\0\^ACN(5678,51)="200.00"`,
+		`05\65287,62154\3\0\0\3\0\0\2\0\^ACN(1234,52)="1"`,
+		`09\65287,62154\3\0\0\3\0\0\1\`,
+	}
+	recs := parseAll(t, lines...)
+
+	a := NewTransactionAssembler()
+	a.MaxLines = 2
+	assert.Empty(t, a.Add(recs[0], lines[0]))
+	assert.Empty(t, a.Add(recs[1], lines[1]))
+	assert.Empty(t, a.Add(recs[2], lines[2]))
+
+	// the transaction is released uncommitted once it has 3 lines,
+	// followed by the record that waited for it
+	units := a.Add(recs[3], lines[3])
+	assert.Equal(t, 2, len(units))
+	assert.False(t, units[0].IsCommitted())
+	assert.Equal(t, []string{lines[0], lines[1], lines[3]}, units[0].Lines)
+	assert.True(t, units[1].IsCommitted())
+
+	// the rest of the transaction is forwarded without being published
+	units = a.Add(recs[4], lines[4])
+	assert.Equal(t, 1, len(units))
+	assert.False(t, units[0].IsCommitted())
+	assert.Empty(t, units[0].Records)
+	assert.Empty(t, a.abandoned)
+
+	now := time.Now()
+	a = NewTransactionAssembler()
+	a.Timeout = time.Minute
+	a.now = func() time.Time { return now }
+	assert.Empty(t, a.Add(recs[0], lines[0]))
+	assert.Empty(t, a.Add(recs[1], lines[1]))
+
+	now = now.Add(2 * time.Minute)
+	units = a.Add(recs[2], lines[2])
+	assert.Equal(t, 2, len(units))
+	assert.False(t, units[0].IsCommitted())
+
+	// an abandoned transaction whose commit never arrives is forgotten,
+	// its later records are published on their own
+	assert.Equal(t, 1, len(a.abandoned))
+	now = now.Add(2 * time.Minute)
+	units = a.Add(recs[3], lines[3])
+	assert.Empty(t, a.abandoned)
+	assert.Equal(t, 1, len(units))
+	assert.True(t, units[0].IsCommitted())
+}
@@ -0,0 +1,366 @@
+package gtmcdc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SinkWebhook is the name of the HTTP webhook sink in GTMCDC_SINKS
+const SinkWebhook = "webhook"
+
+// WebhookSignatureHeader carries the HMAC-SHA256 of the request body
+// in the form sha256=<hex> when a secret is configured
+const WebhookSignatureHeader = "X-Gtmcdc-Signature"
+
+// Error Messages
+const (
+	ErrorCircuitOpen = "circuit breaker is open"
+)
+
+// webhookItem is a unit waiting in the batch to be posted
+type webhookItem struct {
+	events []string
+	ack    func(err error)
+}
+
+// WebhookSink posts the JSON of journal records to a URL. When batchSize
+// is 1 every record is posted as a JSON object, otherwise records are
+// posted as JSON arrays of up to batchSize records, or less if no more
+// records arrive within linger. Requests that fail with a network error,
+// 429 or 5xx are retried with exponential backoff. After a number of
+// consecutive failed requests the circuit breaker opens, and the sink
+// is not healthy until the cooldown is over. Records are not spooled, what
+// happens to the records of a failed request depends on the failure policy
+// of the sink: with require the unit is published again and the filter
+// stops when it still fails, so no record is lost, with ignore the records
+// are dropped and the journal lines are passed on.
+type WebhookSink struct {
+	url        string
+	headers    http.Header
+	secret     []byte
+	client     *http.Client
+	batchSize  int
+	linger     time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	breaker    *circuitBreaker
+	metrics    *Metrics
+
+	sending sync.Mutex
+	mu      sync.Mutex
+	batch   []*webhookItem
+	size    int
+	timer   *time.Timer
+}
+
+// NewWebhookSink creates the webhook sink from the configuration
+func NewWebhookSink(conf *Config, metrics *Metrics) (*WebhookSink, error) {
+	if conf.WebhookURL == "" || conf.WebhookURL == "off" {
+		return nil, errors.New("invalid webhook url")
+	}
+
+	headers := http.Header{}
+	for _, header := range conf.WebhookHeaders {
+		i := strings.Index(header, ":")
+		if i < 1 {
+			return nil, errors.New("invalid webhook header " + header)
+		}
+		headers.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+
+	batchSize := conf.WebhookBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &WebhookSink{
+		url:        conf.WebhookURL,
+		headers:    headers,
+		secret:     []byte(conf.WebhookHMACSecret),
+		client:     &http.Client{Timeout: conf.WebhookTimeout},
+		batchSize:  batchSize,
+		linger:     conf.WebhookLinger,
+		retries:    conf.WebhookRetries,
+		backoff:    conf.WebhookBackoff,
+		maxBackoff: conf.WebhookMaxBackoff,
+		breaker: &circuitBreaker{
+			threshold: conf.WebhookBreakerThreshold,
+			cooldown:  conf.WebhookBreakerCooldown,
+		},
+		metrics: metrics,
+	}, nil
+}
+
+// Name returns the name of the sink
+func (w *WebhookSink) Name() string {
+	return SinkWebhook
+}
+
+// Publish posts the records of the unit and returns once they are accepted
+func (w *WebhookSink) Publish(unit *Unit) error {
+	events, err := unitEvents(unit)
+	if err != nil {
+		return err
+	}
+
+	w.sending.Lock()
+	defer w.sending.Unlock()
+
+	if w.batchSize > 1 {
+		return w.post(events)
+	}
+
+	for _, event := range events {
+		if err := w.post([]string{event}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsAsync returns true if records of different units are posted in batches
+func (w *WebhookSink) IsAsync() bool {
+	return w.batchSize > 1
+}
+
+// PublishAsync adds the records of the unit to the batch, the batch is
+// posted once it is full or linger has passed since the first unit in it
+func (w *WebhookSink) PublishAsync(unit *Unit, track func(), ack func(err error)) {
+	events, err := unitEvents(unit)
+	track()
+	if err != nil {
+		ack(err)
+		return
+	}
+
+	w.mu.Lock()
+	w.batch = append(w.batch, &webhookItem{events: events, ack: ack})
+	w.size += len(events)
+	full := w.size >= w.batchSize
+	if !full && w.timer == nil {
+		w.timer = time.AfterFunc(w.linger, func() {
+			_ = w.Flush()
+		})
+	}
+	w.mu.Unlock()
+
+	if full {
+		_ = w.Flush()
+	}
+}
+
+// Flush posts the records in the batch and acknowledges their units
+func (w *WebhookSink) Flush() error {
+	// batches are posted one at a time to keep the order
+	w.sending.Lock()
+	defer w.sending.Unlock()
+
+	w.mu.Lock()
+	batch := w.batch
+	w.batch, w.size = nil, 0
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var events []string
+	for _, item := range batch {
+		events = append(events, item.events...)
+	}
+
+	err := w.post(events)
+	for _, item := range batch {
+		item.ack(err)
+	}
+
+	return err
+}
+
+// Close posts the remaining records
+func (w *WebhookSink) Close() error {
+	return w.Flush()
+}
+
+// Healthy returns false while the circuit breaker is open
+func (w *WebhookSink) Healthy() bool {
+	return w.breaker.ready()
+}
+
+// unitEvents returns the JSON of the records of the unit
+func unitEvents(unit *Unit) ([]string, error) {
+	events := make([]string, 0, len(unit.Records))
+	for _, rec := range unit.Records {
+		jsonstr, err := rec.JSON()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, jsonstr)
+	}
+
+	return events, nil
+}
+
+// post the events as a JSON object if there is only one and the sink is
+// not batching, otherwise as a JSON array
+func (w *WebhookSink) post(events []string) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	body := events[0]
+	if w.batchSize > 1 {
+		body = "[" + strings.Join(events, ",") + "]"
+	}
+
+	if !w.breaker.allow() {
+		return errors.New(ErrorCircuitOpen)
+	}
+
+	start := time.Now()
+	err := w.postWithRetry([]byte(body))
+	w.breaker.record(err == nil)
+	if err != nil {
+		w.metrics.IncrCounter("webhook_requests_failed")
+		return err
+	}
+
+	w.metrics.IncrCounter("webhook_requests_succeeded")
+	elapsed := time.Since(start)
+	w.metrics.HistoObserve("webhook_post", float64(elapsed/time.Microsecond))
+
+	return nil
+}
+
+func (w *WebhookSink) postWithRetry(body []byte) error {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.postOnce(body)
+		if err == nil || !retry || attempt >= w.retries {
+			return err
+		}
+
+		log.Infof("webhook request failed, retry in %v. %+v", backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// postOnce sends one request, retry is true if the request can be retried
+func (w *WebhookSink) postOnce(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		_, _ = mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook responded with %s", resp.Status)
+}
+
+// circuitBreaker opens after threshold consecutive failures and allows
+// a single trial request once cooldown has passed since it was opened,
+// further requests fail until the result of the trial is recorded. A
+// threshold of 0 disables the circuit breaker
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	opened    time.Time
+	trial     bool
+}
+
+// allow returns true if a request can be sent, once the cooldown is
+// over it returns true for the trial request only
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.isReady() {
+		return false
+	}
+	if b.isOpen() {
+		b.trial = true
+	}
+	return true
+}
+
+// ready returns true if a request would be allowed, without
+// taking the trial request
+func (b *circuitBreaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.isReady()
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+func (b *circuitBreaker) isReady() bool {
+	return !b.isOpen() || (!b.trial && time.Since(b.opened) >= b.cooldown)
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Warnf("circuit breaker opened after %d failures", b.failures)
+		}
+		b.opened = time.Now()
+	}
+}
@@ -0,0 +1,183 @@
+package gtmcdc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testWebhookServer records the bodies of the requests and responds with
+// the given status codes in turn, 200 once they are used up
+type testWebhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	statuses []int
+}
+
+func newTestWebhookServer(statuses ...int) *testWebhookServer {
+	s := &testWebhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		if status == http.StatusOK {
+			s.bodies = append(s.bodies, string(body))
+			s.headers = append(s.headers, r.Header)
+		}
+		w.WriteHeader(status)
+	}))
+
+	return s
+}
+
+func testWebhookConfig(url string) *Config {
+	return &Config{
+		WebhookURL:              url,
+		WebhookBatchSize:        1,
+		WebhookLinger:           10 * time.Millisecond,
+		WebhookTimeout:          time.Second,
+		WebhookRetries:          2,
+		WebhookBackoff:          time.Millisecond,
+		WebhookMaxBackoff:       time.Millisecond,
+		WebhookBreakerThreshold: 2,
+		WebhookBreakerCooldown:  time.Hour,
+	}
+}
+
+func Test_WebhookSink_Publish(t *testing.T) {
+	server := newTestWebhookServer(http.StatusServiceUnavailable)
+	defer server.Close()
+
+	conf := testWebhookConfig(server.URL)
+	conf.WebhookHeaders = []string{"Authorization: Bearer token"}
+	conf.WebhookHMACSecret = "secret"
+
+	sink, err := NewWebhookSink(conf, InitMetrics())
+	assert.Nil(t, err)
+
+	recs := parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`)
+	// the first request fails and is retried
+	assert.Nil(t, sink.Publish(&Unit{Records: recs, done: true}))
+
+	assert.Equal(t, 1, len(server.bodies))
+	event := JournalEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(server.bodies[0]), &event))
+	assert.Equal(t, "ACN", event.Global)
+
+	header := server.headers[0]
+	assert.Equal(t, "Bearer token", header.Get("Authorization"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write([]byte(server.bodies[0]))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), header.Get(WebhookSignatureHeader))
+
+	_, err = NewWebhookSink(&Config{WebhookURL: "off"}, nil)
+	assert.NotNil(t, err)
+	conf.WebhookHeaders = []string{"no colon"}
+	_, err = NewWebhookSink(conf, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_WebhookSink_CircuitBreaker(t *testing.T) {
+	server := newTestWebhookServer(http.StatusBadRequest, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusInternalServerError)
+	defer server.Close()
+
+	sink, err := NewWebhookSink(testWebhookConfig(server.URL), InitMetrics())
+	assert.Nil(t, err)
+
+	unit := &Unit{Records: parseAll(t, `05\65282,59700\28\0\0\28\0\0\0\0\^ACN(1234,51)="1"`), done: true}
+
+	// 400 is not retried, 500 is retried until retries are used up
+	assert.NotNil(t, sink.Publish(unit))
+	assert.True(t, sink.Healthy())
+	assert.NotNil(t, sink.Publish(unit))
+	assert.False(t, sink.Healthy())
+
+	// fails fast while the circuit breaker is open
+	assert.EqualError(t, sink.Publish(unit), ErrorCircuitOpen)
+	assert.Empty(t, server.bodies)
+
+	sink.breaker.cooldown = 0
+	assert.True(t, sink.Healthy())
+	assert.Nil(t, sink.Publish(unit))
+	assert.Equal(t, 0, sink.breaker.failures)
+}
+
+func Test_circuitBreaker(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 2}
+
+	breaker.record(false)
+	assert.True(t, breaker.allow())
+	breaker.record(false)
+
+	// a single trial once the cooldown is over, ready does not take it
+	assert.True(t, breaker.ready())
+	assert.True(t, breaker.ready())
+	assert.True(t, breaker.allow())
+	assert.False(t, breaker.ready())
+	assert.False(t, breaker.allow())
+
+	// the failed trial opens the circuit breaker again
+	breaker.record(false)
+	breaker.cooldown = time.Hour
+	assert.False(t, breaker.allow())
+	breaker.cooldown = 0
+	assert.True(t, breaker.allow())
+
+	breaker.record(true)
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.allow())
+}
+
+func Test_DoFilter_WebhookBatch(t *testing.T) {
+	server := newTestWebhookServer()
+	defer server.Close()
+
+	metrics := InitMetrics()
+	conf := testWebhookConfig(server.URL)
+	conf.WebhookBatchSize = 3
+	sink, err := NewWebhookSink(conf, metrics)
+	assert.Nil(t, err)
+
+	sinks := NewFanout(metrics)
+	sinks.Add(sink, FailureRequire)
+
+	output, err := testTempFileWithContent([]byte(""))
+	assert.Nil(t, err)
+	defer os.Remove(output)
+
+	fin, fout := InitInputAndOutput("testdata/test_tp.txt", output)
+	(&Filter{Sinks: sinks, MaxInFlight: 10, Metrics: metrics}).DoFilter(fin, fout)
+	_ = fout.Close()
+
+	// the 2 updates of the transaction and the single SET fill the first
+	// batch, the update of the ZTP transaction is posted after linger
+	assert.Equal(t, 2, len(server.bodies))
+	var events []*JournalEvent
+	assert.Nil(t, json.Unmarshal([]byte(server.bodies[0]), &events))
+	assert.Equal(t, 3, len(events))
+	assert.Nil(t, json.Unmarshal([]byte(server.bodies[1]), &events))
+	assert.Equal(t, 1, len(events))
+
+	expected, _ := ioutil.ReadFile("testdata/test_tp.txt")
+	actual, _ := ioutil.ReadFile(output)
+	assert.Equal(t, string(expected), string(actual))
+}
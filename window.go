@@ -0,0 +1,125 @@
+package gtmcdc
+
+import (
+	"os"
+	"sync"
+)
+
+// pendingUnit is a unit whose messages are sent but not all acknowledged yet.
+// skip is set for units that are written to the output without publishing,
+// stop for units whose failure stops the filter
+type pendingUnit struct {
+	unit      *Unit
+	remaining int
+	sent      bool
+	failed    bool
+	skip      bool
+	stop      bool
+}
+
+// window keeps the units that are sent to async sinks in input order.
+// The lines of a unit are written to the output only after all its
+// messages are acknowledged and all units before it are written, so the
+// output has the same order as the input. The number of messages sent but
+// not acknowledged is bounded by the size of slots.
+type window struct {
+	mu      sync.Mutex
+	queue   []*pendingUnit
+	slots   chan struct{}
+	pending sync.WaitGroup
+	stopped bool
+	fout    *os.File
+	filter  *Filter
+}
+
+func newWindow(filter *Filter, fout *os.File, maxInFlight int) *window {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	return &window{
+		slots:  make(chan struct{}, maxInFlight),
+		fout:   fout,
+		filter: filter,
+	}
+}
+
+// add a unit to the end of the window, returns false if the
+// window is stopped because of an earlier failure
+func (w *window) add(pu *pendingUnit) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return false
+	}
+
+	w.pending.Add(1)
+	w.queue = append(w.queue, pu)
+	return true
+}
+
+// track blocks until the number of messages in flight is below the limit
+// and then counts one more message in flight for the unit
+func (w *window) track(pu *pendingUnit) {
+	w.slots <- struct{}{}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pu.remaining++
+}
+
+// ack is called when a message of a unit is acknowledged, or failed
+// when err is not nil
+func (w *window) ack(pu *pendingUnit, err error) {
+	<-w.slots
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pu.remaining--
+	if err != nil {
+		pu.failed = true
+		pu.stop = pu.stop || IsStop(err)
+	}
+	w.flush()
+}
+
+// sent is called after all messages of a unit are sent
+func (w *window) sent(pu *pendingUnit) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pu.sent = true
+	w.flush()
+}
+
+// flush writes out the completed units at the head of the window. Once a
+// unit stops the filter, neither it nor any unit after it is written out.
+// must be called with the lock held
+func (w *window) flush() {
+	i := 0
+	for ; i < len(w.queue); i++ {
+		pu := w.queue[i]
+		if !pu.sent || pu.remaining > 0 {
+			break
+		}
+
+		w.stopped = w.stopped || pu.stop
+		if !w.stopped {
+			if !pu.failed && !pu.skip {
+				w.filter.updateCheckpoint(pu.unit)
+			}
+			w.filter.writeLines(pu.unit, w.fout)
+		}
+		w.pending.Done()
+	}
+
+	w.queue = w.queue[i:]
+}
+
+// wait until all units in the window are written out
+func (w *window) wait() {
+	w.pending.Wait()
+}